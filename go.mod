@@ -17,6 +17,7 @@ require (
 	github.com/grandcat/zeroconf v1.0.0
 	github.com/h2non/go-is-svg v0.0.0-20160927212452-35e8c4b0612c
 	github.com/hashicorp/go-version v1.2.0
+	github.com/klauspost/compress v1.11.6
 	github.com/otiai10/copy v1.4.1
 	github.com/probonopd/go-zsyncmake v0.0.0-20181008012426-5db478ac2be7
 	github.com/prometheus/procfs v0.2.0
@@ -27,6 +28,7 @@ require (
 	github.com/shuheiktgw/go-travis v0.3.1
 	github.com/srwiley/oksvg v0.0.0-20200311192757-870daf9aa564
 	github.com/srwiley/rasterx v0.0.0-20200120212402-85cb7272f5e9
+	github.com/ulikunitz/xz v0.5.9
 	github.com/urfave/cli/v2 v2.3.0
 	go.lsp.dev/uri v0.3.0
 	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
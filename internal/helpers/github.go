@@ -3,12 +3,31 @@ package helpers
 import (
 	"context"
 	"errors"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/google/go-github/github" // with go modules disabled
 )
 
+// GitHubAPIURL is where the GitHub API is; it can be changed, e.g., for testing
+var GitHubAPIURL = "https://api.github.com/"
+
+// GitHubHTTPClient is used to talk to the GitHub API; if it is nil, http.DefaultClient is used
+var GitHubHTTPClient *http.Client
+
+// newGitHubClient returns a client for the GitHub API at GitHubAPIURL using GitHubHTTPClient
+func newGitHubClient() *github.Client {
+	client := github.NewClient(GitHubHTTPClient)
+	u, err := url.Parse(GitHubAPIURL)
+	if err == nil {
+		client.BaseURL = u
+	}
+	return client
+}
+
 // GetCommitMessageForLatestCommit gets the commit message for the latest commit
 // (currently only on GitHub) using UpdateInformation. Returns commit string and err
 // Can get rather quickly:
@@ -19,7 +38,7 @@ func GetCommitMessageForLatestCommit(ui UpdateInformation) (string, error) {
 
 	if ui.transportmechanism == "gh-releases-zsync" {
 
-		client := github.NewClient(nil)
+		client := newGitHubClient()
 		var TravisCommit string
 		release, _, err := client.Repositories.GetReleaseByTag(context.Background(), ui.username, ui.repository, ui.releasename)
 		if err == nil {
@@ -52,7 +71,7 @@ func GetReleaseURL(ui UpdateInformation) (string, error) {
 
 	if ui.transportmechanism == "gh-releases-zsync" {
 
-		client := github.NewClient(nil)
+		client := newGitHubClient()
 
 		release, _, err := client.Repositories.GetReleaseByTag(context.Background(), ui.username, ui.repository, ui.releasename)
 		if err == nil {
@@ -70,11 +89,40 @@ func GetReleaseURL(ui UpdateInformation) (string, error) {
 	return "", errors.New("GetReleaseURL: Could not get URL")
 }
 
+// GetReleaseAssetURL gets the download URL of the asset of the release
+// (currently only on GitHub) whose name matches the file name in the given UpdateInformation,
+// which can contain * as a wildcard. Returns URL string and err
+func GetReleaseAssetURL(ui UpdateInformation) (string, error) {
+
+	if ui.transportmechanism != "gh-releases-zsync" {
+		return "", errors.New("Not yet implemented for this transport mechanism")
+	}
+
+	client := newGitHubClient()
+
+	var release *github.RepositoryRelease
+	var err error
+	if ui.releasename == "latest" {
+		release, _, err = client.Repositories.GetLatestRelease(context.Background(), ui.username, ui.repository)
+	} else {
+		release, _, err = client.Repositories.GetReleaseByTag(context.Background(), ui.username, ui.repository, ui.releasename)
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, asset := range release.Assets {
+		if ok, _ := filepath.Match(ui.filename, asset.GetName()); ok == true {
+			return asset.GetBrowserDownloadURL(), nil
+		}
+	}
+	return "", errors.New("GetReleaseAssetURL: No asset matching " + ui.filename + " in " + release.GetHTMLURL())
+}
+
 // GetCommitMessageForThisCommitOnTravis returns a string with the most
 // recent commit message for the commit in the TRAVIS_COMMIT environment variable, and error
 func GetCommitMessageForThisCommitOnTravis() (string, error) {
 
-	client := github.NewClient(nil)
+	client := newGitHubClient()
 
 	TravisCommit := os.Getenv("TRAVIS_COMMIT")
 	if TravisCommit == "" {
@@ -119,6 +119,20 @@ func ValidateUpdateInformation(updateinformation string) error {
 	return nil
 }
 
+// ZsyncURL returns the URL of the zsync file that describes the most recent
+// AppImage for the UpdateInformation, and err.
+// For gh-releases-zsync this asks GitHub for the matching release asset
+func (ui UpdateInformation) ZsyncURL() (string, error) {
+	switch ui.transportmechanism {
+	case "zsync":
+		return ui.fileurl, nil
+	case "gh-releases-zsync":
+		return GetReleaseAssetURL(ui)
+	default:
+		return "", errors.New("Not yet implemented for this transport mechanism")
+	}
+}
+
 func getChangelogHeadlineForUpdateInformation(updateinformation string) string {
 	return ""
 }
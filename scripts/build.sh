@@ -60,16 +60,23 @@ go get -d -v ./...
 go build -o $GOPATH/src -v -trimpath -ldflags="-s -w -X main.commit=$COMMIT" ./src/...
 mv $GOPATH/src/appimaged $GOPATH/src/appimaged-$(go env GOHOSTARCH)
 mv $GOPATH/src/appimagetool $GOPATH/src/appimagetool-$(go env GOHOSTARCH)
+# The compiled AppRun must not depend on any libraries
+env CGO_ENABLED=0 go build -o $GOPATH/src/apprun-$(go env GOHOSTARCH) -v -trimpath -ldflags="-s -w" ./src/apprun
+rm -f $GOPATH/src/apprun
 
 # 32-bit
 if [ $(go env GOHOSTARCH) == "amd64" ] ; then 
   env CGO_ENABLED=1 GOOS=linux GOARCH=386 go build -o $GOPATH/src -v -trimpath -ldflags="-s -w -X main.commit=$COMMIT" ./src/...
   mv $GOPATH/src/appimaged $GOPATH/src/appimaged-386
   mv $GOPATH/src/appimagetool $GOPATH/src/appimagetool-386
+  env CGO_ENABLED=0 GOOS=linux GOARCH=386 go build -o $GOPATH/src/apprun-386 -v -trimpath -ldflags="-s -w" ./src/apprun
+  rm -f $GOPATH/src/apprun
 elif [ $(go env GOHOSTARCH) == "arm64" ] ; then
   env CC=arm-linux-gnueabi-gcc CGO_ENABLED=1 GOOS=linux GOARCH=arm GOARM=6 go build -o $GOPATH/src -v -trimpath -ldflags="-s -w -X main.commit=$COMMIT" ./src/...
   mv $GOPATH/src/appimaged $GOPATH/src/appimaged-arm
   mv $GOPATH/src/appimagetool $GOPATH/src/appimagetool-arm
+  env CGO_ENABLED=0 GOOS=linux GOARCH=arm GOARM=6 go build -o $GOPATH/src/apprun-arm -v -trimpath -ldflags="-s -w" ./src/apprun
+  rm -f $GOPATH/src/apprun
 fi
 
 ##############################################################
@@ -117,6 +124,7 @@ mkdir -p appimagetool.AppDir/usr/bin
 ( cd appimagetool.AppDir/usr/bin/ ; wget -c https://github.com/probonopd/uploadtool/raw/master/upload.sh -O uploadtool )
 chmod +x appimagetool.AppDir/usr/bin/*
 cp appimagetool-$(go env GOHOSTARCH) appimagetool.AppDir/usr/bin/appimagetool
+cp apprun-$(go env GOHOSTARCH) appimagetool.AppDir/usr/bin/apprun # For deploy --native-apprun
 ( cd appimagetool.AppDir/ ; ln -s usr/bin/appimagetool AppRun)
 cp $TRAVIS_BUILD_DIR/data/appimage.png appimagetool.AppDir/
 cat > appimagetool.AppDir/appimagetool.desktop <<\EOF
@@ -4,10 +4,6 @@ import (
 	"bytes"
 	"crypto/md5"
 	"encoding/hex"
-	"io/ioutil"
-	"net/url"
-
-	"gopkg.in/ini.v1"
 
 	"log"
 	"os"
@@ -51,8 +47,13 @@ func NewAppImage(path string) (ai *AppImage, err error) {
 
 	ai.uri = strings.TrimSpace(string(uri.File(filepath.Clean(ai.Path))))
 	ai.md5 = ai.calculateMD5filenamepart() // Need this also for non-existing AppImages for removal
-	ai.desktopfilename = "appimagekit_" + ai.md5 + ".desktop"
-	ai.desktopfilepath = xdg.DataHome + "/applications/" + "appimagekit_" + ai.md5 + ".desktop"
+	ai.setDesktopFileName("appimagekit_" + ai.md5 + ".desktop")
+	if registry != nil {
+		// The desktop file may be named after the application, see desktopid.go
+		if entry, _ := registry.Lookup(ai.Path); entry.DesktopFile != "" {
+			ai.setDesktopFileName(filepath.Base(entry.DesktopFile))
+		}
+	}
 	ai.thumbnailfilename = ai.md5 + ".png"
 	if strings.HasSuffix(ThumbnailsDirNormal, "/") {
 		ai.thumbnailfilepath = ThumbnailsDirNormal + ai.thumbnailfilename
@@ -67,6 +68,12 @@ func NewAppImage(path string) (ai *AppImage, err error) {
 	return ai, nil
 }
 
+// setDesktopFileName sets the name of the desktop file of the AppImage
+func (ai *AppImage) setDesktopFileName(name string) {
+	ai.desktopfilename = name
+	ai.desktopfilepath = xdg.DataHome + "/applications/" + name
+}
+
 func (ai AppImage) calculateMD5filenamepart() string {
 	hasher := md5.New()
 	hasher.Write([]byte(ai.uri))
@@ -141,9 +148,27 @@ func (ai AppImage) _integrate() {
 
 	ai.setExecBit()
 
+	// Remember what we know about this AppImage, including the files written below
+	defer func() {
+		_, err := registry.Update(&ai)
+		helpers.LogError("appimage: registry", err)
+	}()
+
+	// Whether what the registry knows about the AppImage is still true, in which case it was not updated
+	_, unchanged := registry.Lookup(ai.Path)
+
+	// Name the desktop file after the application if this is its most recent AppImage
+	previous := ai.desktopfilename
+	if entry, err := registry.Update(&ai); err == nil {
+		if entry.DesktopFile == "" {
+			previous = "" // Not integrated yet, nothing to migrate
+		}
+		ai.setDesktopFileName(assignDesktopFile(entry, previous))
+	}
+
 	// For performance reasons, we stop working immediately
 	// in case a desktop file already exists at that location
-	if *overwritePtr == false {
+	if *overwritePtr == false && previous == ai.desktopfilename {
 		// Compare mtime of desktop file and AppImage, similar to
 		// https://specifications.freedesktop.org/thumbnail-spec/thumbnail-spec-latest.html#MODIFICATIONS
 		if desktopFileInfo, err := os.Stat(ai.desktopfilepath); err == nil {
@@ -168,8 +193,19 @@ func (ai AppImage) _integrate() {
 	// 	return
 	// }
 
+	_, err := os.Stat(ai.desktopfilepath)
+	alreadyIntegrated := err == nil
+
 	writeDesktopFile(ai) // Do not run with "go" as it would interfere with extractDirIconAsThumbnail
 
+	if alreadyIntegrated == true {
+		if unchanged == false {
+			emitDBusSignal("Updated", ai.Path, ai.md5)
+		}
+	} else {
+		emitDBusSignal("Added", ai.Path, ai.md5)
+	}
+
 	// Subscribe to MQTT messages for this application
 	if ai.updateinformation != "" {
 		if CheckIfConnectedToNetwork() == true {
@@ -202,6 +238,8 @@ func (ai AppImage) _integrate() {
 // Do not call this directly. Instead, call IntegrateOrUnintegrate
 func (ai AppImage) _removeIntegration() {
 	log.Println("appimage: Remove integration", ai.Path)
+	entry, _ := registry.Lookup(ai.Path)
+	registry.Remove(ai.Path)
 	err := os.Remove(ai.thumbnailfilepath)
 	if err == nil {
 		log.Println("appimage: Deleted", ai.thumbnailfilepath)
@@ -214,10 +252,16 @@ func (ai AppImage) _removeIntegration() {
 		go UnSubscribeMQTT(MQTTclient, ai.updateinformation)
 	}
 
+	// Another version of the application may take over the desktop file
+	if handOverDesktopFile(entry) == true {
+		emitDBusSignal("Removed", ai.Path, ai.md5)
+		return
+	}
 	err = os.Remove(ai.desktopfilepath)
 	if err == nil {
 		log.Println("appimage: Deleted", ai.desktopfilepath)
 		sendDesktopNotification("Removed", ai.Path, 3000)
+		emitDBusSignal("Removed", ai.Path, ai.md5)
 
 	}
 }
@@ -251,7 +295,7 @@ func (ai AppImage) ReadUpdateInformation() (string, error) {
 // LaunchMostRecentAppImage launches an the most recent application for a given
 // updateinformation that we found among the integrated AppImages.
 // Kinda like poor man's Launch Services. Probably we should make as much use of it as possible.
-// Downside: Applications without updateinformation cannot be used in this way.
+// Applications without updateinformation can be found by their ID, see resolveApplication.
 func LaunchMostRecentAppImage(updateinformation string, args []string) {
 	if updateinformation == "" {
 		return
@@ -270,51 +314,34 @@ func LaunchMostRecentAppImage(updateinformation string, args []string) {
 }
 
 // FindMostRecentAppImageWithMatchingUpdateInformation finds the most recent registered AppImage
-// that havs matching upate information embedded
+// that havs matching upate information embedded, see version.go for what "most recent" means
 func FindMostRecentAppImageWithMatchingUpdateInformation(updateinformation string) string {
-	results := FindAppImagesWithMatchingUpdateInformation(updateinformation)
-	mostRecent := helpers.FindMostRecentFile(results)
-	return mostRecent
+	return findMostRecentAppImage(registry.FindEntriesByUpdateInformation(updateinformation), nil)
 }
 
 // FindAppImagesWithMatchingUpdateInformation finds registered AppImages
-// that have matching upate information embedded
+// that have matching upate information embedded, the most recent one first
 func FindAppImagesWithMatchingUpdateInformation(updateinformation string) []string {
-	files, err := ioutil.ReadDir(xdg.DataHome + "/applications/")
-	helpers.LogError("desktop", err)
-	var results []string
-	if err != nil {
-		return results
-	}
-	for _, file := range files {
-		if strings.HasSuffix(file.Name(), ".desktop") && strings.HasPrefix(file.Name(), "appimagekit_") {
-
-			cfg, e := ini.LoadSources(ini.LoadOptions{IgnoreInlineComment: true}, // Do not cripple lines hat contain ";"
-				xdg.DataHome+"/applications/"+file.Name())
-			helpers.LogError("desktop", e)
-			dst := cfg.Section("Desktop Entry").Key(ExecLocationKey).String()
-			_, err = os.Stat(dst)
-			if os.IsNotExist(err) {
-				log.Println(dst, "does not exist, it is mentioned in", xdg.DataHome+"/applications/"+file.Name())
-				continue
-			}
-			ai, err := NewAppImage(dst)
-			if err != nil {
-				continue
-			}
-			ui, err := ai.ReadUpdateInformation()
-			if err == nil && ui != "" {
-				//log.Println("updateinformation:", ui)
-				// log.Println("updateinformation:", url.QueryEscape(ui))
-				unescapedui, _ := url.QueryUnescape(ui)
-				// log.Println("updateinformation:", unescapedui)
-				if updateinformation == unescapedui {
-					results = append(results, ai.Path)
-				}
-			}
+	return registry.FindByUpdateInformation(updateinformation)
+}
 
-			continue
-		}
+// appImageFromRegistryEntry returns an AppImage object for the registry entry without reading the file,
+// which is enough to remove the integration of an AppImage that no longer exists
+func appImageFromRegistryEntry(entry RegistryEntry) *AppImage {
+	ai := new(AppImage)
+	ai.AppImage = &goappimage.AppImage{Path: entry.Path, Name: entry.Name, Version: entry.Version}
+	ai.uri = strings.TrimSpace(string(uri.File(filepath.Clean(ai.Path))))
+	ai.md5 = entry.Identifier
+	ai.setDesktopFileName(pathDesktopFileName(entry))
+	if entry.DesktopFile != "" {
+		ai.setDesktopFileName(filepath.Base(entry.DesktopFile))
+	}
+	ai.thumbnailfilename = ai.md5 + ".png"
+	if strings.HasSuffix(ThumbnailsDirNormal, "/") {
+		ai.thumbnailfilepath = ThumbnailsDirNormal + ai.thumbnailfilename
+	} else {
+		ai.thumbnailfilepath = ThumbnailsDirNormal + "/" + ai.thumbnailfilename
 	}
-	return results
+	ai.updateinformation = entry.UpdateInformation
+	return ai
 }
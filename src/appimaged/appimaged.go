@@ -48,7 +48,18 @@ var cleanPtr = flag.Bool("c", true, "Clean pre-existing desktop files")
 var quietPtr = flag.Bool("q", false, "Do not send desktop notifications")
 var noZeroconfPtr = flag.Bool("nz", false, "Do not announce this service on the network using Zeroconf")
 
-var ToBeIntegratedOrUnintegrated []string
+var workersPtr = flag.Int("w", 4, "Number of AppImages to integrate in parallel")
+var updateCheckIntervalPtr = flag.Duration("u", 6*time.Hour, "How often to check for updates using the update information, 0 to only rely on MQTT")
+
+// updateCheckHostInterval is how long to wait between requests to the same host when checking for updates
+const updateCheckHostInterval = 2 * time.Second
+
+// integrationQueue receives the paths of AppImages that may need to be integrated or unintegrated
+var integrationQueue *IntegrationQueue
+
+// integrationDebounce is how long a file must not have changed before it gets integrated,
+// so that files which are still being downloaded or copied are not read
+const integrationDebounce = 2 * time.Second
 
 var thisai *AppImage // A reference to myself
 
@@ -63,6 +74,7 @@ var MQTTclient mqtt.Client
 // Checking whehter other AppImages are left is probably costly.
 // So better find a way to get this information from the mqtt library.
 var subscribedMQTTTopics []string
+var subscribedMQTTTopicsMu sync.Mutex
 
 // This key in the desktop files written by us describes where the AppImage is in the filesystem.
 // We need this because we rewrite Exec= to include things like wrap and Firejail
@@ -111,9 +123,13 @@ func main() {
 
 		// FIXME: Someone please tell me how to do this using flag
 		fmt.Fprintf(os.Stderr, "Commands: \n")
-		fmt.Fprintf(os.Stderr, "run <updateinformation>:\n\tRun the most recent AppImage registered\n\tfor the updateinformation provided\n")
-		fmt.Fprintf(os.Stderr, "start <updateinformation>:\n\tStart the most recent AppImage registered\n\tfor the updateinformation provided and exit immediately\n")
-		fmt.Fprintf(os.Stderr, "update <path to AppImage>:\n\tUpdate the AppImage using the most recent\n\tAppImageUpdate registered\n")
+		fmt.Fprintf(os.Stderr, "run <application> [--version <constraint>]:\n\tRun the most recent AppImage registered\n\tfor the application provided as updateinformation,\n\tAppStream ID, desktop file name, or executable name\n\t(whose version satisfies the constraint, e.g., \">=2.0,<3\")\n")
+		fmt.Fprintf(os.Stderr, "start <application> [--version <constraint>]:\n\tStart the most recent AppImage registered\n\tfor the application provided and exit immediately\n")
+		fmt.Fprintf(os.Stderr, "which <application> [--version <constraint>]:\n\tPrint the path of the AppImage that run would use\n")
+		fmt.Fprintf(os.Stderr, "which --mimetype <MIME type or file> | --url <URL or scheme>:\n\tPrint the path of the AppImage that opens it\n")
+		fmt.Fprintf(os.Stderr, "update <path to AppImage>:\n\tCheck for an update of the AppImage and apply or offer it according to the update policy\n")
+		fmt.Fprintf(os.Stderr, "rollback <path to AppImage>:\n\tReplace the AppImage by the version it was updated from\n")
+		fmt.Fprintf(os.Stderr, "fanotify-helper [-uid <uid>] <filesystem>...:\n\tReport AppImages on the filesystems\n\tusing fanotify; needs CAP_SYS_ADMIN\n")
 		fmt.Fprintf(os.Stderr, "wrap <path to executable>:\n\tExecute the exeutable and send\n\tdesktop notifications for any errors\n")
 		fmt.Fprintf(os.Stderr, "\n")
 
@@ -124,20 +140,25 @@ func main() {
 	// Always show version
 	fmt.Println(filepath.Base(os.Args[0]), version)
 
-	for _, dir := range candidateDirectories {
-		if helpers.Exists(dir) {
-			watchedDirectories = append(watchedDirectories, dir)
+	config, _ := loadWatchConfig(watchConfigFilePath())
+	for _, root := range config.Roots {
+		if helpers.Exists(root.Path) {
+			watchedDirectories = append(watchedDirectories, root.Path)
 		}
 	}
 
 	checkPrerequisites()
 
+	registry = LoadRegistry(registryFilePath())
+	integrationQueue = NewIntegrationQueue(*workersPtr, integrationDebounce, integrateOrUnintegratePath, commitDesktopFiles)
+	go integrationQueue.Run(quit)
+
 	setupToRunThroughSystemd()
+	installDBusServiceFile()
 	// fmt.Println("Setting as autostart...")
 	// setMyselfAsAutostart()
 
-	// Watch the filesystem for accesses using fanotify
-	// FANotifyMonitor() // fanotifymonitor error: operation not permitted
+	// Whole filesystems can be watched using fanotify if configured, see fanotify.go
 
 	installFilemanagerContextMenus()
 
@@ -159,6 +180,9 @@ func main() {
 
 	}
 
+	// Let other programs talk to us over org.appimage.Daemon1
+	serveDBus()
+
 	// go monitorDbusSessionBus() // If used, then nothing else can use DBus anymore? FIXME #####################
 
 	// SimpleNotify("Starting", helpers.Here(), 5000)
@@ -197,6 +221,14 @@ func main() {
 	go monitorUdisks()
 
 	watchDirectories()
+	go watchConfigFile()
+
+	// Check for updates ourselves, see updatecheck.go
+	if *updateCheckIntervalPtr > 0 {
+		checker := NewUpdateChecker(*updateCheckIntervalPtr, updateCheckHostInterval)
+		helpers.GitHubHTTPClient = checker.Client()
+		go checker.Run(time.Minute, quit)
+	}
 
 	// Ticker to periodically check whether MQTT is still connected.
 	// Periodically check whether the MQTT client is
@@ -216,21 +248,6 @@ func main() {
 		}
 	}()
 
-	// Ticker to periodically move desktop files into system
-	ticker := time.NewTicker(2 * time.Second)
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				moveDesktopFiles()
-
-			case <-quit:
-				ticker.Stop()
-				return
-			}
-		}
-	}()
-
 	<-quit
 
 }
@@ -253,57 +270,44 @@ func checkMQTTConnected(MQTTclient mqtt.Client) {
 	}
 }
 
-// Periodically move desktop files from their temporary location
-// into the menu, so that the menu does not get rebuilt all the time
-func moveDesktopFiles() {
-	// log.Println("main: Ticktock")
-
-	if *verbosePtr == true {
-		log.Println("ToBeIntegratedOrUnintegrated:", ToBeIntegratedOrUnintegrated)
+// integrateOrUnintegratePath integrates or unintegrates the AppImage at path,
+// depending on whether it exists; called by the integrationQueue
+func integrateOrUnintegratePath(path string) {
+	if helpers.Exists(path) == false {
+		// AppImages that no longer exist cannot be read, but we remember what is needed to remove them
+		if entry, _ := registry.Lookup(path); entry.Identifier != "" {
+			appImageFromRegistryEntry(entry).IntegrateOrUnintegrate()
+		}
+		return
 	}
-
-	// log.Println("Subscriptions:", subscribedMQTTTopics)
-
-	// log.Println(watchedDirectories)
-	// for _, w := range watchedDirectories {
-	// 	log.Println(w.Path)
-	// }
-
-	/*
-		We want to know that all go routines have been completed,
-		nd only then move in all desktop files at once
-		To use sync.WaitGroup we:
-		    Create a new instance of a sync.WaitGroup (we’ll call it wg)
-		    Call wg.Add(n) where n is the number of goroutines to wait for (we can also call wg.Add(1) n times)
-		    Execute defer wg.Done() in each goroutine to indicate that goroutine is finished executing to the WaitGroup (see defer)
-		    Call wg.Wait() where we want to block
-			https://nathanleclaire.com/blog/2014/02/15/how-to-wait-for-all-goroutines-to-finish-executing-before-continuing/
-	*/
-	var wg sync.WaitGroup
-
-	// We limit the number of concurrent go routines
-	// sem is a channel that will allow up to 8 concurrent operations, a "Bounded channel"
-	// so that we won't get "too many files open" errors
-	var sem = make(chan int, 1024)
-
-	for _, path := range ToBeIntegratedOrUnintegrated {
-		ai, err := NewAppImage(path)
-		if err != nil {
-			continue
+	if shouldIntegrate(path) == false {
+		// Only register it so that it can be found and integrated on request
+		entry, err := registry.Read(path)
+		helpers.LogError("main: registry", err)
+		if err == nil {
+			appImageFromRegistryEntry(entry).setExecBit()
 		}
-		sem <- 1
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			ai.IntegrateOrUnintegrate()
-			ToBeIntegratedOrUnintegrated = RemoveFromSlice(ToBeIntegratedOrUnintegrated, ai.Path)
-		}()
-		<-sem
+		return
+	}
+	if *overwritePtr == false && alreadyIntegrated(path) == true {
+		return
 	}
+	ai, err := NewAppImage(path)
+	if err != nil {
+		return
+	}
+	ai.IntegrateOrUnintegrate()
+}
 
-	wg.Wait() // Wait until all go functions have completed
+// commitDesktopFiles moves the desktop files written for the paths that were processed together
+// from their temporary location into the menu, so that the menu does not get rebuilt all the time
+func commitDesktopFiles(paths []string) {
+	if *verbosePtr == true {
+		log.Println("main: Processed", paths)
+	}
 
-	// If this wait is too short, then we may be running into race conditions which can lead to crashes?
+	err := registry.Save()
+	helpers.LogError("main: registry", err)
 
 	desktopcachedir := xdg.CacheHome + "/applications/" // FIXME: Do not hardcode here and in other places
 
@@ -388,8 +392,6 @@ func moveDesktopFiles() {
 
 func watchDirectories() {
 
-	watchedDirectories = []string{} // Start fresh here, because old ones may have been unmounted in the meantime
-
 	// Register AppImages from well-known locations
 	// https://github.com/AppImage/appimaged#monitored-directories
 	home, _ := os.UserHomeDir()
@@ -398,10 +400,12 @@ func watchDirectories() {
 		helpers.PrintError("main", err)
 	}
 
-	for _, dir := range candidateDirectories {
-		if helpers.Exists(dir) {
-			watchedDirectories = append(watchedDirectories, dir)
-		}
+	// Start fresh here, because old ones may have been unmounted in the meantime
+	config, err := loadWatchConfig(watchConfigFilePath())
+	roots := config.Roots
+	if err != nil {
+		helpers.PrintError("main: "+watchConfigFilePath(), err)
+		go sendErrorDesktopNotification("Invalid configuration", watchConfigFilePath()+":\n"+err.Error())
 	}
 
 	mounts, _ := procfs.GetMounts()
@@ -421,54 +425,28 @@ func watchDirectories() {
 					go sendErrorDesktopNotification("UDisks showexec issue", "Applications cannot run from \n"+mount.MountPoint+". \nSee \nhttps://github.com/storaged-project/udisks/issues/707")
 					printUdisksShowexecHint()
 				} else {
-					watchedDirectories = helpers.AppendIfMissing(watchedDirectories, mount.MountPoint+"/Applications")
+					roots = appendWatchRootIfMissing(roots, newWatchRoot(mount.MountPoint+"/Applications"))
 				}
 			}
 		}
 	}
 
+	watchedDirectories = []string{}
+	for _, root := range roots {
+		if helpers.Exists(root.Path) {
+			watchedDirectories = append(watchedDirectories, root.Path)
+		}
+	}
 	log.Println("Registering AppImages in", watchedDirectories)
 
-	watchDirectoriesReally(watchedDirectories)
+	applyFanotify(config.Fanotify)
+	watcher.Apply(roots, config.MaxWatches)
 
 	helpers.DeleteDesktopFilesWithNonExistingTargets()
+	// Remove the integration of registered AppImages which no longer exist
+	for _, path := range registry.Stale() {
+		integrationQueue.Enqueue(path)
+	}
 	// So this should also catch AppImages which were formerly hidden in some subdirectory
 	// where the whole directory was deleted
 }
-
-func watchDirectoriesReally(watchedDirectories []string) {
-	for _, v := range watchedDirectories {
-		go inotifyWatch(v)
-		// For now we don't walk subdirectories.
-		// filepath.Walk scans subfolders too,
-		// ioutil.ReadDir does not.
-		infos, err := ioutil.ReadDir(v)
-		if err != nil {
-			helpers.PrintError("watchDirectoriesReally", err)
-			continue
-		}
-		for _, info := range infos {
-			if err != nil {
-				log.Printf("%v\n", err)
-			} else if info.IsDir() == true {
-				// go inotifyWatch(v + "/" + info.Name())
-			} else if info.IsDir() == false {
-				ai, err := NewAppImage(v + "/" + info.Name())
-				if err != nil {
-					continue
-				}
-				ToBeIntegratedOrUnintegrated = helpers.AppendIfMissing(ToBeIntegratedOrUnintegrated, ai.Path)
-			}
-		}
-		helpers.LogError("main: watchDirectoriesReally", err)
-	}
-}
-
-func RemoveFromSlice(s []string, r string) []string {
-	for i, v := range s {
-		if v == r {
-			return append(s[:i], s[i+1:]...)
-		}
-	}
-	return s
-}
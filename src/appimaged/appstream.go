@@ -0,0 +1,60 @@
+package main
+
+// Reads the AppStream metainfo file of AppImages, which tells (among other things)
+// the component ID of the application and which versions it had,
+// see https://www.freedesktop.org/software/appstream/docs/chap-Metadata.html
+
+import (
+	"encoding/xml"
+	"strings"
+)
+
+// appStreamDirectories are where metainfo files are, in the order in which they are looked for
+var appStreamDirectories = []string{"usr/share/metainfo", "usr/share/appdata"}
+
+// AppStreamMetadata is what we use from the metainfo file of an AppImage
+type AppStreamMetadata struct {
+	ID      string // Component ID, e.g., org.inkscape.Inkscape
+	Version string // Version of the most recent release
+}
+
+// appStreamComponent is the part of a metainfo file that is parsed
+type appStreamComponent struct {
+	ID       string `xml:"id"`
+	Releases []struct {
+		Version string `xml:"version,attr"`
+	} `xml:"releases>release"`
+}
+
+// readAppStreamMetadata returns what the metainfo file in the AppImage says;
+// it is empty if there is none
+func readAppStreamMetadata(ai *AppImage) AppStreamMetadata {
+	var metadata AppStreamMetadata
+	if ai.AppImage == nil || ai.Type() < 1 {
+		return metadata
+	}
+	for _, dir := range appStreamDirectories {
+		for _, name := range ai.ListFiles(dir) {
+			if strings.HasSuffix(name, ".metainfo.xml") == false && strings.HasSuffix(name, ".appdata.xml") == false {
+				continue
+			}
+			r, err := ai.ExtractFileReader(dir + "/" + name)
+			if err != nil {
+				continue
+			}
+			var component appStreamComponent
+			err = xml.NewDecoder(r).Decode(&component)
+			r.Close()
+			if err != nil {
+				continue
+			}
+			metadata.ID = strings.TrimSpace(component.ID)
+			// Releases are listed newest first
+			if len(component.Releases) > 0 {
+				metadata.Version = strings.TrimSpace(component.Releases[0].Version)
+			}
+			return metadata
+		}
+	}
+	return metadata
+}
@@ -1,6 +1,6 @@
 // appwrapper executes applications and presents errors to the GUI as notifications
-// TODO: Enable appimaged for DBus Activation so that the running instance can wrap
-// the apps, so that we don't need to run another appimaged process for each app
+// TODO: Use the Launch method of org.appimage.Daemon1 (see dbusservice.go) so that the running
+// instance can wrap the apps, so that we don't need to run another appimaged process for each app
 package main
 
 import (
@@ -10,6 +10,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"syscall"
 
@@ -19,6 +20,8 @@ import (
 	"gopkg.in/ini.v1"
 )
 
+var missingSymbolVersionRegexp = regexp.MustCompile("version `((?:GLIBC|GLIBCXX|CXXABI)_[0-9.]+)' not found")
+
 func appwrap() {
 
 	if len(os.Args) < 3 {
@@ -78,6 +81,12 @@ func appwrap() {
 					// body = filepath.Base(os.Args[2]) + " could not be started because " + strings.TrimSpace(parts[2]) + " is missing"
 				}
 
+				// The AppImage was built on a newer system than this one, e.g.,
+				// "/lib/x86_64-linux-gnu/libc.so.6: version `GLIBC_2.34' not found (required by ...)"
+				if match := missingSymbolVersionRegexp.FindStringSubmatch(out.String()); match != nil {
+					body = appname + " needs " + match[1] + " which is newer than what this system has. \nPlease ask the author to build it on an older system."
+				}
+
 				// https://github.com/AppImage/AppImageKit/issues/1004
 				if strings.Contains(out.String(), "execv error") == true && err == nil {
 					body = filepath.Base(os.Args[2]) + " is defective, AppRun is missing. \nPlease ask the author to fix it."
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"strings"
 
+	"github.com/hashicorp/go-version"
 	"github.com/probonopd/go-appimage/internal/helpers"
 )
 
@@ -21,36 +23,52 @@ func takeCareOfCommandlineCommands() {
 		os.Exit(0)
 	}
 
+	// The privileged helper that watches filesystems using fanotify
+	if os.Args[1] == "fanotify-helper" {
+		fanotifyHelper()
+		os.Exit(0)
+	}
+
 	// As quickly as possible go there if we are invoked with the "update" command
 	if os.Args[1] == "update" {
 		update()
 		os.Exit(0)
 	}
 
+	// Roll back to the version an AppImage was updated from
+	if os.Args[1] == "rollback" {
+		rollback()
+		os.Exit(0)
+	}
+
 	// As quickly as possible run the most recent AppImage we can find if we are
-	// invoked with the "run" command and updateinformation as arguments
-	// appimaged run <updateinformation>: Waits for the process to exit
-	// appimaged start <updateinformation>: Does not wait and exits immediately after having tried to launch
+	// invoked with the "run" command and an application as arguments, which can be given
+	// by its update information, AppStream component ID, desktop file name, or executable name
+	// appimaged run <application>: Waits for the process to exit
+	// appimaged start <application>: Does not wait and exits immediately after having tried to launch
+	// Either can be followed by --version and a version constraint, e.g., ">=2.0,<3",
+	// to run the most recent AppImage whose version satisfies it
 	if os.Args[1] == "run" || os.Args[1] == "start" {
 		if len(os.Args) < 3 {
-			fmt.Println("No updateinformation supplied")
+			fmt.Println("No application supplied")
 			os.Exit(1)
 		}
 
-		err := helpers.ValidateUpdateInformation(os.Args[2])
-		var ui string
-		if err == nil {
-			ui = os.Args[2]
-		} else {
-			fmt.Println("Invalid updateinformation string supplied")
-			os.Exit(1)
-		}
-		a := FindMostRecentAppImageWithMatchingUpdateInformation(ui)
-		if a == "" {
-			fmt.Println("No AppImage found for,")
+		id := os.Args[2]
+		constraints, args := versionConstraintArgument(os.Args[3:])
+		registry = LoadRegistry(registryFilePath())
+		a, err := resolveApplication(id, constraints)
+		if err != nil {
+			fmt.Println(err)
+		} else if a == "" {
+			if constraints != nil {
+				fmt.Println("No AppImage found for", id, "with version", constraints.String())
+			} else {
+				fmt.Println("No AppImage found for", id)
+			}
 		} else {
 			comnd := []string{a}
-			comnd = append(comnd, os.Args[3:]...)
+			comnd = append(comnd, args...)
 
 			if os.Args[1] == "run" {
 				err = helpers.RunCmdTransparently(comnd)
@@ -70,4 +88,72 @@ func takeCareOfCommandlineCommands() {
 		os.Exit(1)
 	}
 
+	// Print the path of the AppImage that "run" would launch, or that handles a MIME type or URL scheme
+	// appimaged which <application> [--version <constraint>]
+	// appimaged which --mimetype <MIME type or file>
+	// appimaged which --url <URL or scheme>
+	if os.Args[1] == "which" {
+		which()
+	}
+
+}
+
+// which prints the path of the AppImage asked for and exits
+func which() {
+	if len(os.Args) < 3 {
+		fmt.Fprintln(os.Stderr, "No application supplied")
+		os.Exit(1)
+	}
+	registry = LoadRegistry(registryFilePath())
+	var a, what string
+	switch {
+	case (os.Args[2] == "--mimetype" || os.Args[2] == "--url") && len(os.Args) < 4:
+		fmt.Fprintln(os.Stderr, "No argument supplied for", os.Args[2])
+		os.Exit(1)
+	case os.Args[2] == "--mimetype":
+		what = mimeTypeForArgument(os.Args[3])
+		if what == "" {
+			fmt.Fprintln(os.Stderr, "Cannot tell the MIME type of", os.Args[3])
+			os.Exit(1)
+		}
+		a = registry.FindHandler(what)
+	case os.Args[2] == "--url":
+		what = mimeTypeForURL(os.Args[3])
+		a = registry.FindHandler(what)
+	default:
+		what = os.Args[2]
+		constraints, _ := versionConstraintArgument(os.Args[3:])
+		var err error
+		a, err = resolveApplication(what, constraints)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if a == "" {
+		fmt.Fprintln(os.Stderr, "No AppImage found for", what)
+		os.Exit(1)
+	}
+	fmt.Println(a)
+	os.Exit(0)
+}
+
+// versionConstraintArgument returns the version constraint if args begin with
+// "--version <constraint>" or "--version=<constraint>", and the remaining arguments.
+// Otherwise, e.g., if what follows --version is not a constraint, all args are returned
+// since they are meant for the application
+func versionConstraintArgument(args []string) (version.Constraints, []string) {
+	if len(args) >= 1 && strings.HasPrefix(args[0], "--version=") {
+		constraints, err := version.NewConstraint(strings.TrimPrefix(args[0], "--version="))
+		if err == nil {
+			return constraints, args[1:]
+		}
+	}
+	if len(args) >= 2 && args[0] == "--version" {
+		constraints, err := version.NewConstraint(args[1])
+		if err == nil {
+			return constraints, args[2:]
+		}
+	}
+	return nil, args
 }
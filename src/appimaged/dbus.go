@@ -124,8 +124,7 @@ func monitorDbusSessionBus() {
 			if strings.HasPrefix(str, "%!s") == false {
 				log.Println("org.gtk.vfs.Metadata", str)
 				// time.Sleep(1 * time.Second)
-				ai, _ := NewAppImage(str)
-				ToBeIntegratedOrUnintegrated = helpers.AppendIfMissing(ToBeIntegratedOrUnintegrated, ai.Path)
+				integrationQueue.Enqueue(str)
 			}
 
 		}
@@ -142,8 +141,7 @@ func monitorDbusSessionBus() {
 		if v.Headers[3].String() == "\"ResourceScoreUpdated\"" {
 			fp := v.Body[2].(string)
 			log.Println("monitor: ResourceScoreUpdated: ", fp)
-			ai, _ := NewAppImage(fp)
-			ToBeIntegratedOrUnintegrated = helpers.AppendIfMissing(ToBeIntegratedOrUnintegrated, ai.Path)
+			integrationQueue.Enqueue(fp)
 		}
 
 		// KDE
@@ -186,14 +184,12 @@ func monitorDbusSessionBus() {
 				for _, s := range fromfiles {
 					fp := getFilepath(s)
 					log.Println("monitor: MoveFrom: ", fp)
-					ai, _ := NewAppImage(fp)
-					ToBeIntegratedOrUnintegrated = helpers.AppendIfMissing(ToBeIntegratedOrUnintegrated, ai.Path)
+					integrationQueue.Enqueue(fp)
 				}
 				for _, s := range tofiles {
 					fp := getFilepath(s)
 					log.Println("monitor: MoveTo: ", fp)
-					ai, _ := NewAppImage(fp)
-					ToBeIntegratedOrUnintegrated = helpers.AppendIfMissing(ToBeIntegratedOrUnintegrated, ai.Path)
+					integrationQueue.Enqueue(fp)
 				}
 			}
 		}
@@ -210,8 +206,7 @@ func monitorDbusSessionBus() {
 				for _, s := range tofiles {
 					fp := getFilepath(s)
 					log.Println("monitor: CopyTo: ", fp)
-					ai, _ := NewAppImage(fp)
-					ToBeIntegratedOrUnintegrated = helpers.AppendIfMissing(ToBeIntegratedOrUnintegrated, ai.Path)
+					integrationQueue.Enqueue(fp)
 				}
 			}
 		}
@@ -224,8 +219,7 @@ func monitorDbusSessionBus() {
 				for _, s := range files {
 					fp := getFilepath(s)
 					log.Println("monitor: CleanupOrDelete: ", fp)
-					ai, _ := NewAppImage(fp)
-					ToBeIntegratedOrUnintegrated = helpers.AppendIfMissing(ToBeIntegratedOrUnintegrated, ai.Path)
+					integrationQueue.Enqueue(fp)
 				}
 			}
 		}
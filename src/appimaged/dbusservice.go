@@ -0,0 +1,324 @@
+package main
+
+// Exports the org.appimage.Daemon1 service on the session bus so that
+// file managers, software centers and scripts can ask the running daemon
+// about the AppImages it knows about rather than scanning desktop files.
+// Try it with, e.g.,
+// gdbus call --session --dest org.appimage.Daemon1 --object-path /org/appimage/Daemon1 --method org.appimage.Daemon1.List
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/adrg/xdg"
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+	"github.com/probonopd/go-appimage/internal/helpers"
+	"gopkg.in/ini.v1"
+)
+
+const dbusServiceName = "org.appimage.Daemon1"
+const dbusObjectPath = dbus.ObjectPath("/org/appimage/Daemon1")
+const dbusInterfaceName = "org.appimage.Daemon1"
+
+// dbusServiceConn is the connection the service is exported on, nil if it is not
+var dbusServiceConn *dbus.Conn
+
+// daemonService implements the methods of org.appimage.Daemon1
+type daemonService struct{}
+
+// dbusSignals are the signals of org.appimage.Daemon1; they are emitted by emitDBusSignal
+var dbusSignals = []introspect.Signal{
+	{Name: "Added", Args: []introspect.Arg{{Name: "path", Type: "s"}, {Name: "identifier", Type: "s"}}},
+	{Name: "Removed", Args: []introspect.Arg{{Name: "path", Type: "s"}, {Name: "identifier", Type: "s"}}},
+	{Name: "Updated", Args: []introspect.Arg{{Name: "path", Type: "s"}, {Name: "identifier", Type: "s"}}},
+	{Name: "UpdateAvailable", Args: []introspect.Arg{{Name: "path", Type: "s"}, {Name: "version", Type: "s"}}},
+}
+
+// metadata returns what the service tells about an AppImage
+func (entry RegistryEntry) metadata() map[string]dbus.Variant {
+	return map[string]dbus.Variant{
+		"path":              dbus.MakeVariant(entry.Path),
+		"identifier":        dbus.MakeVariant(entry.Identifier),
+		"name":              dbus.MakeVariant(entry.Name),
+		"version":           dbus.MakeVariant(entry.Version),
+		"type":              dbus.MakeVariant(int32(entry.Type)),
+		"size":              dbus.MakeVariant(entry.Size),
+		"mtime":             dbus.MakeVariant(entry.ModTime.Unix()),
+		"digest":            dbus.MakeVariant(entry.Digest),
+		"signature":         dbus.MakeVariant(entry.Signature),
+		"signingkey":        dbus.MakeVariant(entry.SigningKey),
+		"updateinformation": dbus.MakeVariant(entry.UpdateInformation),
+		"appstreamid":       dbus.MakeVariant(entry.AppStreamID),
+		"desktopid":         dbus.MakeVariant(entry.DesktopID),
+		"executable":        dbus.MakeVariant(entry.Executable),
+		"mimetypes":         dbus.MakeVariant(append([]string{}, entry.MimeTypes...)),
+		"desktopfile":       dbus.MakeVariant(entry.DesktopFile),
+		"thumbnail":         dbus.MakeVariant(entry.Thumbnail),
+	}
+}
+
+// List returns the metadata of all registered AppImages
+func (s daemonService) List() ([]map[string]dbus.Variant, *dbus.Error) {
+	results := []map[string]dbus.Variant{}
+	for _, entry := range registry.Entries() {
+		results = append(results, entry.metadata())
+	}
+	return results, nil
+}
+
+// Get returns the metadata of the AppImage at path
+func (s daemonService) Get(path string) (map[string]dbus.Variant, *dbus.Error) {
+	entry, err := registry.Read(path)
+	if err != nil {
+		return nil, dbus.MakeFailedError(err)
+	}
+	return entry.metadata(), nil
+}
+
+// Integrate queues the AppImage at path for integration,
+// also if it is in a directory where AppImages are not integrated automatically
+func (s daemonService) Integrate(path string) *dbus.Error {
+	ai, err := NewAppImage(path)
+	if err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	requestIntegration(ai.Path)
+	integrationQueue.Enqueue(ai.Path)
+	return nil
+}
+
+// Unintegrate removes the integration of the AppImage at path, even if the file still exists
+func (s daemonService) Unintegrate(path string) *dbus.Error {
+	ai, err := NewAppImage(path)
+	if err != nil {
+		entry, _ := registry.Lookup(path)
+		if entry.Identifier == "" {
+			return dbus.MakeFailedError(err)
+		}
+		ai = appImageFromRegistryEntry(entry)
+	}
+	ai._removeIntegration()
+	return nil
+}
+
+// FindByUpdateInformation returns the paths of the integrated AppImages with matching update information,
+// the most recent one first
+func (s daemonService) FindByUpdateInformation(updateinformation string) ([]string, *dbus.Error) {
+	paths := FindAppImagesWithMatchingUpdateInformation(updateinformation)
+	if paths == nil {
+		paths = []string{}
+	}
+	return paths, nil
+}
+
+// FindByIdentifier returns the path of the registered AppImage with the identifier,
+// which can also be given as the name of its desktop file
+func (s daemonService) FindByIdentifier(identifier string) (string, *dbus.Error) {
+	for _, entry := range registry.Entries() {
+		if entry.Identifier == identifier || pathDesktopFileName(entry) == identifier || (entry.DesktopFile != "" && filepath.Base(entry.DesktopFile) == identifier) {
+			return entry.Path, nil
+		}
+	}
+	return "", dbus.NewError(dbusInterfaceName+".Error.NotFound", []interface{}{"No AppImage with identifier " + identifier})
+}
+
+// Which returns the path of the most recent AppImage of the application with the ID,
+// which can be update information, an AppStream component ID, a desktop file name, or an executable name
+func (s daemonService) Which(id string) (string, *dbus.Error) {
+	a, err := resolveApplication(id, nil)
+	if err != nil {
+		if _, ok := err.(*AmbiguousError); ok == true {
+			return "", dbus.NewError(dbusInterfaceName+".Error.Ambiguous", []interface{}{err.Error()})
+		}
+		return "", dbus.MakeFailedError(err)
+	}
+	if a == "" {
+		return "", dbus.NewError(dbusInterfaceName+".Error.NotFound", []interface{}{"No AppImage for " + id})
+	}
+	return a, nil
+}
+
+// FindHandler returns the path of the AppImage to open the MIME type with,
+// which can be x-scheme-handler/<scheme> for URLs
+func (s daemonService) FindHandler(mimetype string) (string, *dbus.Error) {
+	a := registry.FindHandler(mimetype)
+	if a == "" {
+		return "", dbus.NewError(dbusInterfaceName+".Error.NotFound", []interface{}{"No AppImage for " + mimetype})
+	}
+	return a, nil
+}
+
+// CheckForUpdate checks for an update of the AppImage at path and acts on it according to
+// its update policy: it is applied, offered, or not applied because the AppImage is pinned
+func (s daemonService) CheckForUpdate(path string) *dbus.Error {
+	if helpers.Exists(path) == false {
+		return dbus.NewError(dbusInterfaceName+".Error.NotFound", []interface{}{path + " does not exist"})
+	}
+	go checkForUpdate(path)
+	return nil
+}
+
+// Update updates the AppImage at path right away, regardless of its update policy
+// and even if it is pinned, because the user asked for it
+func (s daemonService) Update(path string) *dbus.Error {
+	if helpers.Exists(path) == false {
+		return dbus.NewError(dbusInterfaceName+".Error.NotFound", []interface{}{path + " does not exist"})
+	}
+	go runUpdate(path)
+	return nil
+}
+
+// Rollback replaces the AppImage at path by the version it was updated from
+func (s daemonService) Rollback(path string) *dbus.Error {
+	err := runRollback(path)
+	if err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	return nil
+}
+
+// Launch launches the AppImage at path with the arguments and returns its process ID.
+// Only registered AppImages that have not changed since they were registered can be launched,
+// so that this cannot be used to run just anything
+func (s daemonService) Launch(path string, args []string) (uint32, *dbus.Error) {
+	entry, fresh := registry.Lookup(path)
+	if filepath.IsAbs(path) == false || fresh == false || (entry.Type != 1 && entry.Type != 2) {
+		return 0, dbus.NewError(dbusInterfaceName+".Error.NotFound", []interface{}{path + " is not a registered AppImage"})
+	}
+	cmd := exec.Command(entry.Path, args...)
+	err := cmd.Start()
+	if err != nil {
+		return 0, dbus.MakeFailedError(err)
+	}
+	go cmd.Wait() // Do not leave zombies behind
+	return uint32(cmd.Process.Pid), nil
+}
+
+// serveDBus exports the service on the session bus.
+// Returns without doing anything if another process already owns the name
+func serveDBus() {
+	conn, err := dbus.SessionBusPrivate() // When using SessionBusPrivate(), need to follow with Auth(nil) and Hello()
+	if err != nil {
+		helpers.PrintError("serveDBus: SessionBusPrivate", err)
+		return
+	}
+	if err = conn.Auth(nil); err != nil {
+		conn.Close()
+		helpers.PrintError("serveDBus: Auth", err)
+		return
+	}
+	if err = conn.Hello(); err != nil {
+		conn.Close()
+		helpers.PrintError("serveDBus: Hello", err)
+		return
+	}
+
+	s := daemonService{}
+	err = conn.Export(s, dbusObjectPath, dbusInterfaceName)
+	if err != nil {
+		conn.Close()
+		helpers.PrintError("serveDBus: Export", err)
+		return
+	}
+	node := &introspect.Node{
+		Name: string(dbusObjectPath),
+		Interfaces: []introspect.Interface{
+			introspect.IntrospectData,
+			{
+				Name:    dbusInterfaceName,
+				Methods: introspect.Methods(s),
+				Signals: dbusSignals,
+			},
+		},
+	}
+	err = conn.Export(introspect.NewIntrospectable(node), dbusObjectPath, "org.freedesktop.DBus.Introspectable")
+	if err != nil {
+		conn.Close()
+		helpers.PrintError("serveDBus: Export", err)
+		return
+	}
+
+	reply, err := conn.RequestName(dbusServiceName, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		conn.Close()
+		helpers.PrintError("serveDBus: RequestName", err)
+		return
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		conn.Close()
+		log.Println("serveDBus:", dbusServiceName, "is already owned by another process")
+		return
+	}
+	dbusServiceConn = conn
+	log.Println("serveDBus: Exported", dbusServiceName, "on the session bus")
+}
+
+// emitDBusSignal emits one of the dbusSignals if the service is exported
+func emitDBusSignal(name string, args ...interface{}) {
+	if dbusServiceConn == nil {
+		return
+	}
+	err := dbusServiceConn.Emit(dbusObjectPath, dbusInterfaceName+"."+name, args...)
+	helpers.LogError("emitDBusSignal", err)
+}
+
+// callDaemon calls method of the running daemon, returns an error if it is not running
+func callDaemon(method string, args ...interface{}) error {
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		return err
+	}
+	obj := conn.Object(dbusServiceName, dbusObjectPath)
+	return obj.Call(dbusInterfaceName+"."+method, dbus.FlagNoAutoStart, args...).Err
+}
+
+// installDBusServiceFile makes the session bus start the daemon when the service is used
+// while the daemon is not running, through systemd if the user service exists
+func installDBusServiceFile() {
+	err := os.MkdirAll(xdg.DataHome+"/dbus-1/services/", os.ModePerm)
+	if err != nil {
+		helpers.LogError("installDBusServiceFile", err)
+		return
+	}
+	d := []byte(`[D-BUS Service]
+Name=` + dbusServiceName + `
+Exec=` + thisai.Path + `
+SystemdService=appimaged.service
+`)
+	err = ioutil.WriteFile(xdg.DataHome+"/dbus-1/services/"+dbusServiceName+".service", d, 0644)
+	helpers.LogError("installDBusServiceFile", err)
+}
+
+// findAppImagesFromDesktopFiles returns the paths of the AppImages
+// for which there are desktop files written by us
+func findAppImagesFromDesktopFiles() []string {
+	var results []string
+	files, err := ioutil.ReadDir(xdg.DataHome + "/applications/")
+	helpers.LogError("desktop", err)
+	if err != nil {
+		return results
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".desktop") && strings.HasPrefix(file.Name(), "appimagekit_") {
+			cfg, e := ini.LoadSources(ini.LoadOptions{IgnoreInlineComment: true}, // Do not cripple lines hat contain ";"
+				xdg.DataHome+"/applications/"+file.Name())
+			if e != nil {
+				helpers.LogError("desktop", e)
+				continue
+			}
+			dst := cfg.Section("Desktop Entry").Key(ExecLocationKey).String()
+			_, err = os.Stat(dst)
+			if os.IsNotExist(err) {
+				log.Println(dst, "does not exist, it is mentioned in", xdg.DataHome+"/applications/"+file.Name())
+				continue
+			}
+			results = append(results, dst)
+		}
+	}
+	return results
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLaunchOnlyRegisteredAppImages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appimaged-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(r *Registry) { registry = r }(registry)
+	registry = &Registry{entries: make(map[string]RegistryEntry)}
+
+	appimage := filepath.Join(dir, "App.AppImage")
+	entry := registeredFile(t, appimage, "#!/bin/sh\n")
+	entry.Type = 2
+	registry.put(entry)
+	other := filepath.Join(dir, "other.sh")
+	entry = registeredFile(t, other, "#!/bin/sh\n")
+	entry.Type = -1
+	registry.put(entry)
+	unregistered := filepath.Join(dir, "unregistered.sh")
+	ioutil.WriteFile(unregistered, []byte("#!/bin/sh\n"), 0755)
+
+	s := daemonService{}
+	if pid, err := s.Launch(appimage, nil); err != nil || pid == 0 {
+		t.Error("Expected the registered AppImage to be launched, got", err)
+	}
+	for _, path := range []string{other, unregistered, "App.AppImage", filepath.Join(dir, "missing.AppImage")} {
+		if _, err := s.Launch(path, nil); err == nil {
+			t.Error("Expected", path, "not to be launched")
+		}
+	}
+
+	// Nor one that changed since it was registered
+	ioutil.WriteFile(appimage, []byte("#!/bin/sh\necho changed\n"), 0755)
+	if _, err := s.Launch(appimage, nil); err == nil {
+		t.Error("Expected the changed AppImage not to be launched")
+	}
+}
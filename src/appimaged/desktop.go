@@ -27,7 +27,7 @@ import (
 // for a while
 func writeDesktopFile(ai AppImage) {
 
-	filename := "appimagekit_" + ai.md5 + ".desktop"
+	filename := ai.desktopfilename
 
 	// log.Println(md5s)
 	// XDG directories
@@ -123,6 +123,22 @@ func writeDesktopFile(ai AppImage) {
 
 	var actions []string
 
+	// Keep the actions of the AppImage itself (e.g., for its entry points),
+	// but run them through the AppImage rather than the executable named in Exec=
+	if startingPoint {
+		for _, action := range strings.FieldsFunc(cfg.Section("Desktop Entry").Key("Actions").String(), func(r rune) bool { return r == ';' || r == '；' }) {
+			if _, err := cfg.GetSection("Desktop Action " + action); err != nil {
+				continue
+			}
+			exec := strings.Fields(cfg.Section("Desktop Action " + action).Key("Exec").String())
+			if len(exec) == 0 {
+				continue
+			}
+			actions = append(actions, action)
+			cfg.Section("Desktop Action " + action).Key("Exec").SetValue(strings.TrimSpace(arg0abs + " wrap \"" + ai.Path + "\" " + strings.Join(exec[1:], " ")))
+		}
+	}
+
 	if isWritable(ai.Path) {
 		// Add "Move to Trash" action
 		// if the AppImage is writeable (= the user can remove it)
@@ -189,6 +205,13 @@ func writeDesktopFile(ai AppImage) {
 		cfg.Section("Desktop Action Update").Key("Exec").SetValue(os.Args[0] + " update \"" + ai.Path + "\"")
 	}
 
+	// Add "Roll Back" action if the AppImage was updated from a version that is still there
+	if entry, _ := registry.Lookup(ai.Path); entry.Previous != "" && helpers.Exists(entry.Previous) {
+		actions = append(actions, "RollBack")
+		cfg.Section("Desktop Action RollBack").Key("Name").SetValue("Roll Back to Previous Version")
+		cfg.Section("Desktop Action RollBack").Key("Exec").SetValue(os.Args[0] + " rollback \"" + ai.Path + "\"")
+	}
+
 	// Add "Open Containing Folder" action
 	if helpers.IsCommandAvailable("xdg-open") {
 		actions = append(actions, "Show")
@@ -0,0 +1,265 @@
+package main
+
+// Docks, favorites, default applications for MIME types, and autostart entries refer to applications
+// by the names of their desktop files. So that these survive moving and updating AppImages, the desktop file
+// of an application is named after what the application is rather than where its AppImage is: its AppStream
+// component ID, the name of the desktop file in the AppImage, or its update information, and only if it has
+// none of these, its path. Of several AppImages of an application, the most recent one gets this name and
+// the others get names made from their paths. Whenever the desktop file of an AppImage gets another name,
+// e.g., because a newer version has taken it over or because it was named after its path by earlier versions
+// of appimaged, what refers to the old name is changed to refer to the new one.
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/adrg/xdg"
+	"github.com/probonopd/go-appimage/internal/helpers"
+)
+
+// unsafeDesktopFileIDCharacters are not allowed in desktop file IDs
+var unsafeDesktopFileIDCharacters = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// pathDesktopFileName returns the name of the desktop file made from the path of the AppImage
+func pathDesktopFileName(entry RegistryEntry) string {
+	return "appimagekit_" + entry.Identifier + ".desktop"
+}
+
+// stableDesktopFileName returns the name of the desktop file of the application of the AppImage
+func stableDesktopFileName(entry RegistryEntry) string {
+	var id string
+	switch {
+	case entry.AppStreamID != "":
+		id = unsafeDesktopFileIDCharacters.ReplaceAllString(strings.TrimSuffix(entry.AppStreamID, ".desktop"), "_")
+	case entry.DesktopID != "":
+		id = unsafeDesktopFileIDCharacters.ReplaceAllString(strings.TrimSuffix(entry.DesktopID, ".desktop"), "_")
+	case entry.UpdateInformation != "":
+		unescapedui, _ := url.QueryUnescape(entry.UpdateInformation)
+		hasher := md5.New()
+		hasher.Write([]byte(unescapedui))
+		id = hex.EncodeToString(hasher.Sum(nil))
+	default:
+		return pathDesktopFileName(entry)
+	}
+	return "appimagekit_" + id + ".desktop"
+}
+
+// isSameApplication returns true if the AppImages have the same AppStream component ID,
+// desktop file name, or update information, so that one can replace the other
+func isSameApplication(a RegistryEntry, b RegistryEntry) bool {
+	if a.AppStreamID != "" && strings.TrimSuffix(a.AppStreamID, ".desktop") == strings.TrimSuffix(b.AppStreamID, ".desktop") {
+		return true
+	}
+	if a.DesktopID != "" && strings.TrimSuffix(a.DesktopID, ".desktop") == strings.TrimSuffix(b.DesktopID, ".desktop") {
+		return true
+	}
+	if a.UpdateInformation != "" && b.UpdateInformation != "" {
+		uia, _ := url.QueryUnescape(a.UpdateInformation)
+		uib, _ := url.QueryUnescape(b.UpdateInformation)
+		return uia == uib
+	}
+	return false
+}
+
+// otherVersions returns the entries of the other integrated AppImages of the application that still exist
+func otherVersions(entry RegistryEntry) []RegistryEntry {
+	var results []RegistryEntry
+	for _, other := range registry.Entries() {
+		if other.Path != entry.Path && other.DesktopFile != "" && isSameApplication(entry, other) && helpers.Exists(other.Path) {
+			results = append(results, other)
+		}
+	}
+	return results
+}
+
+// mostRecentVersion returns the entry of the most recent of the AppImages, and false if none exists
+func mostRecentVersion(entries []RegistryEntry) (RegistryEntry, bool) {
+	path := findMostRecentAppImage(entries, nil)
+	for _, entry := range entries {
+		if entry.Path == path {
+			return entry, true
+		}
+	}
+	return RegistryEntry{}, false
+}
+
+// assignDesktopFile returns the name of the desktop file for the AppImage, which had the desktop file previous.
+// Other versions of the application which had the name are queued to get another one,
+// and what referred to previous is migrated if the name changes
+func assignDesktopFile(entry RegistryEntry, previous string) string {
+	versions := append(otherVersions(entry), entry)
+	owner, _ := mostRecentVersion(versions)
+	stable := stableDesktopFileName(owner)
+	name := pathDesktopFileName(entry)
+	if owner.Path == entry.Path {
+		name = stable
+		for _, other := range versions {
+			if other.Path != entry.Path && filepath.Base(other.DesktopFile) == name && integrationQueue != nil {
+				integrationQueue.Enqueue(other.Path)
+			}
+		}
+	}
+	if previous != "" && previous != name && previous != stable {
+		migrateDesktopFile(previous, stable, entry.Path, owner.Path)
+		removeDesktopFile(previous)
+	}
+	return name
+}
+
+// handOverDesktopFile makes the most recent of the other versions of the application of the AppImage,
+// which no longer exists, take over its desktop file. Returns false if there is none, or if
+// the desktop file of the AppImage is to be removed since the other version has a desktop file of its own
+func handOverDesktopFile(entry RegistryEntry) bool {
+	if entry.DesktopFile == "" {
+		return false
+	}
+	owner, ok := mostRecentVersion(otherVersions(entry))
+	if ok == false {
+		return false
+	}
+	name := filepath.Base(entry.DesktopFile)
+	stable := stableDesktopFileName(owner)
+	if integrationQueue != nil {
+		integrationQueue.Enqueue(owner.Path)
+	}
+	if name == stable {
+		// Keep it until it is rewritten for the other version, so that docks do not lose it
+		return true
+	}
+	migrateDesktopFile(name, stable, entry.Path, owner.Path)
+	return false
+}
+
+// removeDesktopFile removes the desktop file with the name from the menu and from where it is written first
+func removeDesktopFile(name string) {
+	for _, dir := range []string{xdg.DataHome + "/applications/", xdg.CacheHome + "/applications/"} {
+		if err := os.Remove(dir + name); err == nil {
+			log.Println("desktop: Deleted", dir+name)
+		}
+	}
+}
+
+// mimeappsListPaths returns where the default applications of the user are
+func mimeappsListPaths() []string {
+	return []string{xdg.ConfigHome + "/mimeapps.list", xdg.DataHome + "/applications/mimeapps.list"}
+}
+
+// migrateDesktopFile changes default applications, favorites, and autostart entries that refer to
+// the desktop file oldname of the AppImage at oldpath to refer to newname of the AppImage at newpath
+func migrateDesktopFile(oldname string, newname string, oldpath string, newpath string) {
+	if oldname == newname {
+		return
+	}
+	log.Println("desktop: Migrating", oldname, "to", newname)
+	for _, path := range mimeappsListPaths() {
+		helpers.LogError("desktop: "+path, replaceInDesktopFileLists(path, oldname, newname))
+	}
+	helpers.LogError("desktop: favorites", migrateFavorites(oldname, newname))
+	helpers.LogError("desktop: autostart", migrateAutostartEntry(oldname, newname, oldpath, newpath))
+}
+
+// replaceInDesktopFileLists replaces oldname by newname in the lists of desktop files
+// in the file at path, such as mimeapps.list
+func replaceInDesktopFileLists(path string, oldname string, newname string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	lines := strings.Split(string(data), "\n")
+	changed := false
+	for i, line := range lines {
+		eq := strings.Index(line, "=")
+		if eq < 0 || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		items := splitDesktopFileList(line[eq+1:])
+		if replaced, ok := replaceInList(items, oldname, newname); ok == true {
+			lines[i] = line[:eq+1] + strings.Join(replaced, ";") + ";"
+			changed = true
+		}
+	}
+	if changed == false {
+		return nil
+	}
+	err = ioutil.WriteFile(path+".tmp", []byte(strings.Join(lines, "\n")), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// replaceInList returns items with oldname replaced by newname, which is not added twice,
+// and whether oldname was there
+func replaceInList(items []string, oldname string, newname string) ([]string, bool) {
+	var results []string
+	found := false
+	for _, item := range items {
+		if item == oldname {
+			found = true
+			item = newname
+		}
+		if item == newname && helpers.SliceContains(results, newname) == true {
+			continue
+		}
+		results = append(results, item)
+	}
+	return results, found
+}
+
+// migrateFavorites replaces oldname by newname in the favorites of GNOME Shell (and docks
+// that use them) and in the launchers of the task managers of KDE Plasma
+func migrateFavorites(oldname string, newname string) error {
+	if helpers.IsCommandAvailable("gsettings") {
+		out, err := exec.Command("gsettings", "get", "org.gnome.shell", "favorite-apps").Output()
+		if err == nil {
+			var favorites []string
+			for _, item := range strings.Split(strings.Trim(strings.TrimSpace(string(out)), "[]"), ",") {
+				if item = strings.Trim(strings.TrimSpace(item), "'"); item != "" {
+					favorites = append(favorites, item)
+				}
+			}
+			if favorites, ok := replaceInList(favorites, oldname, newname); ok == true {
+				err = exec.Command("gsettings", "set", "org.gnome.shell", "favorite-apps", "['"+strings.Join(favorites, "', '")+"']").Run()
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	path := xdg.ConfigHome + "/plasma-org.kde.plasma.desktop-appletsrc"
+	data, err := ioutil.ReadFile(path)
+	if err != nil || strings.Contains(string(data), "applications:"+oldname) == false {
+		return nil
+	}
+	return ioutil.WriteFile(path, []byte(strings.ReplaceAll(string(data), "applications:"+oldname, "applications:"+newname)), 0600)
+}
+
+// migrateAutostartEntry renames the autostart entry oldname to newname
+// and makes it launch the AppImage at newpath rather than at oldpath
+func migrateAutostartEntry(oldname string, newname string, oldpath string, newpath string) error {
+	dir := xdg.ConfigHome + "/autostart/"
+	data, err := ioutil.ReadFile(dir + oldname)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if helpers.Exists(dir + newname) {
+		return os.Remove(dir + oldname)
+	}
+	err = ioutil.WriteFile(dir+newname, []byte(strings.ReplaceAll(string(data), oldpath, newpath)), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Remove(dir + oldname)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adrg/xdg"
+)
+
+func TestStableDesktopFileName(t *testing.T) {
+	for expected, entry := range map[string]RegistryEntry{
+		"appimagekit_org.inkscape.Inkscape.desktop":            {Identifier: "x", AppStreamID: "org.inkscape.Inkscape", DesktopID: "inkscape.desktop", UpdateInformation: "zsync|https://example.com/Inkscape.AppImage.zsync"},
+		"appimagekit_inkscape.desktop":                         {Identifier: "x", DesktopID: "inkscape.desktop", UpdateInformation: "zsync|https://example.com/Inkscape.AppImage.zsync"},
+		"appimagekit_My_App.desktop":                           {Identifier: "x", DesktopID: "My App.desktop"},
+		"appimagekit_28ca26f8433da9840aa11aa0a657db1c.desktop": {Identifier: "x", UpdateInformation: "zsync|https://example.com/Inkscape.AppImage.zsync"},
+		"appimagekit_x.desktop":                                {Identifier: "x"},
+	} {
+		if name := stableDesktopFileName(entry); name != expected {
+			t.Error("Expected", expected, "got", name)
+		}
+	}
+}
+
+func TestDesktopFileMigratesToNewerVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appimaged-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(config string, data string, cache string) {
+		xdg.ConfigHome, xdg.DataHome, xdg.CacheHome = config, data, cache
+	}(xdg.ConfigHome, xdg.DataHome, xdg.CacheHome)
+	xdg.ConfigHome, xdg.DataHome, xdg.CacheHome = dir, dir, dir
+	os.MkdirAll(filepath.Join(dir, "applications"), 0755)
+	defer func(r *Registry) { registry = r }(registry)
+	registry = &Registry{entries: make(map[string]RegistryEntry)}
+
+	now := time.Now()
+	add := func(identifier string, v string, desktopfile string) RegistryEntry {
+		entry := RegistryEntry{Identifier: identifier, Path: filepath.Join(dir, identifier+".AppImage"), ModTime: now, Version: v, DesktopID: "inkscape.desktop"}
+		ioutil.WriteFile(entry.Path, nil, 0755)
+		if desktopfile != "" {
+			entry.DesktopFile = filepath.Join(dir, "applications", desktopfile)
+			ioutil.WriteFile(entry.DesktopFile, nil, 0644)
+		}
+		registry.put(entry)
+		return entry
+	}
+
+	// A desktop file named after the path by an earlier version of appimaged is the default for PNG files
+	old := add("old", "1.0", "appimagekit_old.desktop")
+	ioutil.WriteFile(filepath.Join(dir, "mimeapps.list"), []byte("[Default Applications]\nimage/png=appimagekit_old.desktop;other.desktop;\n"), 0644)
+	if name := assignDesktopFile(old, "appimagekit_old.desktop"); name != "appimagekit_inkscape.desktop" {
+		t.Fatal("Expected the desktop file to be named after the application, got", name)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "mimeapps.list"))
+	if strings.Contains(string(data), "image/png=appimagekit_inkscape.desktop;other.desktop;") == false {
+		t.Error("Expected the default application to be migrated, got", string(data))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "applications", "appimagekit_old.desktop")); os.IsNotExist(err) == false {
+		t.Error("Expected the old desktop file to be removed")
+	}
+	old = add("old", "1.0", "appimagekit_inkscape.desktop")
+
+	// A newer version takes over the name, the old version gets a name of its own
+	newer := add("new", "2.0", "")
+	if name := assignDesktopFile(newer, ""); name != "appimagekit_inkscape.desktop" {
+		t.Error("Expected the newer version to take over the desktop file, got", name)
+	}
+	newer = add("new", "2.0", "appimagekit_inkscape.desktop")
+	if name := assignDesktopFile(old, "appimagekit_inkscape.desktop"); name != "appimagekit_old.desktop" {
+		t.Error("Expected the old version to get a desktop file of its own, got", name)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "applications", "appimagekit_inkscape.desktop")); err != nil {
+		t.Error("Expected the desktop file of the newer version to be kept")
+	}
+	old = add("old", "1.0", "appimagekit_old.desktop")
+
+	// When the newer version is deleted, the old one takes over its desktop file
+	os.Remove(newer.Path)
+	if handOverDesktopFile(newer) == false {
+		t.Error("Expected the desktop file to be handed over")
+	}
+	// When the old one is deleted too, there is nobody to take over
+	os.Remove(old.Path)
+	if handOverDesktopFile(old) == true {
+		t.Error("Expected the desktop file not to be handed over")
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+// inotify needs one watch per directory, so it cannot watch whole filesystems.
+// fanotify can, with a filesystem mark and file identifiers (FIDs) in the events
+// (Linux 5.9 or later), but needs CAP_SYS_ADMIN. Hence the filesystems listed with
+//
+//	fanotify = /, /home
+//
+// in appimaged.conf are watched by a small helper, "appimaged fanotify-helper", which is
+// started with pkexec (or runs in-process if the daemon has CAP_SYS_ADMIN itself).
+// It writes the paths of AppImages that were created, written, moved, or deleted to its
+// standard output, separated by null bytes. Directories on those filesystems are then
+// only scanned but not watched with inotify. If the helper cannot be started or exits,
+// everything is watched with inotify again.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/probonopd/go-appimage/internal/helpers"
+	"golang.org/x/sys/unix"
+)
+
+// capSysAdmin is the number of CAP_SYS_ADMIN in the capability sets in /proc/self/status
+const capSysAdmin = 21
+
+// fanotifyEvents are the events the helper reports
+const fanotifyEvents = unix.FAN_CREATE | unix.FAN_MOVED_TO | unix.FAN_CLOSE_WRITE | unix.FAN_MOVED_FROM | unix.FAN_DELETE
+
+// fanotifyState is what is being watched with fanotify
+var fanotifyState struct {
+	sync.Mutex
+	filesystems []string
+	generation  int             // Incremented whenever the helper is (re)started
+	devices     map[uint64]bool // Devices of the filesystems while the helper is watching them
+	stop        func()
+}
+
+// hasCapSysAdmin returns true if this process has CAP_SYS_ADMIN in its effective set
+func hasCapSysAdmin() bool {
+	data, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "CapEff:") {
+			caps, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+			return err == nil && caps&(1<<capSysAdmin) != 0
+		}
+	}
+	return false
+}
+
+// isAppImageFileName returns true if the name is one the helper reports
+func isAppImageFileName(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), ".appimage") || strings.HasSuffix(name, ".app")
+}
+
+// deviceOf returns the device of the filesystem path is on
+func deviceOf(path string) (uint64, error) {
+	var st unix.Stat_t
+	err := unix.Stat(path, &st)
+	return uint64(st.Dev), err
+}
+
+// coveredByFanotify returns true if dir is on one of the filesystems the helper is watching
+func coveredByFanotify(dir string) bool {
+	fanotifyState.Lock()
+	defer fanotifyState.Unlock()
+	if len(fanotifyState.devices) == 0 {
+		return false
+	}
+	dev, err := deviceOf(dir)
+	return err == nil && fanotifyState.devices[dev] == true
+}
+
+// applyFanotify starts watching the filesystems with fanotify unless they are already watched
+// or the helper has failed for them. Until the helper is ready, and if it fails, inotify is used
+func applyFanotify(filesystems []string) {
+	fanotifyState.Lock()
+	defer fanotifyState.Unlock()
+	if strings.Join(filesystems, ",") == strings.Join(fanotifyState.filesystems, ",") {
+		return
+	}
+	if fanotifyState.stop != nil {
+		fanotifyState.stop()
+		fanotifyState.stop = nil
+	}
+	fanotifyState.filesystems = filesystems
+	fanotifyState.generation++
+	fanotifyState.devices = nil
+	if len(filesystems) == 0 {
+		return
+	}
+
+	if hasCapSysAdmin() == true {
+		r, w := io.Pipe()
+		go func() {
+			w.CloseWithError(runFanotifyHelper(filesystems, -1, w))
+		}()
+		fanotifyState.stop = func() { r.Close() }
+		go readFanotifyHelper(r, fanotifyState.generation)
+		return
+	}
+	if helpers.IsCommandAvailable("pkexec") == false {
+		log.Println("fanotify: Not running with CAP_SYS_ADMIN and pkexec is missing, using inotify")
+		return
+	}
+	args := []string{thisai.Path, "fanotify-helper", "-uid", strconv.Itoa(os.Getuid())}
+	cmd := exec.Command("pkexec", append(args, filesystems...)...)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		helpers.PrintError("fanotify: Could not start the helper, using inotify", err)
+		return
+	}
+	fanotifyState.stop = func() { cmd.Process.Kill() }
+	go func(generation int) {
+		readFanotifyHelper(stdout, generation)
+		cmd.Wait()
+	}(fanotifyState.generation)
+}
+
+// readFanotifyHelper waits until the helper has marked the filesystems and then
+// queues the paths it reports until it exits
+func readFanotifyHelper(r io.Reader, generation int) {
+	br := bufio.NewReader(r)
+	// The helper writes one line once it has marked the filesystems,
+	// e.g., after pkexec has asked for the password
+	ready, err := br.ReadString('\n')
+	if err != nil || strings.TrimSpace(ready) != "ready" {
+		log.Println("fanotify: The helper did not start, using inotify")
+		return
+	}
+	fanotifyState.Lock()
+	current := fanotifyState.generation == generation
+	if current == true {
+		fanotifyState.devices = make(map[uint64]bool)
+		for _, fs := range fanotifyState.filesystems {
+			if dev, err := deviceOf(fs); err == nil {
+				fanotifyState.devices[dev] = true
+			}
+		}
+		log.Println("fanotify: Watching", fanotifyState.filesystems)
+	}
+	fanotifyState.Unlock()
+	if current == false {
+		return
+	}
+	// Directories on these filesystems no longer need to be watched with inotify
+	go watchDirectories()
+
+	scanner := bufio.NewScanner(br)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexByte(data, 0); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+	for scanner.Scan() {
+		if *verbosePtr == true {
+			log.Println("fanotify:", scanner.Text())
+		}
+		if fanotifyEventIsWatched(scanner.Text()) == true {
+			integrationQueue.Enqueue(scanner.Text())
+		}
+	}
+
+	fanotifyState.Lock()
+	current = fanotifyState.generation == generation
+	if current == true {
+		fanotifyState.devices = nil
+	}
+	fanotifyState.Unlock()
+	if current == true {
+		log.Println("fanotify: The helper has exited, using inotify")
+		go watchDirectories()
+	}
+}
+
+// fanotifyEventIsWatched returns whether an event for the AppImage at path is to be handled.
+// fanotify reports AppImages anywhere on the filesystems, but like with inotify, only those in the
+// watched directories which match their configuration are handled. Outside of them, only AppImages
+// which are registered (e.g., because their integration was requested) or are to be integrated
+// on request are handled, so that they get unintegrated when they are deleted or moved away
+func fanotifyEventIsWatched(path string) bool {
+	if root, ok := findWatchRoot(watcher.Roots(), path); ok == true && root.matches(path) {
+		return true
+	}
+	if entry, _ := registry.Lookup(path); entry.Path != "" {
+		return true
+	}
+	integrationRequests.Lock()
+	defer integrationRequests.Unlock()
+	return integrationRequests.paths[path]
+}
+
+// fanotifyHelper is "appimaged fanotify-helper [-uid <uid>] <filesystem>...",
+// which needs to run with CAP_SYS_ADMIN
+func fanotifyHelper() {
+	flags := flag.NewFlagSet("fanotify-helper", flag.ExitOnError)
+	uid := flags.Int("uid", -1, "Only report files owned by this user or readable by everyone")
+	flags.Parse(os.Args[2:])
+	if flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "Usage:", os.Args[0], "fanotify-helper [-uid <uid>] <filesystem>...")
+		os.Exit(1)
+	}
+	err := runFanotifyHelper(flags.Args(), *uid, os.Stdout)
+	if err != nil {
+		helpers.PrintError("fanotify-helper", err)
+		os.Exit(1)
+	}
+}
+
+// runFanotifyHelper marks the filesystems, writes "ready" and a newline to w,
+// and then the null-terminated paths of AppImages for which events arrive
+func runFanotifyHelper(filesystems []string, uid int, w io.Writer) error {
+	fd, err := unix.FanotifyInit(unix.FAN_CLASS_NOTIF|unix.FAN_CLOEXEC|unix.FAN_REPORT_DFID_NAME, unix.O_RDONLY|unix.O_CLOEXEC)
+	if err != nil {
+		return errors.New("fanotify_init: " + err.Error() + " (Linux 5.9 or later and CAP_SYS_ADMIN are needed)")
+	}
+	defer unix.Close(fd)
+
+	// File handles in events are resolved relative to a file descriptor on the same filesystem
+	mountFds := make(map[[2]int32]int)
+	for _, fs := range filesystems {
+		err = unix.FanotifyMark(fd, unix.FAN_MARK_ADD|unix.FAN_MARK_FILESYSTEM, fanotifyEvents, unix.AT_FDCWD, fs)
+		if err != nil {
+			return errors.New("fanotify_mark " + fs + ": " + err.Error())
+		}
+		var statfs unix.Statfs_t
+		err = unix.Statfs(fs, &statfs)
+		if err != nil {
+			return err
+		}
+		mountFd, err := unix.Open(fs, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return err
+		}
+		defer unix.Close(mountFd)
+		mountFds[statfs.Fsid.Val] = mountFd
+	}
+	_, err = io.WriteString(w, "ready\n")
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := unix.Read(fd, buf)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		resolve := func(fsid [2]int32, handle unix.FileHandle) (string, error) {
+			mountFd, ok := mountFds[fsid]
+			if ok == false {
+				return "", errors.New("not on a watched filesystem")
+			}
+			return resolveFileHandle(mountFd, handle)
+		}
+		for _, path := range parseFanotifyEvents(buf[:n], resolve) {
+			if fanotifyVisibleTo(path, uid) == false {
+				continue
+			}
+			_, err = io.WriteString(w, path+"\x00")
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// parseFanotifyEvents returns the paths of the AppImages in the events in buf,
+// which have been reported with FAN_REPORT_DFID_NAME; resolve returns the path
+// of the directory with the handle on the filesystem with the fsid
+func parseFanotifyEvents(buf []byte, resolve func(fsid [2]int32, handle unix.FileHandle) (string, error)) []string {
+	var paths []string
+	metadataLen := int(unsafe.Sizeof(unix.FanotifyEventMetadata{}))
+	for len(buf) >= metadataLen {
+		eventLen := int(binary.LittleEndian.Uint32(buf[0:4]))
+		if eventLen < metadataLen || eventLen > len(buf) {
+			break
+		}
+		headerLen := int(binary.LittleEndian.Uint16(buf[6:8]))
+		if headerLen < metadataLen || headerLen > eventLen {
+			buf = buf[eventLen:]
+			continue
+		}
+		info := buf[headerLen:eventLen]
+		// struct fanotify_event_info_fid: header (type, pad, len), fsid, struct file_handle, name
+		for len(info) >= 4+8+8 {
+			infoType := info[0]
+			infoLen := int(binary.LittleEndian.Uint16(info[2:4]))
+			if infoLen < 4+8+8 || infoLen > len(info) {
+				break
+			}
+			if infoType == unix.FAN_EVENT_INFO_TYPE_DFID_NAME {
+				var fsid [2]int32
+				fsid[0] = int32(binary.LittleEndian.Uint32(info[4:8]))
+				fsid[1] = int32(binary.LittleEndian.Uint32(info[8:12]))
+				handleBytes := int(binary.LittleEndian.Uint32(info[12:16]))
+				handleType := int32(binary.LittleEndian.Uint32(info[16:20]))
+				if 20+handleBytes <= infoLen {
+					handle := unix.NewFileHandle(handleType, info[20:20+handleBytes])
+					name := string(bytes.TrimRight(bytes.SplitN(info[20+handleBytes:infoLen], []byte{0}, 2)[0], "\x00"))
+					if isAppImageFileName(name) {
+						if dir, err := resolve(fsid, handle); err == nil {
+							paths = append(paths, filepath.Join(dir, name))
+						}
+					}
+				}
+			}
+			info = info[infoLen:]
+		}
+		buf = buf[eventLen:]
+	}
+	return paths
+}
+
+// resolveFileHandle returns the path of the directory with the handle
+func resolveFileHandle(mountFd int, handle unix.FileHandle) (string, error) {
+	fd, err := unix.OpenByHandleAt(mountFd, handle, unix.O_PATH|unix.O_CLOEXEC)
+	if err != nil {
+		return "", err
+	}
+	defer unix.Close(fd)
+	return os.Readlink("/proc/self/fd/" + strconv.Itoa(fd))
+}
+
+// fanotifyVisibleTo returns true if the file at path is owned by uid or readable by everyone,
+// or if uid is -1. Deleted files are reported since they may need to be unintegrated
+func fanotifyVisibleTo(path string, uid int) bool {
+	if uid < 0 {
+		return true
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return true
+	}
+	return int(st.Uid) == uid || st.Mode&0004 != 0
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// fanotifyRecord returns an event with a FAN_EVENT_INFO_TYPE_DFID_NAME record for name
+// in the directory with the handle on the filesystem with the fsid
+func fanotifyRecord(fsid [2]int32, handle []byte, name string) []byte {
+	info := make([]byte, 20, 20+len(handle)+len(name)+4)
+	info[0] = unix.FAN_EVENT_INFO_TYPE_DFID_NAME
+	binary.LittleEndian.PutUint32(info[4:8], uint32(fsid[0]))
+	binary.LittleEndian.PutUint32(info[8:12], uint32(fsid[1]))
+	binary.LittleEndian.PutUint32(info[12:16], uint32(len(handle)))
+	binary.LittleEndian.PutUint32(info[16:20], 1) // Handle type
+	info = append(info, handle...)
+	info = append(info, name...)
+	info = append(info, 0)
+	for len(info)%4 != 0 {
+		info = append(info, 0)
+	}
+	binary.LittleEndian.PutUint16(info[2:4], uint16(len(info)))
+
+	metadataLen := int(unsafe.Sizeof(unix.FanotifyEventMetadata{}))
+	event := make([]byte, metadataLen)
+	binary.LittleEndian.PutUint32(event[0:4], uint32(metadataLen+len(info)))
+	event[4] = unix.FANOTIFY_METADATA_VERSION
+	binary.LittleEndian.PutUint16(event[6:8], uint16(metadataLen))
+	binary.LittleEndian.PutUint64(event[8:16], unix.FAN_CREATE)
+	return append(event, info...)
+}
+
+func TestParseFanotifyEvents(t *testing.T) {
+	watched := [2]int32{1, 2}
+	resolve := func(fsid [2]int32, handle unix.FileHandle) (string, error) {
+		if fsid != watched {
+			return "", errors.New("not on a watched filesystem")
+		}
+		return "/home/me/" + string(handle.Bytes()), nil
+	}
+
+	var buf []byte
+	buf = append(buf, fanotifyRecord(watched, []byte("Downloads"), "Inkscape.AppImage")...)
+	buf = append(buf, fanotifyRecord(watched, []byte("Downloads"), "notes.txt")...)
+	buf = append(buf, fanotifyRecord([2]int32{3, 4}, []byte("Downloads"), "Other.AppImage")...)
+	buf = append(buf, fanotifyRecord(watched, []byte("Applications"), "gimp.appimage")...)
+	expected := []string{"/home/me/Downloads/Inkscape.AppImage", "/home/me/Applications/gimp.appimage"}
+	if paths := parseFanotifyEvents(buf, resolve); reflect.DeepEqual(paths, expected) == false {
+		t.Error("Expected", expected, "got", paths)
+	}
+
+	record := fanotifyRecord(watched, []byte("Downloads"), "Inkscape.AppImage")
+	metadataLen := int(unsafe.Sizeof(unix.FanotifyEventMetadata{}))
+	for name, change := range map[string]func(b []byte) []byte{
+		"truncated buffer": func(b []byte) []byte { return b[:len(b)-8] },
+		"truncated metadata": func(b []byte) []byte {
+			return b[:metadataLen-1]
+		},
+		"event_len beyond the buffer": func(b []byte) []byte {
+			binary.LittleEndian.PutUint32(b[0:4], uint32(len(b)+4))
+			return b
+		},
+		"event_len shorter than the metadata": func(b []byte) []byte {
+			binary.LittleEndian.PutUint32(b[0:4], uint32(metadataLen-1))
+			return b
+		},
+		"metadata_len beyond event_len": func(b []byte) []byte {
+			binary.LittleEndian.PutUint16(b[6:8], uint16(len(b)+4))
+			return b
+		},
+		"info_len beyond the event": func(b []byte) []byte {
+			binary.LittleEndian.PutUint16(b[metadataLen+2:metadataLen+4], uint16(len(b)))
+			return b
+		},
+		"info_len shorter than its header": func(b []byte) []byte {
+			binary.LittleEndian.PutUint16(b[metadataLen+2:metadataLen+4], 4)
+			return b
+		},
+		"handle beyond info_len": func(b []byte) []byte {
+			binary.LittleEndian.PutUint32(b[metadataLen+12:metadataLen+16], 1000)
+			return b
+		},
+	} {
+		b := change(append([]byte(nil), record...))
+		if paths := parseFanotifyEvents(b, resolve); len(paths) != 0 {
+			t.Error("Expected nothing for", name+", got", paths)
+		}
+	}
+}
+
+func TestFanotifyEventIsWatched(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appimaged-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(r *Registry, roots []WatchRoot) { registry, watcher.roots = r, roots }(registry, watcher.roots)
+	registry = &Registry{entries: make(map[string]RegistryEntry)}
+	root := newWatchRoot(filepath.Join(dir, "Applications"))
+	root.Exclude = []string{"*-old.AppImage"}
+	watcher.roots = []WatchRoot{root}
+
+	registered := filepath.Join(dir, "Downloads", "Registered.AppImage")
+	os.MkdirAll(filepath.Dir(registered), 0755)
+	registry.put(registeredFile(t, registered, "Registered"))
+	requested := filepath.Join(dir, "Downloads", "Requested.AppImage")
+	requestIntegration(requested)
+	defer shouldIntegrate(requested)
+
+	for path, expected := range map[string]bool{
+		filepath.Join(dir, "Applications", "App.AppImage"):        true,
+		filepath.Join(dir, "Applications", "App-old.AppImage"):    false, // Excluded
+		filepath.Join(dir, "Applications", "sub", "App.AppImage"): false, // Deeper than the root is watched
+		filepath.Join(dir, "Downloads", "Other.AppImage"):         false,
+		registered: true,
+		requested:  true,
+	} {
+		if fanotifyEventIsWatched(path) != expected {
+			t.Error("Expected", expected, "for", path)
+		}
+	}
+}
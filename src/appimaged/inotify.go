@@ -22,40 +22,238 @@ package main
 // us Unix specific and not cross-platform. Therefore, we are using https://github.com/rjeczalik/notify
 
 import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
 	"github.com/probonopd/go-appimage/internal/helpers"
 	"github.com/rjeczalik/notify"
-	"log"
 )
 
 // Can we watch files with a certain file name extension only
 // and how would this improve performance?
 
-func inotifyWatch(path string) {
-	// Make the channel buffered to ensure no event is dropped. Notify will drop
-	// an event if the receiver is not able to keep up the sending pace.
-	c := make(chan notify.EventInfo, 1)
+// inotifyEvents are the events we watch directories for
+var inotifyEvents = []notify.Event{notify.InCloseWrite, notify.InMovedTo,
+	notify.InMovedFrom, notify.InDelete, notify.InCreate,
+	notify.InDeleteSelf}
+
+// directoryWatch is an inotify watch on one directory
+type directoryWatch struct {
+	c    chan notify.EventInfo
+	done chan struct{}
+	root WatchRoot
+}
+
+// directoryWatcher watches the WatchRoots and their subdirectories
+// up to the configured depth, within a budget of inotify watches
+type directoryWatcher struct {
+	mu         sync.Mutex
+	roots      []WatchRoot
+	watches    map[string]*directoryWatch
+	maxWatches int
+	warned     bool
+}
+
+var watcher = &directoryWatcher{watches: make(map[string]*directoryWatch)}
+
+// Roots returns the watched roots
+func (w *directoryWatcher) Roots() []WatchRoot {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]WatchRoot(nil), w.roots...)
+}
+
+// Apply stops all watches and watches the roots, which are scanned for AppImages
+func (w *directoryWatcher) Apply(roots []WatchRoot, maxWatches int) {
+	w.mu.Lock()
+	for dir, watch := range w.watches {
+		notify.Stop(watch.c)
+		close(watch.done)
+		delete(w.watches, dir)
+	}
+	w.roots = roots
+	w.maxWatches = maxWatches
+	w.warned = false
+	w.mu.Unlock()
+
+	for _, root := range roots {
+		if helpers.IsDirectory(root.Path) {
+			w.watchTree(root, root.Path)
+		}
+	}
+	w.mu.Lock()
+	log.Println("Watching", len(w.watches), "directories")
+	w.mu.Unlock()
+}
+
+// watchTree watches dir and its subdirectories within the depth of the root
+// unless they are watched with fanotify, and queues the AppImages in there
+func (w *directoryWatcher) watchTree(root WatchRoot, dir string) {
+	// Directories on filesystems watched with fanotify only need to be scanned
+	if coveredByFanotify(dir) == false && w.addWatch(root, dir) == false {
+		return
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		helpers.PrintError("watchTree", err)
+		return
+	}
+	for _, info := range infos {
+		path := dir + "/" + info.Name()
+		if info.IsDir() == true {
+			if strings.HasPrefix(info.Name(), ".") == false && root.containsDirectory(path) {
+				w.watchTree(root, path)
+			}
+		} else if root.matches(path) {
+			queueUnlessUnchanged(path)
+		}
+	}
+}
+
+// addWatch watches dir unless it is already watched or there are no watches left,
+// returns whether dir is watched
+func (w *directoryWatcher) addWatch(root WatchRoot, dir string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.watches[dir]; ok == true {
+		return true
+	}
+	if len(w.watches) >= w.maxWatches {
+		w.warnLimit()
+		return false
+	}
+	watch := &directoryWatch{c: make(chan notify.EventInfo, 64), done: make(chan struct{}), root: root}
+	if err := notify.Watch(dir, watch.c, inotifyEvents...); err != nil {
+		if errors.Is(err, syscall.ENOSPC) {
+			w.warnLimit()
+		} else {
+			log.Println(err) // Don't be fatal if a directory cannot be read (e.g., no read rights)
+		}
+		return false
+	}
+	w.watches[dir] = watch
+	go w.handleEvents(dir, watch)
+	return true
+}
+
+// warnLimit warns once that not all directories can be watched; needs w.mu to be held
+func (w *directoryWatcher) warnLimit() {
+	if w.warned == true {
+		return
+	}
+	w.warned = true
+	log.Println("WARNING: Reached the limit of", w.maxWatches, "watched directories, not watching more.")
+	log.Println("Reduce the depth of watched directories or set maxwatches in", watchConfigFilePath())
+	go sendErrorDesktopNotification("Not watching all directories", "The limit of "+strconv.Itoa(w.maxWatches)+" watched directories was reached")
+}
 
-	// Set up a watchpoint listening for inotify-specific events within a
-	// current working directory. Dispatch each InCloseWrite and InMovedTo
-	// events separately to c.
-	if err := notify.Watch(path, c, notify.InCloseWrite, notify.InMovedTo,
-		notify.InMovedFrom, notify.InDelete,
-		notify.InDeleteSelf); err != nil {
-		log.Println(err) // Don't be fatal if a directory cannot be read (e.g., no read rights)
+// removeWatch stops watching dir and its subdirectories, returns the directories no longer watched
+func (w *directoryWatcher) removeWatch(dir string) []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var removed []string
+	for d, watch := range w.watches {
+		if d == dir || strings.HasPrefix(d, dir+"/") {
+			notify.Stop(watch.c)
+			close(watch.done)
+			delete(w.watches, d)
+			removed = append(removed, d)
+		}
 	}
-	defer notify.Stop(c)
+	return removed
+}
 
+func (w *directoryWatcher) handleEvents(dir string, watch *directoryWatch) {
 	for {
-		// Block until an event is received.
-		switch ei := <-c; ei.Event() {
+		var ei notify.EventInfo
+		select {
+		case <-watch.done:
+			return
+		case ei = <-watch.c:
+		}
+		if *verbosePtr == true {
+			log.Println("inotifyWatch:", ei.Path(), ei.Event())
+		}
+		path := ei.Path()
+		switch ei.Event() {
 		case notify.InDeleteSelf:
-			log.Println("TODO:", ei.Path(), "was deleted, un-integrate all AppImages that were conteined herein")
-			ToBeIntegratedOrUnintegrated = helpers.AppendIfMissing(ToBeIntegratedOrUnintegrated, ei.Path())
-			// log.Println("ToBeIntegratedOrUnintegrated now contains:", ToBeIntegratedOrUnintegrated)
+			// Un-integrate all AppImages that were contained herein
+			w.removeWatch(dir)
+			queueRegisteredBelow(dir)
+		case notify.InCreate, notify.InMovedTo:
+			if helpers.IsDirectory(path) {
+				if strings.HasPrefix(filepath.Base(path), ".") == false && watch.root.containsDirectory(path) {
+					w.watchTree(watch.root, path)
+				}
+			} else if ei.Event() == notify.InMovedTo && watch.root.matches(path) {
+				integrationQueue.Enqueue(path)
+			}
+		case notify.InMovedFrom, notify.InDelete:
+			if len(w.removeWatch(path)) > 0 {
+				queueRegisteredBelow(path)
+			} else if watch.root.matches(path) {
+				integrationQueue.Enqueue(path)
+			}
 		default:
-			log.Println("inotifyWatch:", ei.Path(), ei.Event())
-			ToBeIntegratedOrUnintegrated = helpers.AppendIfMissing(ToBeIntegratedOrUnintegrated, ei.Path())
-			// log.Println("ToBeIntegratedOrUnintegrated now contains:", ToBeIntegratedOrUnintegrated)
+			if watch.root.matches(path) {
+				integrationQueue.Enqueue(path)
+			}
+		}
+	}
+}
+
+// queueUnlessUnchanged queues the file at path unless it is an AppImage
+// that has not changed since it was integrated
+func queueUnlessUnchanged(path string) {
+	if alreadyIntegrated(path) == false {
+		integrationQueue.Enqueue(path)
+	}
+}
+
+// alreadyIntegrated returns whether the AppImage at path has not changed since it was integrated,
+// in which case it does not need to be read again and is only subscribed to
+func alreadyIntegrated(path string) bool {
+	entry, fresh := registry.Lookup(path)
+	if fresh == false || entry.DesktopFile == "" || helpers.Exists(entry.DesktopFile) == false {
+		return false
+	}
+	if entry.UpdateInformation != "" && CheckIfConnectedToNetwork() == true {
+		go SubscribeMQTT(MQTTclient, entry.UpdateInformation)
+	}
+	return true
+}
+
+// queueRegisteredBelow queues the registered AppImages in dir, e.g., after it was deleted
+func queueRegisteredBelow(dir string) {
+	for _, entry := range registry.Entries() {
+		if strings.HasPrefix(entry.Path, dir+"/") {
+			integrationQueue.Enqueue(entry.Path)
 		}
 	}
 }
+
+// watchFileChanges returns a channel that receives a value whenever the file at path
+// is written, replaced, or removed. The directory of the file must exist
+func watchFileChanges(path string) <-chan struct{} {
+	changes := make(chan struct{})
+	c := make(chan notify.EventInfo, 8)
+	if err := notify.Watch(filepath.Dir(path), c, notify.InCloseWrite, notify.InMovedTo, notify.InMovedFrom, notify.InDelete); err != nil {
+		helpers.PrintError("watchFileChanges", err)
+		close(changes)
+		return changes
+	}
+	go func() {
+		for ei := range c {
+			if filepath.Base(ei.Path()) == filepath.Base(path) {
+				changes <- struct{}{}
+			}
+		}
+	}()
+	return changes
+}
@@ -0,0 +1,253 @@
+package main
+
+// Finds AppImages the way Launch Services does on macOS: by what the application is rather than
+// by where its file is. An application can be asked for by its AppStream component ID
+// (e.g., org.inkscape.Inkscape), by the name of the desktop file in the AppImage, or by
+// the name of its executable; and the AppImage to open a file type or URL scheme with
+// can be asked for by the MIME type. Of several AppImages of the application,
+// the most recent one is chosen (see version.go)
+
+import (
+	"io/ioutil"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/go-version"
+	"github.com/probonopd/go-appimage/internal/helpers"
+	"gopkg.in/ini.v1"
+)
+
+// AmbiguousError is returned when an ID matches more than one application equally well
+type AmbiguousError struct {
+	ID         string
+	Candidates []string // The path of the most recent AppImage of each application
+}
+
+func (e *AmbiguousError) Error() string {
+	return e.ID + " matches several applications: " + strings.Join(e.Candidates, ", ")
+}
+
+// readEmbeddedDesktopFile returns the name of the desktop file in the top-level directory
+// of the AppImage, the name of the executable in its Exec= key, and the MIME types it can open
+func readEmbeddedDesktopFile(ai *AppImage) (string, string, []string) {
+	if ai.AppImage == nil || ai.Type() < 1 {
+		return "", "", nil
+	}
+	for _, name := range ai.ListFiles("/") {
+		if matched, _ := path.Match("*.desktop", name); matched == false {
+			continue
+		}
+		r, err := ai.ExtractFileReader(name)
+		if err != nil {
+			return name, "", nil
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return name, "", nil
+		}
+		cfg, err := ini.LoadSources(ini.LoadOptions{IgnoreInlineComment: true}, data) // Do not cripple lines hat contain ";"
+		if err != nil {
+			return name, "", nil
+		}
+		section := cfg.Section("Desktop Entry")
+		return name, executableName(section.Key("Exec").String()), splitDesktopFileList(section.Key("MimeType").String())
+	}
+	return "", "", nil
+}
+
+// executableName returns the name of the executable in an Exec= key
+func executableName(exec string) string {
+	exec = strings.TrimSpace(exec)
+	if strings.HasPrefix(exec, "\"") {
+		if end := strings.Index(exec[1:], "\""); end >= 0 {
+			return filepath.Base(exec[1 : end+1])
+		}
+	}
+	fields := strings.Fields(exec)
+	if len(fields) == 0 {
+		return ""
+	}
+	return filepath.Base(fields[0])
+}
+
+// splitDesktopFileList splits a list such as MimeType=text/plain;image/png;
+// Some desktop files use the fullwidth semicolon
+func splitDesktopFileList(s string) []string {
+	var results []string
+	for _, item := range strings.FieldsFunc(s, func(r rune) bool { return r == ';' || r == '；' }) {
+		if item = strings.TrimSpace(item); item != "" {
+			results = append(results, item)
+		}
+	}
+	return results
+}
+
+// applicationKey returns what tells apart the applications of AppImages:
+// AppImages with the same key are versions of the same application
+func applicationKey(entry RegistryEntry) string {
+	switch {
+	case entry.AppStreamID != "":
+		return "appstream:" + strings.TrimSuffix(entry.AppStreamID, ".desktop")
+	case entry.DesktopID != "":
+		return "desktop:" + strings.TrimSuffix(entry.DesktopID, ".desktop")
+	case entry.UpdateInformation != "":
+		unescapedui, _ := url.QueryUnescape(entry.UpdateInformation)
+		return "updateinformation:" + unescapedui
+	}
+	return "path:" + entry.Path
+}
+
+// applicationMatch tells how well the AppImage matches id:
+// 3 for its AppStream component ID, 2 for the name of its desktop file, 1 for its executable, 0 for no match
+func applicationMatch(entry RegistryEntry, id string) int {
+	bare := strings.TrimSuffix(id, ".desktop")
+	switch {
+	case entry.AppStreamID != "" && strings.TrimSuffix(entry.AppStreamID, ".desktop") == bare:
+		return 3
+	case entry.DesktopID != "" && strings.TrimSuffix(entry.DesktopID, ".desktop") == bare:
+		return 2
+	case entry.Executable != "" && entry.Executable == id:
+		return 1
+	}
+	return 0
+}
+
+// FindByApplicationID returns the entries of the AppImages that exist and match id best
+// (see applicationMatch), the most recent one first. If they belong to more than one application,
+// an *AmbiguousError is returned
+func (r *Registry) FindByApplicationID(id string) ([]RegistryEntry, error) {
+	best := 0
+	applications := make(map[string][]RegistryEntry)
+	for _, entry := range r.Entries() {
+		match := applicationMatch(entry, id)
+		if match == 0 || match < best || helpers.Exists(entry.Path) == false {
+			continue
+		}
+		if match > best {
+			best = match
+			applications = make(map[string][]RegistryEntry)
+		}
+		key := applicationKey(entry)
+		applications[key] = append(applications[key], entry)
+	}
+	if len(applications) > 1 {
+		err := &AmbiguousError{ID: id}
+		for _, entries := range applications {
+			rankAppImages(entries)
+			err.Candidates = append(err.Candidates, entries[0].Path)
+		}
+		sort.Strings(err.Candidates)
+		return nil, err
+	}
+	for _, entries := range applications {
+		rankAppImages(entries)
+		return entries, nil
+	}
+	return nil, nil
+}
+
+// resolveApplication returns the path of the most recent AppImage whose version satisfies constraints,
+// if given, for id, which can be update information or anything FindByApplicationID takes;
+// "" if there is none
+func resolveApplication(id string, constraints version.Constraints) (string, error) {
+	if helpers.ValidateUpdateInformation(id) == nil {
+		return findMostRecentAppImage(registry.FindEntriesByUpdateInformation(id), constraints), nil
+	}
+	entries, err := registry.FindByApplicationID(id)
+	if err != nil {
+		return "", err
+	}
+	return findMostRecentAppImage(entries, constraints), nil
+}
+
+// FindHandler returns the path of the AppImage to open the MIME type with, which can be
+// x-scheme-handler/<scheme> for URLs; "" if there is none. The default application in mimeapps.list
+// is preferred if it is an AppImage; otherwise AppImages that name the MIME type are preferred over those
+// that match it with a wildcard such as image/*, and of those the most recent one is chosen
+func (r *Registry) FindHandler(mimetype string) string {
+	entries := r.Entries()
+	for _, desktopfile := range defaultApplications(mimetype) {
+		for _, entry := range entries {
+			if filepath.Base(entry.DesktopFile) != desktopfile && pathDesktopFileName(entry) != desktopfile {
+				continue
+			}
+			// The most recent AppImage of the application, which may not be the one the desktop file is for
+			var versions []RegistryEntry
+			for _, other := range entries {
+				if applicationKey(other) == applicationKey(entry) {
+					versions = append(versions, other)
+				}
+			}
+			if a := findMostRecentAppImage(versions, nil); a != "" {
+				return a
+			}
+		}
+	}
+	best := 0
+	var candidates []RegistryEntry
+	for _, entry := range entries {
+		match := 0
+		for _, t := range entry.MimeTypes {
+			if t == mimetype {
+				match = 2
+				break
+			}
+			if matched, _ := path.Match(t, mimetype); matched == true {
+				match = 1
+			}
+		}
+		if match == 0 || match < best {
+			continue
+		}
+		if match > best {
+			best = match
+			candidates = nil
+		}
+		candidates = append(candidates, entry)
+	}
+	return findMostRecentAppImage(candidates, nil)
+}
+
+// defaultApplications returns the names of the desktop files that are the default applications
+// for the MIME type according to the mimeapps.list files of the user
+func defaultApplications(mimetype string) []string {
+	var results []string
+	for _, p := range mimeappsListPaths() {
+		cfg, err := ini.LoadSources(ini.LoadOptions{IgnoreInlineComment: true}, p)
+		if err != nil {
+			continue
+		}
+		results = append(results, splitDesktopFileList(cfg.Section("Default Applications").Key(mimetype).String())...)
+	}
+	return results
+}
+
+// mimeTypeForArgument returns the MIME type of a file judging from its name;
+// if arg is not a file but a MIME type, it is returned
+func mimeTypeForArgument(arg string) string {
+	if info, err := os.Stat(arg); err == nil && info.IsDir() {
+		return "inode/directory"
+	} else if err != nil {
+		if mediatype, _, err := mime.ParseMediaType(arg); err == nil && strings.Contains(mediatype, "/") {
+			return mediatype
+		}
+	}
+	mediatype, _, _ := mime.ParseMediaType(mime.TypeByExtension(filepath.Ext(arg)))
+	return mediatype
+}
+
+// mimeTypeForURL returns the MIME type of the handlers for the scheme of a URL,
+// which can also be given as just the scheme
+func mimeTypeForURL(arg string) string {
+	scheme := strings.TrimSuffix(arg, ":")
+	if u, err := url.Parse(arg); err == nil && u.Scheme != "" {
+		scheme = u.Scheme
+	}
+	return "x-scheme-handler/" + strings.ToLower(scheme)
+}
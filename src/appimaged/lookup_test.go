@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/adrg/xdg"
+)
+
+func TestFindByApplicationID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appimaged-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(config string, data string) { xdg.ConfigHome, xdg.DataHome = config, data }(xdg.ConfigHome, xdg.DataHome)
+	xdg.ConfigHome, xdg.DataHome = dir, dir
+
+	now := time.Now()
+	r := &Registry{entries: make(map[string]RegistryEntry)}
+	add := func(entry RegistryEntry, mtime time.Time) string {
+		entry.Path = filepath.Join(dir, entry.Identifier+".AppImage")
+		entry.ModTime = mtime
+		ioutil.WriteFile(entry.Path, nil, 0755)
+		r.put(entry)
+		return entry.Path
+	}
+	add(RegistryEntry{Identifier: "inkscape-old", AppStreamID: "org.inkscape.Inkscape", DesktopID: "org.inkscape.Inkscape.desktop", Executable: "inkscape", Version: "0.92", MimeTypes: []string{"image/svg+xml"}}, now)
+	inkscape := add(RegistryEntry{Identifier: "inkscape", AppStreamID: "org.inkscape.Inkscape", DesktopID: "org.inkscape.Inkscape.desktop", Executable: "inkscape", Version: "1.0", MimeTypes: []string{"image/svg+xml", "image/png"}}, now.Add(-time.Hour))
+	gimp := add(RegistryEntry{Identifier: "gimp", DesktopID: "gimp.desktop", Executable: "gimp-2.10", MimeTypes: []string{"image/*"}}, now)
+	fork := add(RegistryEntry{Identifier: "fork", DesktopID: "inkscape.desktop", Executable: "inkscape-fork", MimeTypes: []string{"image/svg+xml"}}, now)
+
+	for id, expected := range map[string]string{
+		"org.inkscape.Inkscape":         inkscape,
+		"org.inkscape.Inkscape.desktop": inkscape,
+		"gimp":                          gimp, // Desktop file name
+		"gimp-2.10":                     gimp, // Executable
+		"inkscape":                      fork, // The desktop file name of the fork takes precedence over the executable name
+	} {
+		entries, err := r.FindByApplicationID(id)
+		if err != nil || len(entries) == 0 || entries[0].Path != expected {
+			t.Error("Expected", expected, "for", id, "got", entries, err)
+		}
+	}
+	if entries, err := r.FindByApplicationID("krita"); err != nil || entries != nil {
+		t.Error("Expected nothing for krita, got", entries, err)
+	}
+
+	// Two applications have the same executable
+	add(RegistryEntry{Identifier: "other", DesktopID: "other.desktop", Executable: "gimp-2.10"}, now)
+	if _, err := r.FindByApplicationID("gimp-2.10"); err == nil {
+		t.Error("Expected gimp-2.10 to be ambiguous")
+	} else if ambiguous, ok := err.(*AmbiguousError); ok == false || len(ambiguous.Candidates) != 2 {
+		t.Error("Expected two candidates, got", err)
+	}
+
+	// Naming the MIME type is better than matching it with a wildcard
+	if a := r.FindHandler("image/png"); a != inkscape {
+		t.Error("Expected", inkscape, "to open PNG files, got", a)
+	}
+	if a := r.FindHandler("image/jpeg"); a != gimp {
+		t.Error("Expected", gimp, "to open JPEG files, got", a)
+	}
+	// Unless the user has chosen a default application
+	ioutil.WriteFile(filepath.Join(dir, "mimeapps.list"), []byte("[Default Applications]\nimage/png=appimagekit_gimp.desktop;\n"), 0644)
+	if a := r.FindHandler("image/png"); a != gimp {
+		t.Error("Expected the default application", gimp, "to open PNG files, got", a)
+	}
+
+	if m := mimeTypeForArgument("image/svg+xml"); m != "image/svg+xml" {
+		t.Error("Expected image/svg+xml, got", m)
+	}
+	if m := mimeTypeForArgument("drawing.png"); m != "image/png" {
+		t.Error("Expected image/png, got", m)
+	}
+	if m := mimeTypeForURL("https://example.com/"); m != "x-scheme-handler/https" {
+		t.Error("Expected x-scheme-handler/https, got", m)
+	}
+	if e := executableName(`"/opt/My App/app" %F`); e != "app" {
+		t.Error("Expected app, got", e)
+	}
+}
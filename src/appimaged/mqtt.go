@@ -50,12 +50,16 @@ func UnSubscribeMQTT(client mqtt.Client, updateinformation string) {
 // TODO: Keep track of what we have already subscribed, and don't subscribe again
 func SubscribeMQTT(client mqtt.Client, updateinformation string) {
 
+	// Called from the integration workers in parallel
+	subscribedMQTTTopicsMu.Lock()
 	if helpers.SliceContains(subscribedMQTTTopics, updateinformation) == true {
 		// We have already subscribed to this; so nothing to do here
+		subscribedMQTTTopicsMu.Unlock()
 		return
 	}
 	// Need to do this immediately here, otherwise it comes too late
 	subscribedMQTTTopics = helpers.AppendIfMissing(subscribedMQTTTopics, updateinformation)
+	subscribedMQTTTopicsMu.Unlock()
 	time.Sleep(time.Second * 10) // We get retained messages immediately when we subscribe;
 	// at this point our AppImage may not be integrated yet...
 	// Also it's better user experience not to be bombarded with updates immediately at startup.
@@ -134,7 +138,8 @@ func SubscribeMQTT(client mqtt.Client, updateinformation string) {
 						helpers.PrintError("mqtt: GetCommitMessageForLatestCommit:", err)
 					} else {
 						// The following could not be tested yet
-						go sendUpdateDesktopNotification(ai, version, msg)
+						go offerUpdate(ai, version, msg)
+						emitDBusSignal("UpdateAvailable", ai.Path, version)
 						//sendDesktopNotification("Update available for "+ai.niceName, "It can be updated to version "+version+". \n"+msg, 120000)
 					}
 				}
@@ -0,0 +1,173 @@
+package main
+
+// Events for AppImages (from inotify, udisks, D-Bus, and the scan at startup)
+// go through an IntegrationQueue: events for the same path are coalesced,
+// a path is only processed once it has not changed for a while (so that
+// files which are still being downloaded or copied are not read half-written),
+// at most a given number of paths are processed in parallel, and once all
+// paths that were due have been processed, the results are committed at once
+// so that the menu does not get rebuilt all the time.
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// IntegrationQueue is a coalescing, debouncing queue of paths
+// which are processed by a bounded pool of workers.
+// Its methods are safe for concurrent use
+type IntegrationQueue struct {
+	workers  int
+	debounce time.Duration
+	process  func(path string)
+	commit   func(paths []string)
+
+	mu      sync.Mutex
+	pending map[string]*pendingPath
+	wake    chan struct{}
+}
+
+// pendingPath is a path waiting to be processed, and how the file looked when it was last checked
+type pendingPath struct {
+	due     time.Time
+	exists  bool
+	size    int64
+	modTime time.Time
+}
+
+// NewIntegrationQueue returns a queue that calls process for each path with up to workers
+// calls in parallel, once the path has not changed for debounce, and then calls commit
+// with all paths that were processed together. Call Run to start processing
+func NewIntegrationQueue(workers int, debounce time.Duration, process func(path string), commit func(paths []string)) *IntegrationQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	return &IntegrationQueue{
+		workers:  workers,
+		debounce: debounce,
+		process:  process,
+		commit:   commit,
+		pending:  make(map[string]*pendingPath),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// Enqueue adds path to the queue. If it is already waiting, it is not added again,
+// but its processing is postponed since it has changed
+func (q *IntegrationQueue) Enqueue(path string) {
+	p := statPendingPath(path)
+	p.due = time.Now().Add(q.debounce)
+	q.mu.Lock()
+	q.pending[path] = p
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Len returns the number of paths waiting to be processed
+func (q *IntegrationQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// Run processes the queue until stop is closed
+func (q *IntegrationQueue) Run(stop <-chan struct{}) {
+	timer := time.NewTimer(q.debounce)
+	defer timer.Stop()
+	for {
+		batch, next := q.takeDue(time.Now())
+		if len(batch) > 0 {
+			q.processBatch(batch)
+			continue
+		}
+		if timer.Stop() == false {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if next.IsZero() == false {
+			timer.Reset(time.Until(next))
+		} else {
+			timer.Reset(time.Hour)
+		}
+		select {
+		case <-stop:
+			return
+		case <-q.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// takeDue removes the paths that are due and have not changed since they were last checked
+// from the queue and returns them, and when the next path will be due
+func (q *IntegrationQueue) takeDue(now time.Time) ([]string, time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var batch []string
+	var next time.Time
+	for path, p := range q.pending {
+		if p.due.After(now) {
+			if next.IsZero() || p.due.Before(next) {
+				next = p.due
+			}
+			continue
+		}
+		current := statPendingPath(path)
+		if current.exists != p.exists || current.size != p.size || current.modTime.Equal(p.modTime) == false {
+			// Still being written, check again later
+			current.due = now.Add(q.debounce)
+			q.pending[path] = current
+			if next.IsZero() || current.due.Before(next) {
+				next = current.due
+			}
+			continue
+		}
+		delete(q.pending, path)
+		batch = append(batch, path)
+	}
+	return batch, next
+}
+
+// processBatch processes the paths with the workers and commits them once all are done.
+// Paths that are enqueued again in the meantime wait for the next batch
+func (q *IntegrationQueue) processBatch(batch []string) {
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	workers := q.workers
+	if workers > len(batch) {
+		workers = len(batch)
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range jobs {
+				q.process(path)
+			}
+		}()
+	}
+	for _, path := range batch {
+		jobs <- path
+	}
+	close(jobs)
+	wg.Wait()
+	if q.commit != nil {
+		q.commit(batch)
+	}
+}
+
+func statPendingPath(path string) *pendingPath {
+	p := &pendingPath{}
+	if info, err := os.Stat(path); err == nil {
+		p.exists = true
+		p.size = info.Size()
+		p.modTime = info.ModTime()
+	}
+	return p
+}
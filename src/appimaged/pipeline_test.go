@@ -0,0 +1,203 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// recorder records what an IntegrationQueue does
+type recorder struct {
+	mu        sync.Mutex
+	processed map[string]int
+	times     map[string]time.Time
+	batches   [][]string
+	running   int32
+	maxActive int32
+	delay     time.Duration
+}
+
+func newRecorder(delay time.Duration) *recorder {
+	return &recorder{processed: make(map[string]int), times: make(map[string]time.Time), delay: delay}
+}
+
+func (r *recorder) process(path string) {
+	active := atomic.AddInt32(&r.running, 1)
+	for {
+		max := atomic.LoadInt32(&r.maxActive)
+		if active <= max || atomic.CompareAndSwapInt32(&r.maxActive, max, active) {
+			break
+		}
+	}
+	time.Sleep(r.delay)
+	r.mu.Lock()
+	r.processed[path]++
+	r.times[path] = time.Now()
+	r.mu.Unlock()
+	atomic.AddInt32(&r.running, -1)
+}
+
+func (r *recorder) commit(paths []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if atomic.LoadInt32(&r.running) != 0 {
+		panic("commit while paths are still being processed")
+	}
+	r.batches = append(r.batches, append([]string(nil), paths...))
+}
+
+func (r *recorder) total() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	total := 0
+	for _, n := range r.processed {
+		total += n
+	}
+	return total
+}
+
+func (r *recorder) committed() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	committed := 0
+	for _, batch := range r.batches {
+		committed += len(batch)
+	}
+	return committed
+}
+
+// waitFor waits until cond is true or fails the test
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for cond() == false {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// startQueue runs the queue and returns a function that stops it
+func startQueue(q *IntegrationQueue) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		q.Run(stop)
+		close(done)
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+func TestIntegrationQueueCoalesces(t *testing.T) {
+	r := newRecorder(0)
+	q := NewIntegrationQueue(4, 50*time.Millisecond, r.process, r.commit)
+	defer startQueue(q)()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				q.Enqueue("/nonexistent/a.AppImage")
+				q.Enqueue("/nonexistent/b.AppImage")
+			}
+		}()
+	}
+	wg.Wait()
+	waitFor(t, "committing", func() bool { return r.committed() == 2 })
+	time.Sleep(100 * time.Millisecond)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.processed["/nonexistent/a.AppImage"] != 1 || r.processed["/nonexistent/b.AppImage"] != 1 {
+		t.Error("Expected each path to be processed once, got", r.processed)
+	}
+	if len(r.batches) != 1 || len(r.batches[0]) != 2 {
+		t.Error("Expected one batch with both paths, got", r.batches)
+	}
+}
+
+func TestIntegrationQueueWaitsForFilesBeingWritten(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appimaged-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "growing.AppImage")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	r := newRecorder(0)
+	q := NewIntegrationQueue(2, 30*time.Millisecond, r.process, r.commit)
+	defer startQueue(q)()
+
+	// Only one event, as for a file that is created and then written without further events
+	q.Enqueue(path)
+	var lastWrite time.Time
+	for i := 0; i < 15; i++ {
+		_, err = f.Write([]byte("data" + strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lastWrite = time.Now()
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitFor(t, "committing", func() bool { return r.committed() == 1 })
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.times[path].Before(lastWrite) {
+		t.Error("Processed", path, "while it was still being written")
+	}
+}
+
+func TestIntegrationQueueBoundsWorkers(t *testing.T) {
+	r := newRecorder(5 * time.Millisecond)
+	q := NewIntegrationQueue(3, 10*time.Millisecond, r.process, r.commit)
+	defer startQueue(q)()
+
+	for i := 0; i < 50; i++ {
+		q.Enqueue("/nonexistent/" + strconv.Itoa(i) + ".AppImage")
+	}
+	waitFor(t, "committing", func() bool { return r.committed() == 50 })
+
+	if max := atomic.LoadInt32(&r.maxActive); max > 3 {
+		t.Error("Expected at most 3 paths to be processed in parallel, got", max)
+	}
+	if total := r.total(); total != 50 {
+		t.Error("Expected 50 paths to be processed, got", total)
+	}
+}
+
+func TestIntegrationQueueRequeuesDuringProcessing(t *testing.T) {
+	r := newRecorder(0)
+	var q *IntegrationQueue
+	var once sync.Once
+	process := func(path string) {
+		r.process(path)
+		// An event for the same path arrives while it is being processed
+		once.Do(func() { q.Enqueue(path) })
+	}
+	q = NewIntegrationQueue(1, 10*time.Millisecond, process, r.commit)
+	defer startQueue(q)()
+
+	q.Enqueue("/nonexistent/a.AppImage")
+	waitFor(t, "committing twice", func() bool { return r.committed() == 2 })
+
+	if total := r.total(); total != 2 {
+		t.Error("Expected the path to be processed twice, got", total)
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+// The registry remembers what we know about each AppImage so that
+// unchanged files do not need to be opened again, and so that lookups
+// (e.g., by update information) do not need to parse all desktop files
+// and read all AppImages. It is stored in $XDG_STATE_HOME/appimaged/registry.json
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/adrg/xdg"
+	"github.com/probonopd/go-appimage/internal/helpers"
+	"go.lsp.dev/uri"
+)
+
+// RegistryEntry is what the registry knows about an AppImage
+type RegistryEntry struct {
+	Identifier        string    `json:"identifier"` // Derived from the path, used in the names of the desktop file and thumbnail
+	Path              string    `json:"path"`
+	Device            uint64    `json:"dev,omitempty"`
+	Inode             uint64    `json:"inode,omitempty"`
+	Size              int64     `json:"size"`
+	ModTime           time.Time `json:"mtime"`
+	Digest            string    `json:"digest"` // As used for signing, i.e., without the signature sections
+	Type              int       `json:"type"`
+	Name              string    `json:"name"`
+	AppStreamID       string    `json:"appstreamid,omitempty"` // Component ID in the AppStream metainfo file
+	DesktopID         string    `json:"desktopid,omitempty"`   // Name of the desktop file in the AppImage
+	Executable        string    `json:"executable,omitempty"`  // Name of the executable in Exec= of that desktop file
+	MimeTypes         []string  `json:"mimetypes,omitempty"`
+	Version           string    `json:"version"`          // X-AppImage-Version, or the version of the most recent AppStream release
+	FSTime            time.Time `json:"fstime,omitempty"` // When the squashfs of a type-2 AppImage was made
+	UpdateInformation string    `json:"updateinformation"`
+	Signature         string    `json:"signature"`            // "unsigned", "valid", or "invalid"
+	SigningKey        string    `json:"signingkey,omitempty"` // Fingerprint of the key that made a valid signature
+	DesktopFile       string    `json:"desktopfile,omitempty"`
+	Thumbnail         string    `json:"thumbnail,omitempty"`
+	Previous          string    `json:"previous,omitempty"` // The version this one was updated from, for rolling back
+	Pinned            bool      `json:"pinned,omitempty"`   // Not to be updated automatically, e.g., after rolling back
+	Schema            int       `json:"schema,omitempty"`
+}
+
+// registrySchema is increased whenever newRegistryEntry reads more from AppImages,
+// so that entries made by earlier versions are read again
+const registrySchema = 1
+
+// Registry holds the RegistryEntries keyed by the identity of the file contents,
+// so that AppImages which were moved do not need to be read again;
+// it is safe for concurrent use
+type Registry struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]RegistryEntry
+	changed bool
+}
+
+var registry *Registry
+
+// registryFilePath returns where the registry is stored
+func registryFilePath() string {
+	stateHome := os.Getenv("XDG_STATE_HOME")
+	if stateHome == "" {
+		stateHome = home + "/.local/state"
+	}
+	return stateHome + "/appimaged/registry.json"
+}
+
+// LoadRegistry loads the registry from path. If it does not exist yet, it is
+// populated from the desktop files written by earlier versions
+func LoadRegistry(path string) *Registry {
+	r := &Registry{path: path, entries: make(map[string]RegistryEntry)}
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		var entries []RegistryEntry
+		err = json.Unmarshal(data, &entries)
+		if err == nil {
+			for _, entry := range entries {
+				r.entries[entryKey(entry)] = entry
+			}
+			return r
+		}
+		helpers.PrintError("registry: "+path, err)
+	}
+	for _, path := range findAppImagesFromDesktopFiles() {
+		ai, err := NewAppImage(path)
+		if err != nil {
+			continue
+		}
+		r.Update(ai)
+	}
+	log.Println("registry: Imported", len(r.entries), "AppImages from desktop files")
+	return r
+}
+
+// Save writes the registry to disk if it has changed since it was loaded or saved
+func (r *Registry) Save() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.changed == false {
+		return nil
+	}
+	entries := make([]RegistryEntry, 0, len(r.entries))
+	for _, entry := range r.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(r.path), 0755)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file and rename it so that readers, e.g., "appimaged run",
+	// never see a partially written registry
+	err = ioutil.WriteFile(r.path+".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(r.path+".tmp", r.path)
+	if err == nil {
+		r.changed = false
+	}
+	return err
+}
+
+// Lookup returns the entry for the AppImage at path, and whether the file is unchanged
+// since the entry was made, in which case there is no need to read it again.
+// The file is found by its contents, so that it is also unchanged after it was moved
+// or hard linked; the entry is then for path but not integrated there yet
+func (r *Registry) Lookup(path string) (RegistryEntry, bool) {
+	path = filepath.Clean(path)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if info, err := os.Stat(path); err == nil {
+		if entry, ok := r.entries[contentKey(info)]; ok == true && entry.Schema == registrySchema {
+			if entry.Path != path {
+				entry.Path = path
+				entry.Identifier = identifierForPath(path)
+				entry.DesktopFile, entry.Thumbnail = "", ""
+			}
+			return entry, true
+		}
+	}
+	key, ok := r.keyForPath(path)
+	if ok == false {
+		return RegistryEntry{}, false
+	}
+	return r.entries[key], false
+}
+
+// Read returns the up-to-date entry for the AppImage at path,
+// and reads the file only if it changed since the entry was made
+func (r *Registry) Read(path string) (RegistryEntry, error) {
+	if entry, fresh := r.Lookup(path); fresh == true {
+		entry.DesktopFile, entry.Thumbnail = integrationArtifacts(appImageFromRegistryEntry(entry))
+		r.put(entry)
+		return entry, nil
+	}
+	ai, err := NewAppImage(path)
+	if err != nil {
+		return RegistryEntry{}, err
+	}
+	return r.Update(ai)
+}
+
+// Update reads the AppImage unless it is unchanged since the entry was made,
+// and returns the up-to-date entry
+func (r *Registry) Update(ai *AppImage) (RegistryEntry, error) {
+	entry, fresh := r.Lookup(ai.Path)
+	if fresh == true {
+		entry.DesktopFile, entry.Thumbnail = integrationArtifacts(ai)
+		r.put(entry)
+		return entry, nil
+	}
+	previous, pinned := entry.Previous, entry.Pinned
+	entry, err := newRegistryEntry(ai)
+	if err != nil {
+		return entry, err
+	}
+	// What we know about updates is not in the file, so keep it when the file changes
+	entry.Previous, entry.Pinned = previous, pinned
+	r.put(entry)
+	return entry, nil
+}
+
+// SetPrevious remembers that the AppImage at path was updated from previous
+// (which can be empty if there is nothing to roll back to), and that it is no longer pinned.
+// This can be done before the file is at path
+func (r *Registry) SetPrevious(path string, previous string) {
+	r.modify(path, func(entry *RegistryEntry) {
+		entry.Previous = previous
+		entry.Pinned = false
+	})
+}
+
+// SetPinned sets whether the AppImage at path is kept from being updated automatically
+func (r *Registry) SetPinned(path string, pinned bool) {
+	r.modify(path, func(entry *RegistryEntry) {
+		entry.Pinned = pinned
+	})
+}
+
+// modify changes the entry for path, which is created if it does not exist yet;
+// the rest of it is filled in once the AppImage is read
+func (r *Registry) modify(path string, change func(entry *RegistryEntry)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key, ok := r.keyForPath(path)
+	entry := r.entries[key]
+	if ok == false {
+		entry = RegistryEntry{Identifier: identifierForPath(path), Path: filepath.Clean(path)}
+		key = entryKey(entry)
+	}
+	change(&entry)
+	r.entries[key] = entry
+	r.changed = true
+}
+
+// Remove removes the entry for the AppImage at path
+func (r *Registry) Remove(path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if key, ok := r.keyForPath(path); ok == true {
+		delete(r.entries, key)
+		r.changed = true
+	}
+}
+
+// Entries returns all entries, sorted by path
+func (r *Registry) Entries() []RegistryEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entries := make([]RegistryEntry, 0, len(r.entries))
+	for _, entry := range r.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries
+}
+
+// FindByUpdateInformation returns the paths of the AppImages that exist and have
+// matching update information, the most recent one first
+func (r *Registry) FindByUpdateInformation(updateinformation string) []string {
+	var results []string
+	for _, entry := range r.FindEntriesByUpdateInformation(updateinformation) {
+		results = append(results, entry.Path)
+	}
+	return results
+}
+
+// FindEntriesByUpdateInformation returns the entries of the AppImages that exist and have
+// matching update information, the most recent one first
+func (r *Registry) FindEntriesByUpdateInformation(updateinformation string) []RegistryEntry {
+	var results []RegistryEntry
+	for _, entry := range r.Entries() {
+		unescapedui, _ := url.QueryUnescape(entry.UpdateInformation)
+		if entry.UpdateInformation != "" && unescapedui == updateinformation && helpers.Exists(entry.Path) {
+			results = append(results, entry)
+		}
+	}
+	rankAppImages(results)
+	return results
+}
+
+// Stale returns the paths of the entries whose AppImages no longer exist
+func (r *Registry) Stale() []string {
+	var results []string
+	for _, entry := range r.Entries() {
+		if _, err := os.Stat(entry.Path); os.IsNotExist(err) {
+			results = append(results, entry.Path)
+		}
+	}
+	return results
+}
+
+func (r *Registry) put(entry RegistryEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := entryKey(entry)
+	// The entry made before the file changed is replaced
+	if old, ok := r.keyForPath(entry.Path); ok == true && old != key {
+		delete(r.entries, old)
+		r.changed = true
+	}
+	if old, ok := r.entries[key]; ok == false || reflect.DeepEqual(old, entry) == false {
+		r.entries[key] = entry
+		r.changed = true
+	}
+}
+
+// keyForPath returns the key of the entry for path; the caller must hold r.mu
+func (r *Registry) keyForPath(path string) (string, bool) {
+	path = filepath.Clean(path)
+	for key, entry := range r.entries {
+		if entry.Path == path {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// contentKey returns the key of the entry for the file described by info,
+// which changes whenever the file is written or replaced
+func contentKey(info os.FileInfo) string {
+	var dev, ino uint64
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok == true {
+		dev, ino = uint64(stat.Dev), uint64(stat.Ino)
+	}
+	return fmt.Sprintf("%d:%d:%d:%d", dev, ino, info.Size(), info.ModTime().UnixNano())
+}
+
+// entryKey returns the key of the entry; entries made before the file
+// was read, e.g., by SetPrevious, are keyed by their path
+func entryKey(entry RegistryEntry) string {
+	if entry.Inode == 0 {
+		return "path:" + entry.Path
+	}
+	return fmt.Sprintf("%d:%d:%d:%d", entry.Device, entry.Inode, entry.Size, entry.ModTime.UnixNano())
+}
+
+// setFileInfo sets what identifies the contents of the file described by info in the entry
+func setFileInfo(entry *RegistryEntry, info os.FileInfo) {
+	entry.Size = info.Size()
+	entry.ModTime = info.ModTime()
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok == true {
+		entry.Device, entry.Inode = uint64(stat.Dev), uint64(stat.Ino)
+	}
+}
+
+// identifierForPath returns the identifier of the AppImage at path,
+// which is also used in the names of its desktop file and thumbnail
+func identifierForPath(path string) string {
+	ai := AppImage{uri: strings.TrimSpace(string(uri.File(filepath.Clean(path))))}
+	return ai.calculateMD5filenamepart()
+}
+
+// integrationArtifacts returns the desktop file and thumbnail of the AppImage if they exist
+func integrationArtifacts(ai *AppImage) (string, string) {
+	var desktopfile, thumbnail string
+	// Desktop files are written to the cache first and moved into the menu later
+	if helpers.Exists(ai.desktopfilepath) || helpers.Exists(xdg.CacheHome+"/applications/"+ai.desktopfilename) {
+		desktopfile = ai.desktopfilepath
+	}
+	if helpers.Exists(ai.thumbnailfilepath) {
+		thumbnail = ai.thumbnailfilepath
+	}
+	return desktopfile, thumbnail
+}
+
+// newRegistryEntry reads everything the registry stores from the AppImage
+func newRegistryEntry(ai *AppImage) (RegistryEntry, error) {
+	metadata := readAppStreamMetadata(ai)
+	entry := RegistryEntry{
+		Identifier:        ai.md5,
+		Path:              ai.Path,
+		Type:              ai.Type(),
+		Name:              ai.Name,
+		AppStreamID:       metadata.ID,
+		Version:           appImageVersion(ai, metadata),
+		UpdateInformation: ai.updateinformation,
+		Schema:            registrySchema,
+	}
+	entry.DesktopID, entry.Executable, entry.MimeTypes = readEmbeddedDesktopFile(ai)
+	info, err := os.Stat(ai.Path)
+	if err != nil {
+		return entry, err
+	}
+	setFileInfo(&entry, info)
+	entry.DesktopFile, entry.Thumbnail = integrationArtifacts(ai)
+	if entry.Type != 2 {
+		// Type-1 AppImages have neither the digest sections nor signatures
+		entry.Signature = "unsigned"
+		return entry, nil
+	}
+	entry.FSTime = ai.ModTime()
+	entry.Digest = helpers.CalculateSHA256Digest(ai.Path)
+	entry.Signature, entry.SigningKey = readSignature(ai.Path)
+	return entry, nil
+}
+
+// appImageVersion returns the version of the AppImage as given by X-AppImage-Version in its
+// desktop file or otherwise by its AppStream metainfo file, or "" if neither tells
+func appImageVersion(ai *AppImage, metadata AppStreamMetadata) string {
+	if ai.Desktop != nil {
+		if v := ai.Desktop.Section("Desktop Entry").Key("X-AppImage-Version").Value(); v != "" {
+			return v
+		}
+	}
+	return metadata.Version
+}
+
+// readSignature returns whether the type-2 AppImage at path is "unsigned",
+// or has a "valid" or "invalid" signature, and the fingerprint of the key that made a valid signature
+func readSignature(path string) (string, string) {
+	sigkey, _ := helpers.GetSectionData(path, ".sig_key")
+	if len(bytes.Trim(sigkey, "\x00")) == 0 {
+		return "unsigned", ""
+	}
+	signer, err := helpers.CheckSignature(path)
+	if err != nil || signer == nil {
+		log.Println("registry: Could not verify the signature of", path)
+		return "invalid", ""
+	}
+	return "valid", hex.EncodeToString(signer.PrimaryKey.Fingerprint[:])
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/probonopd/go-appimage/internal/helpers"
+)
+
+// registeredFile writes a file at path and returns an up-to-date entry for it
+func registeredFile(t *testing.T, path string, name string) RegistryEntry {
+	if err := ioutil.WriteFile(path, []byte(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := RegistryEntry{Identifier: identifierForPath(path), Path: path, Name: name, Schema: registrySchema}
+	setFileInfo(&entry, info)
+	return entry
+}
+
+func TestRegistrySaveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appimaged-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state", "registry.json")
+	r := &Registry{path: path, entries: make(map[string]RegistryEntry)}
+	r.put(registeredFile(t, filepath.Join(dir, "b.AppImage"), "B"))
+	r.put(registeredFile(t, filepath.Join(dir, "a.AppImage"), "A"))
+	r.SetPinned(filepath.Join(dir, "a.AppImage"), true)
+	if err := r.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if r.changed == true {
+		t.Error("Expected the registry to be unchanged after saving")
+	}
+
+	loaded := LoadRegistry(path)
+	entries := loaded.Entries()
+	if len(entries) != 2 || entries[0].Name != "A" || entries[0].Pinned == false || entries[1].Name != "B" {
+		t.Fatal("Expected the saved entries sorted by path, got", entries)
+	}
+	if entry, fresh := loaded.Lookup(filepath.Join(dir, "a.AppImage")); fresh == false || entry.Name != "A" {
+		t.Error("Expected the loaded entry to be up to date, got", entry)
+	}
+
+	// Nothing is written unless something changed
+	os.Remove(path)
+	if err := loaded.Save(); err != nil || helpers.Exists(path) == true {
+		t.Error("Expected an unchanged registry not to be written")
+	}
+}
+
+func TestRegistryLookup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appimaged-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := &Registry{entries: make(map[string]RegistryEntry)}
+	path := filepath.Join(dir, "a.AppImage")
+	r.put(registeredFile(t, path, "A"))
+	r.SetPrevious(path, filepath.Join(dir, "old.AppImage"))
+	if entry, fresh := r.Lookup(path); fresh == false || entry.Name != "A" {
+		t.Fatal("Expected the entry to be up to date, got", entry)
+	}
+
+	// A moved file is not read again, but is not integrated at its new path yet
+	moved := filepath.Join(dir, "moved.AppImage")
+	os.Rename(path, moved)
+	entry, fresh := r.Lookup(moved)
+	if fresh == false || entry.Path != moved || entry.Identifier != identifierForPath(moved) || entry.Name != "A" || entry.Previous == "" {
+		t.Fatal("Expected the moved file to be found by its contents, got", entry)
+	}
+	r.put(entry)
+	if len(r.Entries()) != 1 {
+		t.Error("Expected the entry to be replaced by the one for the new path, got", r.Entries())
+	}
+
+	// A changed file needs to be read again, but what is known about its updates is kept
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(moved, later, later)
+	entry, fresh = r.Lookup(moved)
+	if fresh == true || entry.Path != moved || entry.Previous == "" {
+		t.Error("Expected the entry of the changed file to be stale, got", entry, fresh)
+	}
+	if entry, fresh := r.Lookup(filepath.Join(dir, "other.AppImage")); fresh == true || entry.Path != "" {
+		t.Error("Expected no entry for an unknown path, got", entry)
+	}
+}
+
+func TestRegistryStale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appimaged-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := &Registry{entries: make(map[string]RegistryEntry)}
+	kept := filepath.Join(dir, "kept.AppImage")
+	removed := filepath.Join(dir, "removed.AppImage")
+	r.put(registeredFile(t, kept, "Kept"))
+	r.put(registeredFile(t, removed, "Removed"))
+	os.Remove(removed)
+	if stale := r.Stale(); len(stale) != 1 || stale[0] != removed {
+		t.Fatal("Expected only the removed AppImage to be stale, got", stale)
+	}
+	if entry, _ := r.Lookup(removed); entry.Name != "Removed" {
+		t.Error("Expected the entry of the removed AppImage to remain until it is unintegrated, got", entry)
+	}
+	r.Remove(removed)
+	if stale := r.Stale(); len(stale) != 0 || len(r.Entries()) != 1 {
+		t.Error("Expected the stale entry to be removed, got", r.Entries())
+	}
+}
@@ -7,54 +7,379 @@
 
 package main
 
+// Updates are applied by the daemon itself: the zsync file named by the update information
+// of an AppImage describes the new version, of which only the parts that are not in the
+// AppImage we already have are downloaded (see zsync.go). The new version has to be signed
+// with the same key as the old one if that one was signed. Depending on the update policy
+// (see updatepolicy.go), the new version replaces the old one atomically, or is put next to it.
+// Either way the previous version is kept so that the update can be rolled back.
+
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 
 	"github.com/probonopd/go-appimage/internal/helpers"
 )
 
+// errUpToDate is returned when there is no newer version than the one we have
+var errUpToDate = errors.New("already up to date")
+
+// updatesInProgress are the paths that are being updated or rolled back
+var updatesInProgress = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: make(map[string]bool)}
+
+// update is the "update" command: the running daemon is asked to check for an update
+// and act on it according to the update policy, or if it is not running, we do it ourselves
 func update() {
-	if len(os.Args) < 2 {
+	if len(os.Args) < 3 {
+		fmt.Println("Argument missing")
+		os.Exit(1)
+	}
+	path, _ := filepath.Abs(os.Args[2])
+	if callDaemon("CheckForUpdate", path) == nil {
+		return
+	}
+	registry = LoadRegistry(registryFilePath())
+	checkForUpdate(path)
+	helpers.LogError("update", registry.Save())
+}
+
+// rollback is the "rollback" command: the running daemon is asked to roll back
+// to the previous version, or if it is not running, we do it ourselves
+func rollback() {
+	if len(os.Args) < 3 {
 		fmt.Println("Argument missing")
 		os.Exit(1)
 	}
-	runUpdate(os.Args[2])
+	path, _ := filepath.Abs(os.Args[2])
+	if callDaemon("Rollback", path) == nil {
+		return
+	}
+	registry = LoadRegistry(registryFilePath())
+	err := runRollback(path)
+	helpers.LogError("rollback", registry.Save())
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// checkForUpdate checks for an update of the AppImage at path right away
+// and acts on it according to its update policy, like the periodic checks do
+func checkForUpdate(path string) {
+	name := filepath.Base(path)
+	entry, err := registry.Read(path)
+	if err != nil {
+		helpers.PrintError("update: "+path, err)
+		return
+	}
+	updateinformation, _ := url.QueryUnescape(entry.UpdateInformation)
+	if updateinformation == "" {
+		log.Println("update:", path, "has no update information")
+		sendDesktopNotification("No update available", name+" has no update information", 5000)
+		return
+	}
+	control, err := NewUpdateChecker(0, 0).Check(path, updateinformation)
+	if err != nil {
+		helpers.PrintError("update: "+path, err)
+		sendDesktopNotification("Update failed", "Could not check for updates of "+name+":\n"+err.Error(), 30000)
+		return
+	}
+	if control == nil {
+		log.Println("update:", path, "is", errUpToDate)
+		sendDesktopNotification("No update available", name+" is "+errUpToDate.Error(), 5000)
+		return
+	}
+	if offerUpdate(appImageFromRegistryEntry(entry), control.Filename, "") == updatePolicyPinned {
+		// Asked for by the user, who would otherwise not know why nothing happens
+		sendDesktopNotification("Update not applied", name+" is pinned, "+control.Filename+" is available", 10000)
+	}
 }
 
+// offerUpdate acts on an update to version being available for the AppImage
+// according to its update policy, and returns the mode of the policy
+func offerUpdate(ai *AppImage, version string, changelog string) string {
+	entry, _ := registry.Lookup(ai.Path)
+	policy, err := loadUpdatePolicy(updatePolicyFilePath(), entry)
+	helpers.LogError("update: "+updatePolicyFilePath(), err)
+	if entry.Pinned == true {
+		policy.Mode = updatePolicyPinned
+	}
+	switch policy.Mode {
+	case updatePolicyPinned:
+		log.Println("update: Not updating", ai.Path, "to version", version, "because it is pinned")
+	case updatePolicyAuto:
+		log.Println("update: Updating", ai.Path, "to version", version)
+		runUpdate(ai.Path)
+	default:
+		sendUpdateDesktopNotification(ai, version, changelog)
+	}
+	return policy.Mode
+}
+
+// runUpdate updates the AppImage at path and tells the user how it went
 func runUpdate(path string) {
-	// I think this way of doing things is really clever because
-	// this way we can even put the update action into menus if
-	// no updater is on the system yet at that time, and give the user
-	// instructions what to do once they want to use the upate action
-	// in the menu. Also, this way the updater does not have to be at
-	// a static location on the $PATH but can be put into any location
-	// from which it gets integrated.
-
-	// For now we don't implement updating functionality ourselves
-	// but merely launch an updater we found among the integrated
-	// AppImages. In the future we may do the updating ourselves.
-
-	aiur := "gh-releases-zsync|antony-jr|AppImageUpdater|continuous|AppImageUpdater*-x86_64.AppImage.zsync"
-
-	// aiu := "gh-releases-zsync|AppImage|AppImageUpdate|continuous|AppImageUpdate-*x86_64.AppImage.zsync"
-	// Using AppImageUpdate is blocked by https://github.com/AppImage/AppImageUpdate/issues/1
-	// https://github.com/AppImage/AppImageUpdate/issues/139
-	// whereas AppImageUpdater gets this right as per
-	// https://github.com/antony-jr/AppImageUpdater/issues/14
-
-	a := FindMostRecentAppImageWithMatchingUpdateInformation(aiur)
-	if a == "" {
-		sendDesktopNotification("AppImageUpdater missing", "Please download the AppImageUpdater\nAppImage and try again", 30000)
-		// Tried making a hyperlink but when I click it in Xfce, nothing happens.
+	name := filepath.Base(path)
+	newPath, err := updateAppImage(path)
+	if err == errUpToDate {
+		log.Println("update:", path, "is", err)
+		sendDesktopNotification("No update available", name+" is "+err.Error(), 5000)
+		return
+	}
+	if err != nil {
+		helpers.PrintError("update: "+path, err)
+		sendDesktopNotification("Update failed", name+" could not be updated:\n"+err.Error(), 30000)
+		return
+	}
+	log.Println("update: Updated", path, "to", newPath)
+	sendDesktopNotification("Update complete", name+" was updated to\n"+filepath.Base(newPath), 10000)
+}
+
+// runRollback rolls back the update of the AppImage at path and tells the user how it went
+func runRollback(path string) error {
+	previous, err := rollbackAppImage(path)
+	if err != nil {
+		helpers.PrintError("rollback: "+path, err)
+		sendDesktopNotification("Rollback failed", filepath.Base(path)+" could not be rolled back:\n"+err.Error(), 30000)
+		return err
+	}
+	log.Println("rollback: Rolled back", path, "to", previous)
+	sendDesktopNotification("Rolled back", filepath.Base(path)+" was rolled back to the previous version", 10000)
+	return nil
+}
+
+// beginUpdate marks path as being updated, returns false if it already is
+func beginUpdate(path string) bool {
+	updatesInProgress.Lock()
+	defer updatesInProgress.Unlock()
+	if updatesInProgress.paths[path] == true {
+		return false
+	}
+	updatesInProgress.paths[path] = true
+	return true
+}
+
+func endUpdate(path string) {
+	updatesInProgress.Lock()
+	delete(updatesInProgress.paths, path)
+	updatesInProgress.Unlock()
+}
+
+// updateAppImage updates the AppImage at path according to its update policy
+// and returns the path of the new version
+func updateAppImage(path string) (string, error) {
+	if beginUpdate(path) == false {
+		return "", errors.New("already being updated")
+	}
+	defer endUpdate(path)
+
+	entry, err := registry.Read(path)
+	if err != nil {
+		return "", err
+	}
+	updateinformation, _ := url.QueryUnescape(entry.UpdateInformation)
+	if updateinformation == "" {
+		return "", errors.New("the AppImage has no update information")
+	}
+	ui, err := helpers.NewUpdateInformationFromString(updateinformation)
+	if err != nil {
+		return "", err
+	}
+	zsyncURL, err := ui.ZsyncURL()
+	if err != nil {
+		return "", err
+	}
+	control, err := fetchZsyncControl(zsyncURL)
+	if err != nil {
+		return "", err
+	}
+	if sum, err := fileSHA1(path); err == nil && sum == control.SHA1 {
+		return path, errUpToDate
+	}
+	policy, err := loadUpdatePolicy(updatePolicyFilePath(), entry)
+	helpers.LogError("update: "+updatePolicyFilePath(), err)
+
+	// Unless the old version is to be replaced, the new version goes next to it under its own name
+	target := path
+	if policy.Keep != 1 && control.Filename != "" && filepath.Base(control.Filename) != filepath.Base(path) {
+		target = filepath.Join(filepath.Dir(path), filepath.Base(control.Filename))
+		if helpers.Exists(target) {
+			if sum, err := fileSHA1(target); err == nil && sum == control.SHA1 {
+				return target, errUpToDate
+			}
+			return "", errors.New(target + " already exists")
+		}
+	}
+	if policy.Keep != 1 && target == path {
+		log.Println("update: The new version of", path, "has the same name, replacing it; the old version is kept for rolling back at", previousVersionPath(path))
+	}
+
+	// The new version is written next to where it goes so that it can be renamed there atomically
+	tmp, err := ioutil.TempFile(filepath.Dir(target), "."+filepath.Base(target)+".part-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	reused, err := control.Sync(path, tmp)
+	if err != nil {
+		log.Println("update: Could not use the blocks of", path+",", "downloading all of", control.URL+":", err)
+		reused = 0
+		err = control.download(tmp)
+		if err != nil {
+			return "", err
+		}
+	}
+	log.Println("update: Downloaded", control.Length-reused, "of", control.Length, "bytes of", control.URL)
+	err = tmp.Close()
+	if err != nil {
+		return "", err
+	}
+
+	err = verifySigningKey(entry, tmp.Name())
+	if err != nil {
+		return "", err
+	}
+	// Unlike zsync, do not set the mtime from the zsync file: the desktop file and thumbnail
+	// are only written again for AppImages that are newer than them
+	err = os.Chmod(tmp.Name(), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	if target == path {
+		// Keep the old version where rolling back can find it
+		backup := previousVersionPath(path)
+		err = os.MkdirAll(filepath.Dir(backup), 0755)
+		if err != nil {
+			return "", err
+		}
+		os.Remove(backup)
+		if os.Link(path, backup) != nil {
+			err = helpers.CopyFile(path, backup)
+			if err != nil {
+				return "", err
+			}
+		}
+		registry.SetPrevious(path, backup)
 	} else {
-		os.Unsetenv("INVOCATION_ID") // This is a variable that systemd sets; we use it to determine whether we were launched through systemd
-		cmd := []string{a}
-		cmd = append(cmd, "-n")
-		cmd = append(cmd, "-d")
-		cmd = append(cmd, path)
-		err := helpers.RunCmdTransparently(cmd)
-		helpers.LogError("update", err)
+		registry.SetPrevious(target, path)
+	}
+	err = os.Rename(tmp.Name(), target)
+	if err != nil {
+		return "", err
+	}
+	if policy.Keep > 1 {
+		removeOldVersions(entry.UpdateInformation, target, policy.Keep)
+	}
+	return target, nil
+}
+
+// verifySigningKey returns an error unless the new version at path is signed
+// with the same key as the old version of the entry, if that one was signed
+func verifySigningKey(entry RegistryEntry, path string) error {
+	ai, err := NewAppImage(path)
+	if err != nil {
+		return err
+	}
+	if ai.Type() != 2 {
+		if entry.Signature == "valid" {
+			return errors.New("the new version is not signed")
+		}
+		return nil
+	}
+	signature, key := readSignature(path)
+	switch {
+	case signature == "invalid":
+		return errors.New("the signature of the new version is invalid")
+	case entry.Signature == "valid" && signature != "valid":
+		return errors.New("the new version is not signed")
+	case entry.Signature == "valid" && key != entry.SigningKey:
+		return errors.New("the new version is signed with key " + key + " rather than " + entry.SigningKey)
+	}
+	return nil
+}
+
+// previousVersionPath returns where the previous version of the AppImage at path is kept
+// when it is replaced by an update
+func previousVersionPath(path string) string {
+	return filepath.Dir(registryFilePath()) + "/previous/" + identifierForPath(path) + ".AppImage"
+}
+
+// removeOldVersions removes all but the keep most recent AppImages with the update information
+// in the directory of latest, which is not yet registered
+func removeOldVersions(updateinformation string, latest string, keep int) {
+	unescapedui, _ := url.QueryUnescape(updateinformation)
+	kept := 1 // latest
+	for _, path := range registry.FindByUpdateInformation(unescapedui) {
+		if filepath.Dir(path) != filepath.Dir(latest) || path == latest {
+			continue
+		}
+		if kept < keep {
+			kept++
+			continue
+		}
+		log.Println("update: Removing old version", path)
+		helpers.LogError("update", os.Remove(path))
 	}
+}
 
+// rollbackAppImage replaces the AppImage at path by the version it was updated from,
+// pins that so that it is not updated again automatically,
+// and returns the path of the previous version
+func rollbackAppImage(path string) (string, error) {
+	if beginUpdate(path) == false {
+		return "", errors.New("already being updated")
+	}
+	defer endUpdate(path)
+
+	entry, _ := registry.Lookup(path)
+	if entry.Previous == "" || helpers.Exists(entry.Previous) == false {
+		return "", errors.New("there is no previous version")
+	}
+
+	if strings.HasPrefix(entry.Previous, filepath.Dir(previousVersionPath(path))+"/") == false {
+		// The previous version is an AppImage next to this one, so this one can go
+		err := os.Remove(path)
+		if err != nil {
+			return "", err
+		}
+		registry.SetPinned(entry.Previous, true)
+		return entry.Previous, nil
+	}
+
+	// The previous version was replaced, so put it back in place atomically
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".part-")
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if os.Rename(entry.Previous, tmp.Name()) != nil {
+		// Not on the same filesystem
+		err = helpers.CopyFile(entry.Previous, tmp.Name())
+		if err != nil {
+			return "", err
+		}
+		err = os.Chmod(tmp.Name(), 0755)
+		if err != nil {
+			return "", err
+		}
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return "", err
+	}
+	os.Remove(entry.Previous)
+	registry.SetPrevious(path, "")
+	registry.SetPinned(path, true)
+	return path, nil
 }
@@ -0,0 +1,386 @@
+package main
+
+// Besides being told about updates over MQTT (which only works for AppImages built
+// with appimagetool on Travis CI), we check for updates ourselves every now and then.
+// For each update information, the beginning of the zsync file of the most recent version
+// is fetched (for gh-releases-zsync, the release is looked up using the GitHub API first)
+// and its SHA-1 and MTime are compared with the most recent AppImage we have.
+// To be nice to servers, requests are conditional so that unchanged files are not sent
+// again, requests to the same host are spaced out, hosts that tell us to slow down
+// are left alone until they allow it again, and checks that fail are done less often.
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/probonopd/go-appimage/internal/helpers"
+)
+
+// maxUpdateCheckBackoff is how long checks that keep failing are postponed at most
+const maxUpdateCheckBackoff = 7 * 24 * time.Hour
+
+// maxCachedResponse is the size up to which responses are kept for conditional requests
+const maxCachedResponse = 1 << 20
+
+// UpdateChecker checks for updates using the update information of the AppImages.
+// Its methods are safe for concurrent use
+type UpdateChecker struct {
+	client   *http.Client
+	interval time.Duration
+
+	mu      sync.Mutex
+	backoff map[string]updateCheckBackoff // By update information
+	offered map[string]string             // SHA-1 of the update that was offered, by path
+	sums    map[string]localSum           // SHA-1 of the AppImages, by path
+}
+
+// updateCheckBackoff is how often checks for an update information failed in a row
+// and when to check again
+type updateCheckBackoff struct {
+	failures int
+	next     time.Time
+}
+
+// localSum is the SHA-1 of a file, which is valid as long as its size and mtime do not change
+type localSum struct {
+	size    int64
+	modTime time.Time
+	sha1    string
+}
+
+// NewUpdateChecker returns a checker that checks every interval, and sends
+// requests to the same host at most every hostInterval
+func NewUpdateChecker(interval time.Duration, hostInterval time.Duration) *UpdateChecker {
+	return &UpdateChecker{
+		client: &http.Client{Transport: &pollTransport{
+			next:         updateHTTPClient.Transport,
+			hostInterval: hostInterval,
+			cache:        make(map[string]*cachedResponse),
+			hosts:        make(map[string]*hostState),
+		}},
+		interval: interval,
+		backoff:  make(map[string]updateCheckBackoff),
+		offered:  make(map[string]string),
+		sums:     make(map[string]localSum),
+	}
+}
+
+// Client returns the HTTP client the checker uses, e.g., for the GitHub API
+func (c *UpdateChecker) Client() *http.Client {
+	return c.client
+}
+
+// Check returns the header of the zsync file for the newer version of the AppImage at path
+// with the update information, or nil if it is up to date
+func (c *UpdateChecker) Check(path string, updateinformation string) (*zsyncControl, error) {
+	ui, err := helpers.NewUpdateInformationFromString(updateinformation)
+	if err != nil {
+		return nil, err
+	}
+	zsyncURL, err := ui.ZsyncURL()
+	if err != nil {
+		return nil, err
+	}
+	control, err := fetchZsyncHeader(c.client, zsyncURL)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == control.Length && info.ModTime().Unix() == control.MTime.Unix() {
+		// Downloaded with zsync, which sets the mtime from the zsync file
+		return nil, nil
+	}
+	sum, err := c.localSHA1(path, info)
+	if err != nil {
+		return nil, err
+	}
+	if sum == control.SHA1 {
+		return nil, nil
+	}
+	return control, nil
+}
+
+// localSHA1 returns the SHA-1 of the file at path, which is only calculated again if it has changed
+func (c *UpdateChecker) localSHA1(path string, info os.FileInfo) (string, error) {
+	c.mu.Lock()
+	sum, ok := c.sums[path]
+	c.mu.Unlock()
+	if ok == true && sum.size == info.Size() && sum.modTime.Equal(info.ModTime()) {
+		return sum.sha1, nil
+	}
+	sha1, err := fileSHA1(path)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.sums[path] = localSum{size: info.Size(), modTime: info.ModTime(), sha1: sha1}
+	c.mu.Unlock()
+	return sha1, nil
+}
+
+// due returns whether checking for the update information is not postponed
+// because earlier checks failed
+func (c *UpdateChecker) due(updateinformation string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return now.Before(c.backoff[updateinformation].next) == false
+}
+
+// failed postpones the next check for the update information, the longer the more often it failed
+func (c *UpdateChecker) failed(updateinformation string, now time.Time) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := c.backoff[updateinformation]
+	b.failures++
+	delay := c.interval
+	for i := 0; i < b.failures && delay < maxUpdateCheckBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxUpdateCheckBackoff {
+		delay = maxUpdateCheckBackoff
+	}
+	b.next = now.Add(delay)
+	c.backoff[updateinformation] = b
+	return delay
+}
+
+func (c *UpdateChecker) succeeded(updateinformation string) {
+	c.mu.Lock()
+	delete(c.backoff, updateinformation)
+	c.mu.Unlock()
+}
+
+// CheckAll checks for updates of the most recent AppImage for each update information
+// and offers the updates that were not offered before
+func (c *UpdateChecker) CheckAll() {
+	seen := make(map[string]bool)
+	for _, entry := range registry.Entries() {
+		updateinformation, _ := url.QueryUnescape(entry.UpdateInformation)
+		if updateinformation == "" || seen[updateinformation] == true {
+			continue
+		}
+		seen[updateinformation] = true
+		if c.due(updateinformation, time.Now()) == false {
+			continue
+		}
+		path := FindMostRecentAppImageWithMatchingUpdateInformation(updateinformation)
+		if path == "" {
+			continue
+		}
+		control, err := c.Check(path, updateinformation)
+		if err != nil {
+			delay := c.failed(updateinformation, time.Now())
+			log.Println("updatecheck: Could not check for updates of", path+":", err, "- trying again in", delay)
+			continue
+		}
+		c.succeeded(updateinformation)
+		if control == nil {
+			if *verbosePtr == true {
+				log.Println("updatecheck:", path, "is up to date")
+			}
+			continue
+		}
+		c.mu.Lock()
+		alreadyOffered := c.offered[path] == control.SHA1
+		c.offered[path] = control.SHA1
+		c.mu.Unlock()
+		if alreadyOffered == true {
+			continue
+		}
+		log.Println("updatecheck:", control.Filename, "is available for", path)
+		latest, err := registry.Read(path)
+		if err != nil {
+			continue
+		}
+		emitDBusSignal("UpdateAvailable", path, control.Filename)
+		go offerUpdate(appImageFromRegistryEntry(latest), control.Filename, "")
+	}
+}
+
+// Run checks for updates every interval until stop is closed,
+// starting after delay so that the AppImages are registered by then
+func (c *UpdateChecker) Run(delay time.Duration, stop <-chan struct{}) {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		}
+		if CheckIfConnectedToNetwork() == true {
+			c.CheckAll()
+		}
+		timer.Reset(c.interval)
+	}
+}
+
+// pollTransport is the http.RoundTripper of an UpdateChecker.
+// It makes requests conditional on the ETag or Last-Modified of what was received before,
+// and if the server answers with 304 Not Modified, returns what was received before.
+// Requests to the same host are spaced out by hostInterval, and requests to hosts
+// that asked us to wait (with Retry-After, or GitHub's rate limit headers) fail until then
+type pollTransport struct {
+	next         http.RoundTripper
+	hostInterval time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*cachedResponse // By URL and range
+	hosts map[string]*hostState
+}
+
+// cachedResponse is what is kept of a response for conditional requests
+type cachedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// hostState is when the next request can be sent to a host
+type hostState struct {
+	next         time.Time
+	blockedUntil time.Time
+}
+
+// errRateLimited is returned for requests to hosts that asked us to wait
+var errRateLimited = errors.New("rate limited")
+
+// RoundTrip implements http.RoundTripper
+func (t *pollTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	err := t.wait(req)
+	if err != nil {
+		return nil, err
+	}
+
+	key := req.URL.String() + " " + req.Header.Get("Range")
+	t.mu.Lock()
+	cached := t.cache[key]
+	t.mu.Unlock()
+	if cached != nil && req.Method == "GET" {
+		req = req.Clone(req.Context())
+		if etag := cached.header.Get("ETag"); etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := cached.header.Get("Last-Modified"); lastModified != "" {
+			req.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	t.noteRateLimit(req.URL.Host, resp)
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		resp.Body.Close()
+		return &http.Response{
+			Status:        strconv.Itoa(cached.status) + " " + http.StatusText(cached.status),
+			StatusCode:    cached.status,
+			Proto:         resp.Proto,
+			ProtoMajor:    resp.ProtoMajor,
+			ProtoMinor:    resp.ProtoMinor,
+			Header:        cached.header.Clone(),
+			Body:          ioutil.NopCloser(bytes.NewReader(cached.body)),
+			ContentLength: int64(len(cached.body)),
+			Request:       req,
+		}, nil
+	}
+
+	if req.Method != "GET" || (resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent) ||
+		(resp.Header.Get("ETag") == "" && resp.Header.Get("Last-Modified") == "") {
+		return resp, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCachedResponse+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if len(body) > maxCachedResponse {
+		// Too large to keep, pass it on as it is
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	t.mu.Lock()
+	t.cache[key] = &cachedResponse{status: resp.StatusCode, header: resp.Header.Clone(), body: body}
+	t.mu.Unlock()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// wait waits until the next request can be sent to the host of req,
+// returns errRateLimited if the host asked us to wait longer
+func (t *pollTransport) wait(req *http.Request) error {
+	now := time.Now()
+	t.mu.Lock()
+	host := t.hosts[req.URL.Host]
+	if host == nil {
+		host = &hostState{}
+		t.hosts[req.URL.Host] = host
+	}
+	if now.Before(host.blockedUntil) {
+		until := host.blockedUntil
+		t.mu.Unlock()
+		return errors.New(req.URL.Host + " is " + errRateLimited.Error() + " until " + until.Format(time.RFC1123))
+	}
+	start := host.next
+	if start.Before(now) {
+		start = now
+	}
+	host.next = start.Add(t.hostInterval)
+	t.mu.Unlock()
+
+	if start.After(now) {
+		timer := time.NewTimer(start.Sub(now))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			return req.Context().Err()
+		}
+	}
+	return nil
+}
+
+// noteRateLimit remembers when the host allows requests again if resp asks us to wait
+func (t *pollTransport) noteRateLimit(host string, resp *http.Response) {
+	var until time.Time
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+		retryAfter := resp.Header.Get("Retry-After")
+		if seconds, err := strconv.Atoi(retryAfter); err == nil {
+			until = time.Now().Add(time.Duration(seconds) * time.Second)
+		} else if date, err := http.ParseTime(retryAfter); err == nil {
+			until = date
+		}
+	case resp.StatusCode == http.StatusForbidden && resp.Header.Get("X-RateLimit-Remaining") == "0":
+		if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			until = time.Unix(reset, 0)
+		}
+	}
+	if until.IsZero() {
+		return
+	}
+	log.Println("updatecheck:", host, "asks us to wait until", until.Format(time.RFC1123))
+	t.mu.Lock()
+	if hs := t.hosts[host]; hs != nil && until.After(hs.blockedUntil) {
+		hs.blockedUntil = until
+	}
+	t.mu.Unlock()
+}
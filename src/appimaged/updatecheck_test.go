@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/probonopd/go-appimage/internal/helpers"
+)
+
+// requestLog records the requests a test server gets
+type requestLog struct {
+	mu          sync.Mutex
+	requests    int
+	conditional int
+}
+
+func (l *requestLog) record(r *http.Request) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.requests++
+	if r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+		l.conditional++
+	}
+}
+
+func (l *requestLog) counts() (int, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.requests, l.conditional
+}
+
+func TestUpdateCheckerZsync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appimaged-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldPath, _ := zsyncFixture(t, dir)
+
+	var served requestLog
+	fs := http.FileServer(http.Dir(dir))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served.record(r)
+		fs.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	ui := "zsync|" + server.URL + "/new.bin.zsync"
+
+	c := NewUpdateChecker(time.Hour, 0)
+	control, err := c.Check(oldPath, ui)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if control == nil || control.Filename != "new.bin" {
+		t.Fatal("Expected new.bin to be offered, got", control)
+	}
+	sum, _ := fileSHA1(filepath.Join(dir, "new.bin"))
+	if control.SHA1 != sum {
+		t.Error("Expected SHA-1", sum, "got", control.SHA1)
+	}
+
+	// The second time, the server is asked whether the zsync file has changed
+	control, err = c.Check(oldPath, ui)
+	if err != nil || control == nil {
+		t.Fatal("Expected new.bin to be offered again, got", control, err)
+	}
+	if requests, conditional := served.counts(); requests != 2 || conditional != 1 {
+		t.Error("Expected 2 requests of which 1 conditional, got", requests, conditional)
+	}
+
+	control, err = c.Check(filepath.Join(dir, "new.bin"), ui)
+	if err != nil || control != nil {
+		t.Error("Expected new.bin to be up to date, got", control, err)
+	}
+}
+
+func TestUpdateCheckerGitHubRelease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appimaged-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldPath, _ := zsyncFixture(t, dir)
+
+	var api requestLog
+	notModified := 0
+	fs := http.FileServer(http.Dir(dir))
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/someone/something/releases/tags/continuous" {
+			fs.ServeHTTP(w, r)
+			return
+		}
+		api.record(r)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprintf(w, `{"tag_name": "continuous", "assets": [
+			{"name": "Something-x86_64.AppImage", "browser_download_url": "%[1]s/new.bin"},
+			{"name": "Something-x86_64.AppImage.zsync", "browser_download_url": "%[1]s/new.bin.zsync"}]}`, server.URL)
+	}))
+	defer server.Close()
+
+	c := NewUpdateChecker(time.Hour, 0)
+	defer func(u string, client *http.Client) {
+		helpers.GitHubAPIURL, helpers.GitHubHTTPClient = u, client
+	}(helpers.GitHubAPIURL, helpers.GitHubHTTPClient)
+	helpers.GitHubAPIURL = server.URL + "/"
+	helpers.GitHubHTTPClient = c.Client()
+
+	ui := "gh-releases-zsync|someone|something|continuous|Something-*x86_64.AppImage.zsync"
+	for i := 0; i < 2; i++ {
+		control, err := c.Check(oldPath, ui)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if control == nil || control.URL != server.URL+"/new.bin" {
+			t.Fatal("Expected new.bin to be offered, got", control)
+		}
+	}
+	if requests, conditional := api.counts(); requests != 2 || conditional != 1 || notModified != 1 {
+		t.Error("Expected the release to be requested twice, the second time answered with 304, got", requests, conditional, notModified)
+	}
+}
+
+func TestUpdateCheckerRespectsRateLimits(t *testing.T) {
+	var served requestLog
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served.record(r)
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "appimaged-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "Something.AppImage")
+	ioutil.WriteFile(path, []byte("something"), 0755)
+
+	c := NewUpdateChecker(time.Hour, 0)
+	for i := 0; i < 3; i++ {
+		_, err := c.Check(path, "zsync|"+server.URL+"/Something.AppImage.zsync")
+		if err == nil {
+			t.Fatal("Expected an error")
+		}
+	}
+	if requests, _ := served.counts(); requests != 1 {
+		t.Error("Expected no more requests after being asked to wait, got", requests)
+	}
+
+	// Failing checks are postponed, the longer the more often they fail
+	now := time.Now()
+	first := c.failed("zsync|x", now)
+	second := c.failed("zsync|x", now)
+	if first <= time.Hour || second <= first || c.due("zsync|x", now.Add(first)) == true {
+		t.Error("Expected increasing backoff, got", first, second)
+	}
+	c.succeeded("zsync|x")
+	if c.due("zsync|x", now) == false {
+		t.Error("Expected check to be due after success")
+	}
+}
+
+func TestUpdateCheckerSpacesOutRequestsToHost(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	c := NewUpdateChecker(time.Hour, 50*time.Millisecond)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		resp, err := c.Client().Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Error("Expected requests to be spaced out by 50 ms, took", elapsed)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+// What happens when an update is available can be configured in
+// $XDG_CONFIG_HOME/appimaged/updates.conf, e.g.,
+//
+//	# For all AppImages: notify (default), auto, or pinned
+//	policy = notify
+//	# Replace the old version (default), keep both, keep all, or keep this many versions
+//	keep = replace
+//
+//	# For an application, by its name or its update information
+//	[Inkscape]
+//	policy = auto
+//	keep = 3
+//
+// With "notify", a notification offers to update; with "auto", updates are applied
+// without asking; with "pinned", updates are ignored unless the user asks for them.
+// The file is read whenever an update is available, so changes take effect immediately.
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+
+	"github.com/adrg/xdg"
+	"github.com/probonopd/go-appimage/internal/helpers"
+	"gopkg.in/ini.v1"
+)
+
+const (
+	updatePolicyNotify = "notify"
+	updatePolicyAuto   = "auto"
+	updatePolicyPinned = "pinned"
+)
+
+// UpdatePolicy says what happens when an update is available for an AppImage
+type UpdatePolicy struct {
+	Mode string // updatePolicyNotify, updatePolicyAuto, or updatePolicyPinned
+	Keep int    // How many versions are kept: 1 replaces the old version, 0 keeps all
+}
+
+// updatePolicyFilePath returns where the update policies are configured
+func updatePolicyFilePath() string {
+	return xdg.ConfigHome + "/appimaged/updates.conf"
+}
+
+// loadUpdatePolicy returns the policy for the AppImage of the entry
+// as configured in the file at path
+func loadUpdatePolicy(path string, entry RegistryEntry) (UpdatePolicy, error) {
+	policy := UpdatePolicy{Mode: updatePolicyNotify, Keep: 1}
+	if helpers.Exists(path) == false {
+		return policy, nil
+	}
+	cfg, err := ini.LoadSources(ini.LoadOptions{IgnoreInlineComment: true}, path)
+	if err != nil {
+		return policy, err
+	}
+	err = policy.apply(cfg.Section(ini.DefaultSection))
+	if err != nil {
+		return policy, err
+	}
+	ui, _ := url.QueryUnescape(entry.UpdateInformation)
+	for _, section := range cfg.Sections() {
+		name := section.Name()
+		if name == ini.DefaultSection || name == "" {
+			continue
+		}
+		if name == entry.Name || name == entry.UpdateInformation || name == ui {
+			err = policy.apply(section)
+		}
+	}
+	return policy, err
+}
+
+// apply sets what is configured in section
+func (policy *UpdatePolicy) apply(section *ini.Section) error {
+	if section.HasKey("policy") {
+		mode := section.Key("policy").In(updatePolicyNotify, []string{updatePolicyNotify, updatePolicyAuto, updatePolicyPinned})
+		if mode != section.Key("policy").String() {
+			return errors.New("Invalid update policy " + section.Key("policy").String())
+		}
+		policy.Mode = mode
+	}
+	if section.HasKey("keep") {
+		switch keep := section.Key("keep").String(); keep {
+		case "replace":
+			policy.Keep = 1
+		case "both":
+			policy.Keep = 2
+		case "all":
+			policy.Keep = 0
+		default:
+			n, err := strconv.Atoi(keep)
+			if err != nil || n < 1 {
+				return errors.New("Invalid number of versions to keep " + keep)
+			}
+			policy.Keep = n
+		}
+	}
+	return nil
+}
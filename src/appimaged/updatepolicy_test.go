@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadUpdatePolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appimaged-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "updates.conf")
+	ioutil.WriteFile(path, []byte(`policy = auto
+keep = both
+
+[Inkscape]
+policy = pinned
+
+[zsync|https://example.com/Gimp-latest.AppImage.zsync]
+keep = 3
+
+# Sections are applied in order, so the more specific one goes last
+[Krita]
+keep = all
+policy = notify
+`), 0644)
+
+	for _, c := range []struct {
+		entry    RegistryEntry
+		expected UpdatePolicy
+	}{
+		{RegistryEntry{Name: "Other"}, UpdatePolicy{Mode: updatePolicyAuto, Keep: 2}},
+		{RegistryEntry{Name: "Inkscape"}, UpdatePolicy{Mode: updatePolicyPinned, Keep: 2}},
+		{RegistryEntry{Name: "GIMP", UpdateInformation: "zsync%7Chttps://example.com/Gimp-latest.AppImage.zsync"}, UpdatePolicy{Mode: updatePolicyAuto, Keep: 3}},
+		{RegistryEntry{Name: "Krita"}, UpdatePolicy{Mode: updatePolicyNotify, Keep: 0}},
+	} {
+		policy, err := loadUpdatePolicy(path, c.entry)
+		if err != nil || policy != c.expected {
+			t.Errorf("Expected %+v for %s, got %+v %v", c.expected, c.entry.Name, policy, err)
+		}
+	}
+
+	// Without a configuration, the user is asked and the old version is replaced
+	policy, err := loadUpdatePolicy(filepath.Join(dir, "missing.conf"), RegistryEntry{Name: "Other"})
+	if err != nil || policy != (UpdatePolicy{Mode: updatePolicyNotify, Keep: 1}) {
+		t.Error("Expected the default policy, got", policy, err)
+	}
+}
+
+func TestLoadUpdatePolicyErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appimaged-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "updates.conf")
+	for _, conf := range []string{"policy = sometimes\n", "keep = 0\n", "keep = some\n", "[Inkscape]\nkeep = -1\n"} {
+		ioutil.WriteFile(path, []byte(conf), 0644)
+		if _, err := loadUpdatePolicy(path, RegistryEntry{Name: "Inkscape"}); err == nil {
+			t.Errorf("Expected an error for %q", conf)
+		}
+	}
+}
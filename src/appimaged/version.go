@@ -0,0 +1,70 @@
+package main
+
+// When there are several AppImages of an application, we need to know which one is
+// the most recent, e.g., to launch it or to check it for updates. The modification time
+// of the files is not good enough for this since copying an old AppImage makes it "new".
+// So AppImages are ranked by their version (X-AppImage-Version in the desktop file, or
+// the most recent release in the AppStream metainfo file), as long as it can be parsed as
+// a semantic version or a date; then by when their squashfs was made; and only then
+// by the modification time of the files.
+
+import (
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/go-version"
+)
+
+// datePattern matches versions that are dates, e.g., 20200131, 2020-01-31, or 2020.01.31
+var datePattern = regexp.MustCompile(`^(\d{4})[-._]?(\d{2})[-._]?(\d{2})(.*)$`)
+
+// parseVersion parses a semantic version or a date
+func parseVersion(s string) (*version.Version, error) {
+	s = strings.TrimSpace(s)
+	if m := datePattern.FindStringSubmatch(s); m != nil && (m[4] == "" || strings.ContainsAny(m[4][:1], "0123456789") == false) {
+		// Otherwise, e.g., 2020-01-31 would be 2020 with the pre-release 01-31
+		s = m[1] + "." + m[2] + "." + m[3] + m[4]
+	}
+	return version.NewVersion(s)
+}
+
+// isMoreRecent returns true if the AppImage of a is more recent than the one of b
+func isMoreRecent(a RegistryEntry, b RegistryEntry) bool {
+	va, erra := parseVersion(a.Version)
+	vb, errb := parseVersion(b.Version)
+	if erra == nil && errb == nil && va.Equal(vb) == false {
+		return va.GreaterThan(vb)
+	}
+	if a.FSTime.IsZero() == false && b.FSTime.IsZero() == false && a.FSTime.Equal(b.FSTime) == false {
+		return a.FSTime.After(b.FSTime)
+	}
+	if a.ModTime.Equal(b.ModTime) == false {
+		return a.ModTime.After(b.ModTime)
+	}
+	return a.Path < b.Path
+}
+
+// rankAppImages sorts the entries, the most recent one first
+func rankAppImages(entries []RegistryEntry) {
+	sort.SliceStable(entries, func(i, j int) bool { return isMoreRecent(entries[i], entries[j]) })
+}
+
+// findMostRecentAppImage returns the path of the most recent of the entries
+// whose AppImage exists and whose version satisfies constraints, if given
+func findMostRecentAppImage(entries []RegistryEntry, constraints version.Constraints) string {
+	rankAppImages(entries)
+	for _, entry := range entries {
+		if constraints != nil {
+			v, err := parseVersion(entry.Version)
+			if err != nil || constraints.Check(v) == false {
+				continue
+			}
+		}
+		if info, err := os.Stat(entry.Path); err == nil && info.Mode().IsRegular() {
+			return entry.Path
+		}
+	}
+	return ""
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-version"
+)
+
+func TestParseVersion(t *testing.T) {
+	ordered := [][]string{
+		{"1.2.3-beta1", "1.2.3", "1.10.0", "v2.0"},
+		{"20191231", "2020-01-31", "2020.02.01", "20200201.1"},
+	}
+	for _, versions := range ordered {
+		for i := 1; i < len(versions); i++ {
+			a, err := parseVersion(versions[i-1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := parseVersion(versions[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a.LessThan(b) == false {
+				t.Error("Expected", versions[i-1], "to be older than", versions[i])
+			}
+		}
+	}
+	if _, err := parseVersion("continuous"); err == nil {
+		t.Error("Expected continuous not to be a version")
+	}
+}
+
+func TestFindMostRecentAppImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appimaged-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	entry := func(name string, v string, fstime time.Time, mtime time.Time) RegistryEntry {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, nil, 0755)
+		return RegistryEntry{Path: path, Version: v, FSTime: fstime, ModTime: mtime}
+	}
+
+	// A copy of an old version has the most recent mtime
+	entries := []RegistryEntry{
+		entry("new.AppImage", "2.1.0", now.Add(-time.Hour), now.Add(-time.Hour)),
+		entry("old.AppImage", "1.9.0", now.Add(-48*time.Hour), now),
+		entry("newer-build.AppImage", "2.1.0", now.Add(-time.Minute), now.Add(-2*time.Hour)),
+		entry("unknown.AppImage", "continuous", now.Add(-72*time.Hour), now.Add(time.Hour)),
+	}
+	if got := findMostRecentAppImage(entries, nil); got != filepath.Join(dir, "newer-build.AppImage") {
+		t.Error("Expected newer-build.AppImage, got", got)
+	}
+	constraints, _ := version.NewConstraint(">=1.0,<2")
+	if got := findMostRecentAppImage(entries, constraints); got != filepath.Join(dir, "old.AppImage") {
+		t.Error("Expected old.AppImage, got", got)
+	}
+	constraints, _ = version.NewConstraint(">=3")
+	if got := findMostRecentAppImage(entries, constraints); got != "" {
+		t.Error("Expected nothing, got", got)
+	}
+
+	c, args := versionConstraintArgument([]string{"--version", ">=2.0,<3", "file.txt"})
+	if c == nil || len(args) != 1 || args[0] != "file.txt" {
+		t.Error("Expected a constraint and one argument, got", c, args)
+	}
+	c, args = versionConstraintArgument([]string{"--version"})
+	if c != nil || len(args) != 1 {
+		t.Error("Expected --version to be passed to the application, got", c, args)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+// Which directories are watched for AppImages can be configured in
+// $XDG_CONFIG_HOME/appimaged/appimaged.conf, e.g.,
+//
+//	# Watch at most this many directories (default: half of fs.inotify.max_user_watches)
+//	maxwatches = 4096
+//	# Watch these whole filesystems with fanotify, see fanotify.go
+//	fanotify = /, /home
+//
+//	# Add a watched directory, including subdirectories up to 2 levels deep (-1 for all levels)
+//	[~/Software]
+//	depth = 2
+//	include = *.AppImage, *.appimage
+//	exclude = *-old-*, */Archive/*
+//	# Only register the AppImages in here, integrate them on request (e.g., over D-Bus)
+//	integrate = false
+//
+//	# Stop watching one of the default directories
+//	[~/Desktop]
+//	enabled = false
+//
+// The include and exclude patterns are matched against the file name and against the whole path.
+// Hidden subdirectories are not descended into. Changes to the file are picked up while running.
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/adrg/xdg"
+	"github.com/probonopd/go-appimage/internal/helpers"
+	"gopkg.in/ini.v1"
+)
+
+// WatchRoot is a directory that is watched for AppImages
+type WatchRoot struct {
+	Path      string
+	Depth     int // Levels of subdirectories that are watched, -1 for all
+	Include   []string
+	Exclude   []string
+	Integrate bool // Whether AppImages are integrated automatically or only registered
+}
+
+// WatchConfig is what is configured in the configuration file
+type WatchConfig struct {
+	Roots      []WatchRoot
+	MaxWatches int      // Maximum number of directories watched with inotify
+	Fanotify   []string // Filesystems watched with fanotify
+}
+
+// defaultMaxWatches is used if fs.inotify.max_user_watches cannot be read
+const defaultMaxWatches = 4096
+
+// watchConfigFilePath returns where the configuration of the watched directories is stored
+func watchConfigFilePath() string {
+	return xdg.ConfigHome + "/appimaged/appimaged.conf"
+}
+
+// newWatchRoot returns a WatchRoot for path with the default settings
+func newWatchRoot(path string) WatchRoot {
+	return WatchRoot{Path: filepath.Clean(path), Depth: 0, Integrate: true}
+}
+
+// expandHome expands a leading ~ and $HOME in path
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		path = home + path[1:]
+	}
+	return os.Expand(path, func(name string) string {
+		if name == "HOME" {
+			return home
+		}
+		return os.Getenv(name)
+	})
+}
+
+// splitPatterns splits a comma-separated list of glob patterns
+func splitPatterns(value string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(value, ",") {
+		if strings.TrimSpace(pattern) != "" {
+			patterns = append(patterns, expandHome(strings.TrimSpace(pattern)))
+		}
+	}
+	return patterns
+}
+
+// loadWatchConfig returns the configuration in the file at path,
+// starting from the default directories
+func loadWatchConfig(path string) (WatchConfig, error) {
+	config := WatchConfig{MaxWatches: systemMaxWatches() / 2}
+	for _, dir := range candidateDirectories {
+		config.Roots = append(config.Roots, newWatchRoot(dir))
+	}
+
+	if helpers.Exists(path) == false {
+		return config, nil
+	}
+	cfg, err := ini.LoadSources(ini.LoadOptions{IgnoreInlineComment: true}, path)
+	if err != nil {
+		return config, err
+	}
+	if cfg.Section("").HasKey("maxwatches") {
+		config.MaxWatches, err = cfg.Section("").Key("maxwatches").Int()
+		if err != nil {
+			return config, err
+		}
+	}
+	if cfg.Section("").HasKey("fanotify") {
+		config.Fanotify = splitPatterns(cfg.Section("").Key("fanotify").String())
+	}
+	for _, section := range cfg.Sections() {
+		if section.Name() == ini.DefaultSection {
+			continue
+		}
+		root := newWatchRoot(expandHome(section.Name()))
+		i := -1
+		for j, r := range config.Roots {
+			if r.Path == root.Path {
+				i = j
+				root = r
+			}
+		}
+		if section.Key("enabled").MustBool(true) == false {
+			if i >= 0 {
+				config.Roots = append(config.Roots[:i], config.Roots[i+1:]...)
+			}
+			continue
+		}
+		if section.HasKey("depth") {
+			root.Depth, err = section.Key("depth").Int()
+			if err != nil {
+				return config, err
+			}
+		}
+		if section.HasKey("include") {
+			root.Include = splitPatterns(section.Key("include").String())
+		}
+		if section.HasKey("exclude") {
+			root.Exclude = splitPatterns(section.Key("exclude").String())
+		}
+		root.Integrate = section.Key("integrate").MustBool(root.Integrate)
+		if i >= 0 {
+			config.Roots[i] = root
+		} else {
+			config.Roots = append(config.Roots, root)
+		}
+	}
+	return config, nil
+}
+
+// systemMaxWatches returns fs.inotify.max_user_watches
+func systemMaxWatches() int {
+	data, err := ioutil.ReadFile("/proc/sys/fs/inotify/max_user_watches")
+	if err != nil {
+		return defaultMaxWatches
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return defaultMaxWatches
+	}
+	return max
+}
+
+// level returns how many levels of subdirectories below the root path is in,
+// or -1 if it is not in the root
+func (root WatchRoot) level(path string) int {
+	rel, err := filepath.Rel(root.Path, filepath.Dir(path))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return -1
+	}
+	if rel == "." {
+		return 0
+	}
+	return strings.Count(rel, "/") + 1
+}
+
+// contains returns true if the file at path is within the depth of the root
+func (root WatchRoot) contains(path string) bool {
+	level := root.level(path)
+	return level >= 0 && (root.Depth < 0 || level <= root.Depth)
+}
+
+// containsDirectory returns true if the files in dir are within the depth of the root
+func (root WatchRoot) containsDirectory(dir string) bool {
+	return root.contains(dir + "/file")
+}
+
+// matches returns true if the file at path is in the root and not excluded by its patterns
+func (root WatchRoot) matches(path string) bool {
+	if root.contains(path) == false {
+		return false
+	}
+	if len(root.Include) > 0 && matchesAnyPattern(path, root.Include) == false {
+		return false
+	}
+	return matchesAnyPattern(path, root.Exclude) == false
+}
+
+// matchesAnyPattern returns true if the file name or the whole path matches one of the patterns
+func matchesAnyPattern(path string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, filepath.Base(path)); ok == true {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, path); ok == true {
+			return true
+		}
+	}
+	return false
+}
+
+// appendWatchRootIfMissing appends root unless there is already a root for its path
+func appendWatchRootIfMissing(roots []WatchRoot, root WatchRoot) []WatchRoot {
+	for _, r := range roots {
+		if r.Path == root.Path {
+			return roots
+		}
+	}
+	return append(roots, root)
+}
+
+// findWatchRoot returns the most specific of the roots that contains path
+func findWatchRoot(roots []WatchRoot, path string) (WatchRoot, bool) {
+	var found WatchRoot
+	ok := false
+	for _, root := range roots {
+		if root.contains(path) && (ok == false || len(root.Path) > len(found.Path)) {
+			found = root
+			ok = true
+		}
+	}
+	return found, ok
+}
+
+// integrationRequests are the paths which are to be integrated
+// even if they are in a directory where AppImages are not integrated automatically
+var integrationRequests = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: make(map[string]bool)}
+
+// requestIntegration makes the next integration of path happen regardless of the configuration
+func requestIntegration(path string) {
+	integrationRequests.Lock()
+	integrationRequests.paths[path] = true
+	integrationRequests.Unlock()
+}
+
+// shouldIntegrate returns whether the AppImage at path is to be integrated
+// rather than only registered
+func shouldIntegrate(path string) bool {
+	integrationRequests.Lock()
+	requested := integrationRequests.paths[path]
+	delete(integrationRequests.paths, path)
+	integrationRequests.Unlock()
+	if requested == true {
+		return true
+	}
+	root, ok := findWatchRoot(watcher.Roots(), path)
+	return ok == false || root.Integrate == true
+}
+
+// watchConfigFile re-applies the watched directories whenever the configuration file changes
+func watchConfigFile() {
+	path := watchConfigFilePath()
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		helpers.PrintError("watchConfigFile", err)
+		return
+	}
+	for range watchFileChanges(path) {
+		log.Println("Configuration changed, reloading", path)
+		watchDirectories()
+	}
+}
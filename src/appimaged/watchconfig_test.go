@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadWatchConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appimaged-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(h string, candidates []string) { home, candidateDirectories = h, candidates }(home, candidateDirectories)
+	home = "/home/me"
+	candidateDirectories = []string{"/home/me/Downloads", "/opt"}
+
+	downloads := WatchRoot{Path: "/home/me/Downloads", Integrate: true}
+	opt := WatchRoot{Path: "/opt", Integrate: true}
+	defaultMax := systemMaxWatches() / 2
+	for _, c := range []struct {
+		conf     string
+		expected WatchConfig
+	}{
+		{"", WatchConfig{Roots: []WatchRoot{downloads, opt}, MaxWatches: defaultMax}},
+		{"maxwatches = 100\nfanotify = /, ~/data\n", WatchConfig{Roots: []WatchRoot{downloads, opt}, MaxWatches: 100, Fanotify: []string{"/", "/home/me/data"}}},
+		{"[~/Downloads]\ndepth = 2\nexclude = *.part, ~/Downloads/old/*\n", WatchConfig{Roots: []WatchRoot{
+			{Path: "/home/me/Downloads", Depth: 2, Exclude: []string{"*.part", "/home/me/Downloads/old/*"}, Integrate: true}, opt,
+		}, MaxWatches: defaultMax}},
+		{"[/opt]\nenabled = false\n", WatchConfig{Roots: []WatchRoot{downloads}, MaxWatches: defaultMax}},
+		{"[/mnt/apps/]\ndepth = -1\ninclude = *.AppImage\nintegrate = false\n", WatchConfig{Roots: []WatchRoot{
+			downloads, opt, {Path: "/mnt/apps", Depth: -1, Include: []string{"*.AppImage"}, Integrate: false},
+		}, MaxWatches: defaultMax}},
+	} {
+		path := filepath.Join(dir, "appimaged.conf")
+		os.Remove(path)
+		if c.conf != "" {
+			ioutil.WriteFile(path, []byte(c.conf), 0644)
+		}
+		config, err := loadWatchConfig(path)
+		if err != nil || reflect.DeepEqual(config, c.expected) == false {
+			t.Errorf("Expected %+v for %q, got %+v %v", c.expected, c.conf, config, err)
+		}
+	}
+
+	for _, conf := range []string{"maxwatches = many\n", "[/opt]\ndepth = deep\n"} {
+		path := filepath.Join(dir, "appimaged.conf")
+		ioutil.WriteFile(path, []byte(conf), 0644)
+		if _, err := loadWatchConfig(path); err == nil {
+			t.Errorf("Expected an error for %q", conf)
+		}
+	}
+}
+
+func TestSystemMaxWatches(t *testing.T) {
+	max := systemMaxWatches()
+	if _, err := os.Stat("/proc/sys/fs/inotify/max_user_watches"); err != nil && max != defaultMaxWatches {
+		t.Error("Expected the default of", defaultMaxWatches, "without /proc, got", max)
+	}
+	if max <= 0 {
+		t.Error("Expected a positive number of watches, got", max)
+	}
+}
+
+func TestWatchRootMatches(t *testing.T) {
+	apps := WatchRoot{Path: "/home/me/Applications", Depth: 1, Exclude: []string{"*-old.AppImage", "/home/me/Applications/tmp/*"}}
+	all := WatchRoot{Path: "/mnt", Depth: -1, Include: []string{"*.AppImage"}}
+	for _, c := range []struct {
+		root     WatchRoot
+		path     string
+		expected bool
+	}{
+		{apps, "/home/me/Applications/App.AppImage", true},
+		{apps, "/home/me/Applications/sub/App.AppImage", true},
+		{apps, "/home/me/Applications/sub/sub/App.AppImage", false}, // Deeper than depth
+		{apps, "/home/me/Applications/App-old.AppImage", false},     // Excluded by name
+		{apps, "/home/me/Applications/tmp/App.AppImage", false},     // Excluded by path
+		{apps, "/home/me/ApplicationsOld/App.AppImage", false},
+		{apps, "/home/me/App.AppImage", false},
+		{all, "/mnt/a/b/c/d/App.AppImage", true},
+		{all, "/mnt/a/App.app", false}, // Not included
+	} {
+		if c.root.matches(c.path) != c.expected {
+			t.Error("Expected", c.expected, "for", c.path, "in", c.root.Path)
+		}
+	}
+
+	roots := []WatchRoot{{Path: "/home/me", Depth: -1}, {Path: "/home/me/Applications", Depth: 0}}
+	if root, ok := findWatchRoot(roots, "/home/me/Applications/App.AppImage"); ok == false || root.Path != "/home/me/Applications" {
+		t.Error("Expected the most specific root, got", root.Path)
+	}
+	if root, ok := findWatchRoot(roots, "/home/me/Applications/sub/App.AppImage"); ok == false || root.Path != "/home/me" {
+		t.Error("Expected the root that is deep enough, got", root.Path)
+	}
+	if _, ok := findWatchRoot(roots, "/opt/App.AppImage"); ok == true {
+		t.Error("Expected no root for /opt")
+	}
+}
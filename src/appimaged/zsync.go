@@ -0,0 +1,432 @@
+package main
+
+// A zsync client so that updates only need to download the parts of an AppImage
+// that have changed. The zsync file describes the new file block by block;
+// blocks that are also in the AppImage we already have are copied from there,
+// the others are fetched from the server with HTTP range requests.
+// See http://zsync.moria.org.uk/paper/ for how this works
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/md4"
+	"golang.org/x/sys/unix"
+)
+
+// zsyncControl is what a zsync file says about the file it describes
+type zsyncControl struct {
+	Filename      string
+	MTime         time.Time
+	Blocksize     int
+	Length        int64
+	URL           string // Absolute, resolved relative to the zsync file
+	SHA1          string
+	rsumBytes     int
+	checksumBytes int
+	seqMatches    int // How many blocks in a row need to match, the checksums are too short to rely on fewer
+	blocks        []zsyncBlock
+}
+
+// zsyncBlock is the checksums of one block of the file
+type zsyncBlock struct {
+	rsum     uint32
+	checksum []byte
+}
+
+// updateHTTPClient is used for everything that updating downloads
+var updateHTTPClient = &http.Client{Transport: &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	ResponseHeaderTimeout: 30 * time.Second,
+}}
+
+// httpGet gets u using client and returns the response if its status is 200 or 206
+func httpGet(client *http.Client, u string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("User-Agent", "appimaged")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return resp, nil
+}
+
+// fetchZsyncControl downloads and parses the zsync file at u
+func fetchZsyncControl(u string) (*zsyncControl, error) {
+	resp, err := httpGet(updateHTTPClient, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	base, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	return parseZsyncControl(resp.Body, base)
+}
+
+// fetchZsyncHeader downloads the beginning of the zsync file at u using client
+// and parses its header; the block checksums are not needed to tell whether a file is up to date
+func fetchZsyncHeader(client *http.Client, u string) (*zsyncControl, error) {
+	header := http.Header{}
+	header.Set("Range", "bytes=0-65535")
+	resp, err := httpGet(client, u, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	base, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	c, _, err := parseZsyncHeader(bufio.NewReader(resp.Body), base)
+	return c, err
+}
+
+// parseZsyncControl parses a zsync file; relative URLs in it are resolved against base
+func parseZsyncControl(r io.Reader, base *url.URL) (*zsyncControl, error) {
+	br := bufio.NewReader(r)
+	c, seqMatches, err := parseZsyncHeader(br, base)
+	if err != nil {
+		return nil, err
+	}
+	if seqMatches < 1 || seqMatches > 2 || c.rsumBytes < 1 || c.rsumBytes > 4 || c.checksumBytes < 3 || c.checksumBytes > 16 {
+		return nil, errors.New("zsync: Unsupported Hash-Lengths")
+	}
+	c.seqMatches = seqMatches
+
+	n := int((c.Length + int64(c.Blocksize) - 1) / int64(c.Blocksize))
+	c.blocks = make([]zsyncBlock, n)
+	buf := make([]byte, c.rsumBytes+c.checksumBytes)
+	for i := range c.blocks {
+		_, err := io.ReadFull(br, buf)
+		if err != nil {
+			return nil, errors.New("zsync: Block checksums truncated")
+		}
+		rsum := make([]byte, 4)
+		copy(rsum[4-c.rsumBytes:], buf[:c.rsumBytes])
+		c.blocks[i].rsum = uint32(rsum[0])<<24 | uint32(rsum[1])<<16 | uint32(rsum[2])<<8 | uint32(rsum[3])
+		c.blocks[i].checksum = append([]byte(nil), buf[c.rsumBytes:]...)
+	}
+	return c, nil
+}
+
+// parseZsyncHeader parses the header of a zsync file, up to and including the empty line after it.
+// Returns the header and the number of sequential matches from Hash-Lengths
+func parseZsyncHeader(br *bufio.Reader, base *url.URL) (*zsyncControl, int, error) {
+	c := &zsyncControl{}
+	seqMatches := 1
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, 0, errors.New("zsync: Header not terminated")
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, 0, errors.New("zsync: Invalid header line " + line)
+		}
+		value := strings.TrimSpace(parts[1])
+		switch parts[0] {
+		case "Filename":
+			c.Filename = value
+		case "MTime":
+			c.MTime, _ = time.Parse(time.RFC1123Z, value)
+		case "Blocksize":
+			c.Blocksize, err = strconv.Atoi(value)
+		case "Length":
+			c.Length, err = strconv.ParseInt(value, 10, 64)
+		case "Hash-Lengths":
+			lengths := strings.Split(value, ",")
+			if len(lengths) != 3 {
+				return nil, 0, errors.New("zsync: Invalid Hash-Lengths " + value)
+			}
+			seqMatches, err = strconv.Atoi(lengths[0])
+			if err == nil {
+				c.rsumBytes, err = strconv.Atoi(lengths[1])
+			}
+			if err == nil {
+				c.checksumBytes, err = strconv.Atoi(lengths[2])
+			}
+		case "URL":
+			if c.URL == "" {
+				var u *url.URL
+				u, err = base.Parse(value)
+				if err == nil {
+					c.URL = u.String()
+				}
+			}
+		case "SHA-1":
+			c.SHA1 = strings.ToLower(value)
+		}
+		if err != nil {
+			return nil, 0, errors.New("zsync: Invalid header line " + line)
+		}
+	}
+	if c.Blocksize <= 0 || c.Length < 0 || c.URL == "" || c.SHA1 == "" {
+		return nil, 0, errors.New("zsync: Incomplete header")
+	}
+	return c, seqMatches, nil
+}
+
+// rsum is the rolling checksum of a window of data
+type rsum struct {
+	a, b uint16
+}
+
+func newRsum(data []byte) rsum {
+	var r rsum
+	l := uint16(len(data))
+	for _, c := range data {
+		r.a += uint16(c)
+		r.b += l * uint16(c)
+		l--
+	}
+	return r
+}
+
+// roll moves the window by one byte, out leaving and in entering it
+func (r *rsum) roll(out byte, in byte, blocksize int) {
+	r.a += uint16(in) - uint16(out)
+	r.b += r.a - uint16(blocksize)*uint16(out)
+}
+
+func (r rsum) value(mask uint32) uint32 {
+	return (uint32(r.a)<<16 | uint32(r.b)) & mask
+}
+
+// Sync writes the file described by the zsync file to out, using the blocks it shares
+// with the file at seedPath, and downloading the rest.
+// Returns how many bytes could be used from the seed file
+func (c *zsyncControl) Sync(seedPath string, out *os.File) (int64, error) {
+	known := make([]bool, len(c.blocks))
+	reused, err := c.copyKnownBlocks(seedPath, out, known)
+	if err != nil {
+		// Not being able to use the seed file is not fatal, we can still download everything
+		reused = 0
+		known = make([]bool, len(c.blocks))
+	}
+
+	for start := 0; start < len(known); start++ {
+		if known[start] == true {
+			continue
+		}
+		end := start
+		for end < len(known) && known[end] == false {
+			end++
+		}
+		complete, err := c.fetchRange(out, int64(start)*int64(c.Blocksize), int64(end)*int64(c.Blocksize))
+		if err != nil {
+			return reused, err
+		}
+		if complete == true {
+			// The server does not support ranges and sent the whole file
+			reused = 0
+			break
+		}
+		start = end
+	}
+
+	err = out.Truncate(c.Length)
+	if err != nil {
+		return reused, err
+	}
+	return reused, c.verify(out)
+}
+
+// copyKnownBlocks copies the blocks that are also in the seed file to out
+// and marks them as known
+func (c *zsyncControl) copyKnownBlocks(seedPath string, out *os.File, known []bool) (int64, error) {
+	f, err := os.Open(seedPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() < int64(c.Blocksize) {
+		return 0, nil
+	}
+	seed, err := unix.Mmap(int(f.Fd()), 0, int(info.Size()), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Munmap(seed)
+
+	mask := uint32(0xffffffff)
+	if c.rsumBytes < 4 {
+		mask = 1<<(8*uint(c.rsumBytes)) - 1
+	}
+	candidates := make(map[uint32][]int)
+	for i, block := range c.blocks {
+		candidates[block.rsum] = append(candidates[block.rsum], i)
+	}
+
+	var reused int64
+	bs := c.Blocksize
+	pos := 0
+	r := newRsum(seed[:bs])
+	for {
+		matched := false
+		if indices, ok := candidates[r.value(mask)]; ok == true {
+			h := md4.New()
+			h.Write(seed[pos : pos+bs])
+			checksum := h.Sum(nil)[:c.checksumBytes]
+			for _, i := range indices {
+				if bytes.Equal(checksum, c.blocks[i].checksum) == false {
+					continue
+				}
+				if c.seqMatches == 2 && i+1 < len(c.blocks) {
+					// The block that follows needs to match as well, which is then also copied
+					if pos+2*bs > len(seed) || c.blockMatches(i+1, seed[pos+bs:pos+2*bs], mask) == false {
+						continue
+					}
+					if known[i+1] == false {
+						_, err = out.WriteAt(seed[pos+bs:pos+2*bs], int64(i+1)*int64(bs))
+						if err != nil {
+							return reused, err
+						}
+						known[i+1] = true
+						reused += int64(bs)
+					}
+				}
+				matched = true
+				if known[i] == true {
+					continue
+				}
+				_, err = out.WriteAt(seed[pos:pos+bs], int64(i)*int64(bs))
+				if err != nil {
+					return reused, err
+				}
+				known[i] = true
+				reused += int64(bs)
+			}
+		}
+		if matched == true {
+			// Blocks do not overlap, so continue after the one that matched
+			pos += bs
+			if pos+bs > len(seed) {
+				break
+			}
+			r = newRsum(seed[pos : pos+bs])
+			continue
+		}
+		if pos+bs >= len(seed) {
+			break
+		}
+		r.roll(seed[pos], seed[pos+bs], bs)
+		pos++
+	}
+	return reused, nil
+}
+
+// blockMatches returns whether data has the checksums of block i
+func (c *zsyncControl) blockMatches(i int, data []byte, mask uint32) bool {
+	if newRsum(data).value(mask) != c.blocks[i].rsum {
+		return false
+	}
+	h := md4.New()
+	h.Write(data)
+	return bytes.Equal(h.Sum(nil)[:c.checksumBytes], c.blocks[i].checksum)
+}
+
+// fetchRange downloads the bytes from start up to end (exclusive) into out.
+// Returns true if the server sent the whole file rather than the range
+func (c *zsyncControl) fetchRange(out *os.File, start int64, end int64) (bool, error) {
+	if end > c.Length {
+		end = c.Length
+	}
+	if start >= end {
+		return false, nil
+	}
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	resp, err := httpGet(updateHTTPClient, c.URL, header)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	complete := resp.StatusCode == http.StatusOK
+	if complete == true {
+		start = 0
+		end = c.Length
+	}
+	_, err = out.Seek(start, io.SeekStart)
+	if err != nil {
+		return complete, err
+	}
+	_, err = io.CopyN(out, resp.Body, end-start)
+	return complete, err
+}
+
+// verify checks the SHA-1 of the file written to out
+func (c *zsyncControl) verify(out *os.File) error {
+	_, err := out.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	h := sha1.New()
+	_, err = io.Copy(h, out)
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != c.SHA1 {
+		return errors.New("zsync: SHA-1 of " + out.Name() + " does not match")
+	}
+	return nil
+}
+
+// download writes the whole file described by the zsync file to out
+// without using a seed file
+func (c *zsyncControl) download(out *os.File) error {
+	err := out.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = c.fetchRange(out, 0, c.Length)
+	if err != nil {
+		return err
+	}
+	return c.verify(out)
+}
+
+// fileSHA1 returns the SHA-1 of the file at path as used in zsync files
+func fileSHA1(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha1.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/probonopd/go-zsyncmake/zsync"
+	"golang.org/x/crypto/md4"
+)
+
+// zsyncFixture writes an old and a new version of a file that share most of their blocks,
+// and the zsync file for the new version, to dir
+func zsyncFixture(t *testing.T, dir string) (oldPath string, newData []byte) {
+	rnd := rand.New(rand.NewSource(1))
+	oldData := make([]byte, 100*1024+123)
+	rnd.Read(oldData)
+	// Change some bytes, insert some, and drop some so that blocks move
+	newData = append([]byte(nil), oldData[:30000]...)
+	newData = append(newData, []byte("inserted")...)
+	newData = append(newData, oldData[30000:60000]...)
+	newData = append(newData, oldData[64000:]...)
+	newData[80000] ^= 0xff
+
+	oldPath = filepath.Join(dir, "old.bin")
+	err := ioutil.WriteFile(oldPath, oldData, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "new.bin"), newData, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zsync.ZsyncMake(filepath.Join(dir, "new.bin"), zsync.Options{BlockSize: 2048, Url: "new.bin"})
+	return oldPath, newData
+}
+
+func TestZsyncSyncReusesSeedBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appimaged-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldPath, newData := zsyncFixture(t, dir)
+
+	var ranges int
+	fs := http.FileServer(http.Dir(dir))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			ranges++
+		}
+		fs.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	control, err := fetchZsyncControl(server.URL + "/new.bin.zsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if control.URL != server.URL+"/new.bin" || control.Length != int64(len(newData)) {
+		t.Fatal("Unexpected header", control.URL, control.Length)
+	}
+	out, err := ioutil.TempFile(dir, "out-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	reused, err := control.Sync(oldPath, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadFile(out.Name())
+	if bytes.Equal(got, newData) == false {
+		t.Fatal("Synced file differs from the new version")
+	}
+	if reused < int64(len(newData))*3/4 {
+		t.Error("Expected most of the file to be reused, got", reused, "of", len(newData))
+	}
+	if ranges == 0 || ranges > 5 {
+		t.Error("Expected a few range requests, got", ranges)
+	}
+}
+
+func TestZsyncSyncWithoutRangeSupport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appimaged-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldPath, newData := zsyncFixture(t, dir)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Ignores Range headers
+		data, err := ioutil.ReadFile(filepath.Join(dir, filepath.Base(r.URL.Path)))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	control, err := fetchZsyncControl(server.URL + "/new.bin.zsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.TempFile(dir, "out-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	_, err = control.Sync(oldPath, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadFile(out.Name())
+	if bytes.Equal(got, newData) == false {
+		t.Fatal("Downloaded file differs from the new version")
+	}
+}
+
+func TestZsyncRequiresSequentialMatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appimaged-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rnd := rand.New(rand.NewSource(2))
+	a, b, other := make([]byte, 64), make([]byte, 64), make([]byte, 64)
+	rnd.Read(a)
+	rnd.Read(b)
+	rnd.Read(other)
+	c := &zsyncControl{Blocksize: 64, Length: 128, rsumBytes: 2, checksumBytes: 3, seqMatches: 2, blocks: make([]zsyncBlock, 2)}
+	for i, data := range [][]byte{a, b} {
+		c.blocks[i].rsum = newRsum(data).value(0xffff)
+		h := md4.New()
+		h.Write(data)
+		c.blocks[i].checksum = h.Sum(nil)[:3]
+	}
+
+	for _, s := range []struct {
+		seed       []byte
+		seqMatches int
+		expected   int64
+	}{
+		{append(append([]byte("moved"), a...), b...), 2, 128},
+		{append(append([]byte(nil), a...), other...), 2, 0}, // The first block alone is not enough
+		{append(append([]byte(nil), a...), other...), 1, 64},
+		{append(append([]byte(nil), other...), b...), 2, 64}, // Nothing follows the last block
+	} {
+		seedPath := filepath.Join(dir, "seed")
+		ioutil.WriteFile(seedPath, s.seed, 0644)
+		out, err := ioutil.TempFile(dir, "out-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.seqMatches = s.seqMatches
+		reused, err := c.copyKnownBlocks(seedPath, out, make([]bool, 2))
+		out.Close()
+		if err != nil || reused != s.expected {
+			t.Errorf("Expected %d bytes to be reused with %d sequential matches, got %d %v", s.expected, s.seqMatches, reused, err)
+		}
+	}
+}
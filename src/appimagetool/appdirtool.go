@@ -119,6 +119,10 @@ if [ -e "$LD_LINUX" ] ; then
   export GSETTINGS_SCHEMA_DIR="${HERE}"/usr/share/glib-2.0/runtime-schemas/:"${HERE}"/usr/share/glib-2.0/schemas/:"${GSETTINGS_SCHEMA_DIR}"
   export QT_PLUGIN_PATH="${HERE}"/usr/lib/qt4/plugins/:"${HERE}"/usr/lib/i386-linux-gnu/qt4/plugins/:"${HERE}"/usr/lib/x86_64-linux-gnu/qt4/plugins/:"${HERE}"/usr/lib32/qt4/plugins/:"${HERE}"/usr/lib64/qt4/plugins/:"${HERE}"/usr/lib/qt5/plugins/:"${HERE}"/usr/lib/i386-linux-gnu/qt5/plugins/:"${HERE}"/usr/lib/x86_64-linux-gnu/qt5/plugins/:"${HERE}"/usr/lib32/qt5/plugins/:"${HERE}"/usr/lib64/qt5/plugins/:"${QT_PLUGIN_PATH}"
   # exec "${LD_LINUX}" --inhibit-cache --library-path "${LIBRARY_PATH}" "${MAIN_BIN}" "$@"
+  # Only for the bundled ld-linux, so that programs launched from the host do not inherit it
+  if [ ! -z "$LD_LINUX_LIBRARY_PATH" ] ; then
+    exec "${LD_LINUX}" --library-path "${LD_LINUX_LIBRARY_PATH}" "${MAIN_BIN}" "$@"
+  fi
   case $line in
     "ld-linux"*) exec "${LD_LINUX}" --inhibit-cache "${MAIN_BIN}" "$@" ;;
     *) exec "${LD_LINUX}" "${MAIN_BIN}" "$@" ;;
@@ -134,8 +138,8 @@ type ELF struct {
 	rpath    string
 }
 
-// Key: name of the package, value: location of the copyright file
-var copyrightFiles = make(map[string]string) // Need to use 'make', otherwise we can't add to it
+// Key: name of the package, value: locations of the copyright files
+var copyrightFiles = make(map[string][]string) // Need to use 'make', otherwise we can't add to it
 
 // Key: Path of the file, value: name of the package
 var packagesContainingFiles = make(map[string]string) // Need to use 'make', otherwise we can't add to it
@@ -166,8 +170,20 @@ var packagesContainingFiles = make(map[string]string) // Need to use 'make', oth
 */
 
 type DeployOptions struct {
-	standalone     bool
-	libAppRunHooks bool
+	standalone        bool
+	libAppRunHooks    bool
+	qtConf            bool     // Write qt.conf rather than patching qt_prfxpath in libQt5Core.so.5
+	sbomFormats       []string // Formats of the software bill of materials to be generated, if any
+	embedSBOM         bool     // Write the software bill of materials into the AppDir
+	compatBaseline    string   // Fail if symbol versions newer than these (e.g., "GLIBC_2.17") are needed
+	strip             string   // Strip the ELF files in the AppDir ("debug" or "all"), or leave them untouched ("")
+	debugArchive      string   // Write the stripped debug information into this archive
+	nativeAppRun      bool     // Use the compiled AppRun with AppRun.env rather than the AppRun shell script
+	libAppRunHooksDir string   // Directory containing the libapprun_hooks AppRun and libapprun_hooks.so
+	entryPoints       string   // Executables in usr/bin besides the main executable that AppRun can dispatch to ("all" for all)
+	entryPointActions bool     // Add a desktop action for each entry point
+	locales           []string // Languages of the translations to be bundled in self-contained mode (all if empty)
+	dlopenHints       string   // Hint file listing libraries loaded with dlopen, in addition to the one in the AppDir
 }
 
 // this is the public options instance
@@ -181,12 +197,45 @@ func AppDirDeploy(path string) {
 		os.Exit(1)
 	}
 
+	// AppRun; written first so that the handlers below can add to it
+	if options.libAppRunHooks == false && options.nativeAppRun == true {
+		err = installNativeAppRun(appdir)
+		if err != nil {
+			helpers.PrintError("Could not add compiled AppRun", err)
+			os.Exit(1)
+		}
+	} else if options.libAppRunHooks == false {
+		// If libapprun_hooks is not used
+		log.Println("Adding AppRun...")
+		err = ioutil.WriteFile(appdir.Path+"/AppRun", []byte(AppRunData), 0755)
+		if err != nil {
+			helpers.PrintError("write AppRun", err)
+			os.Exit(1)
+		}
+	} else {
+		err = installLibAppRunHooks(appdir, options.libAppRunHooksDir)
+		if err != nil {
+			helpers.PrintError("Could not add libapprun_hooks", err)
+			os.Exit(1)
+		}
+	}
+
+	err = detectLibc(appdir)
+	if err != nil {
+		helpers.PrintError("musl", err)
+		os.Exit(1)
+	}
+
 	log.Println("Gathering all required libraries for the AppDir...")
 	determineELFsInDirTree(appdir, appdir.Path)
 
 	// Gdk
 	handleGdk(appdir)
 
+	// Gtk 4 modules/plugins, data, and schemas
+	// Needs to come before GStreamer because the Gtk 4 media backend may pull it in
+	handleGtk4(appdir)
+
 	// GStreamer
 	handleGStreamer(appdir)
 
@@ -205,9 +254,25 @@ func AppDirDeploy(path string) {
 	// PulseAudio
 	handlePulseAudio(appdir)
 
+	// Libraries loaded with dlopen that are listed in hint files
+	err = handleDlopenHints(appdir, options.dlopenHints)
+	if err != nil {
+		helpers.PrintError("dlopen hints", err)
+		os.Exit(1)
+	}
+
 	// ld-linux interpreter
 	ldLinux, err := deployInterpreter(appdir)
 
+	// gconv and NSS modules, locale data, and translations
+	if options.standalone == true {
+		err = handleRuntimeData(appdir)
+		if err != nil {
+			helpers.PrintError("Could not bundle locale data, gconv and NSS modules", err)
+			os.Exit(1)
+		}
+	}
+
 	// Glib 2 schemas
 	if helpers.Exists(appdir.Path + "/usr/share/glib-2.0/schemas") {
 		err = handleGlibSchemas(appdir)
@@ -221,18 +286,8 @@ func AppDirDeploy(path string) {
 		helpers.PrintError("Could not deploy Fontconfig", err)
 	}
 
-	// AppRun
-	if options.libAppRunHooks == false {
-		// If libapprun_hooks is not used
-		log.Println("Adding AppRun...")
-		err = ioutil.WriteFile(appdir.Path+"/AppRun", []byte(AppRunData), 0755)
-		if err != nil {
-			helpers.PrintError("write AppRun", err)
-			os.Exit(1)
-		}
-	} else {
-		log.Println("TODO: Add AppRun suitable for libapprun_hooks...")
-	}
+	// Python
+	handlePython(appdir)
 
 	log.Println("Find out whether Qt is a dependency of the application to be bundled...")
 
@@ -252,6 +307,15 @@ func AppDirDeploy(path string) {
 		handleQt(appdir, qtVersionDetected)
 	}
 
+	// Translations for all ELFs, including those deployed by the handlers above
+	if options.standalone == true {
+		err = handleTranslations(appdir, options.locales)
+		if err != nil {
+			helpers.PrintError("Could not bundle translations", err)
+			os.Exit(1)
+		}
+	}
+
 	fmt.Println("")
 	log.Println("libraryLocations:")
 	for _, lib := range libraryLocations {
@@ -295,12 +359,105 @@ func AppDirDeploy(path string) {
 		deployElf(lib, appdir, err)
 		patchRpathsInElf(appdir, libraryLocationsInAppDir, lib)
 
-		if strings.Contains(lib, "libQt5Core.so.5") {
+		if strings.Contains(lib, "libQt5Core.so.5") && options.qtConf == false {
 			patchQtPrfxpath(appdir, lib, libraryLocationsInAppDir, ldLinux)
 		}
 	}
 
+	if qtVersionDetected >= 5 && options.qtConf == true {
+		log.Println("Writing qt.conf instead of patching qt_prfxpath...")
+		err = writeQtConf(appdir, libraryLocationsInAppDir, ldLinux)
+		if err != nil {
+			helpers.PrintError("Could not write qt.conf", err)
+			os.Exit(1)
+		}
+	}
+
+	if options.standalone == true {
+		err = patchLocalePaths(appdir)
+		if err != nil {
+			helpers.PrintError("Could not patch locale paths", err)
+			os.Exit(1)
+		}
+	}
+
+	if options.nativeAppRun == true && options.libAppRunHooks == false {
+		err = finishNativeAppRunEnv(appdir, ldLinux)
+		if err != nil {
+			helpers.PrintError("Could not write "+AppRunEnvFile, err)
+			os.Exit(1)
+		}
+	}
+
+	if options.entryPoints != "" {
+		err = handleEntryPoints(appdir, options.entryPoints, options.entryPointActions)
+		if err != nil {
+			helpers.PrintError("Could not set up entry points", err)
+			os.Exit(1)
+		}
+	}
+
+	if options.libAppRunHooks == true {
+		err = finishLibAppRunHooksEnv(appdir, ldLinux, libraryLocationsInAppDir)
+		if err == nil {
+			err = checkLibAppRunHooksLayout(appdir.Path)
+		}
+		if err != nil {
+			helpers.PrintError("libapprun_hooks", err)
+			os.Exit(1)
+		}
+	}
+
+	if options.strip != "" {
+		log.Println("Stripping ELF files in the AppDir...")
+		err = stripELFsInAppDir(appdir, options.strip, options.debugArchive)
+		if err != nil {
+			helpers.PrintError("Could not strip", err)
+			os.Exit(1)
+		}
+	}
+
 	deployCopyrightFiles(appdir)
+
+	err = checkHostCompatibility(appdir.Path, options.compatBaseline)
+	if err != nil {
+		helpers.PrintError("Host compatibility", err)
+		os.Exit(1)
+	}
+
+	err = writeSBOMs(appdir.Path, options.sbomFormats, options.embedSBOM)
+	if err != nil {
+		helpers.PrintError("Could not generate software bill of materials", err)
+		os.Exit(1)
+	}
+}
+
+// addToAppRun inserts a section with the given lines into the AppRun of the AppDir,
+// right before the main executable is launched, so that handlers can export
+// environment variables for what they have deployed
+func addToAppRun(appdir helpers.AppDir, title string, lines []string) error {
+	if options.libAppRunHooks == true {
+		return appendToEnvFile(appdir, LibAppRunHooksEnvFile, title, lines)
+	}
+	if options.nativeAppRun == true {
+		return appendToEnvFile(appdir, AppRunEnvFile, title, lines)
+	}
+	apprun, err := ioutil.ReadFile(appdir.Path + "/AppRun")
+	if err != nil {
+		return err
+	}
+	marker := "############################################################################################\n" +
+		"# Run experimental bundle"
+	if bytes.Contains(apprun, []byte(marker)) == false {
+		return errors.New("AppRun was not written by appimagetool, cannot add " + title)
+	}
+	section := "############################################################################################\n" +
+		"# " + title + "\n" +
+		"############################################################################################\n\n" +
+		strings.Join(lines, "\n") + "\n\n"
+	log.Println("Adding to AppRun:", title)
+	apprun = bytes.Replace(apprun, []byte(marker), []byte(section+marker), 1)
+	return ioutil.WriteFile(appdir.Path+"/AppRun", apprun, 0755)
 }
 
 func deployFontconfig(appdir helpers.AppDir) error {
@@ -362,6 +519,15 @@ func deployInterpreter(appdir helpers.AppDir) (string, error) {
 			helpers.PrintError("Could not copy ld-linux", err)
 			return "", err
 		}
+		if muslArch != "" {
+			// musl has no gconv modules
+			log.Println("Patching the musl dynamic loader...")
+			err = patchMuslLoader(ldTargetPath)
+			if err == nil {
+				err = os.Chmod(ldTargetPath, 0755)
+			}
+			return ldLinux, err
+		}
 		// Do what we do in the Scribus AppImage script, namely
 		// sed -i -e 's|/usr|/xxx|g' lib/x86_64-linux-gnu/ld-linux-x86-64.so.2
 		log.Println("Patching ld-linux...")
@@ -381,20 +547,8 @@ func deployInterpreter(appdir helpers.AppDir) (string, error) {
 			helpers.PrintError("PatchFile", err)
 			return "", err
 		}
-		log.Println("Determining gconv (for GCONV_PATH)...")
-		// Search in all of the system's library directories for a directory called gconv
-		// and put it into the a location which matches the GCONV_PATH we export in AppRun
-		gconvs, err := findWithPrefixInLibraryLocations("gconv")
-		if err == nil {
-			// Target location must match GCONV_PATH exported in AppRun
-			determineELFsInDirTree(appdir, gconvs[0])
-		}
+		// gconv modules are bundled by handleRuntimeData
 
-		if err != nil {
-			helpers.PrintError("Could not deploy the interpreter", err)
-			os.Exit(1)
-		}
-		
 		// Make ld-linux executable
 		err = os.Chmod(ldTargetPath, 0755)
 		if err != nil {
@@ -418,6 +572,13 @@ func deployElf(lib string, appdir helpers.AppDir, err error) {
 	}
 
 	log.Println("Working on", lib)
+	if linked, err := deployMuslLibc(appdir, lib); linked == true {
+		if err != nil {
+			helpers.PrintError("Could not link musl libc", err)
+			os.Exit(1)
+		}
+		return
+	}
 	if strings.HasPrefix(lib, appdir.Path) == false { // Do not copy if it is already in the AppDir
 		libTargetPath := appdir.Path + "/" + lib
 		if options.libAppRunHooks && checkWhetherPartOfLibc(lib) == true {
@@ -467,13 +628,7 @@ func patchQtPrfxpath(appdir helpers.AppDir, lib string, libraryLocationsInAppDir
 	*/
 	// Note: The following is correct only if we bundle (and run through) ld-linux; in all other cases
 	// we should calculate the relative path relative to the main binary
-	var qtPrefixDir string
-	for _, libraryLocationInAppDir := range libraryLocationsInAppDir {
-		if strings.HasSuffix(libraryLocationInAppDir, "/plugins/platforms") {
-			qtPrefixDir = filepath.Dir(filepath.Dir(libraryLocationInAppDir))
-			break
-		}
-	}
+	qtPrefixDir := findQtPrefixDirInAppDir(libraryLocationsInAppDir)
 	if qtPrefixDir == "" {
 		helpers.PrintError("Could not determine the the Qt prefix directory:", err)
 		os.Exit(1)
@@ -525,13 +680,37 @@ func deployCopyrightFiles(appdir helpers.AppDir) {
 
 		if shouldDoIt == true && strings.HasPrefix(lib, appdir.Path) == false {
 			// Copy copyright files into the AppImage
-			copyrightFile, err := getCopyrightFile(lib)
-			// It is perfectly fine for this to error - on non-dpkg systems, or if lib was not in a deb package
-			if err == nil {
+			cfs, err := getCopyrightFiles(lib)
+			// This can error, e.g., if lib was not installed by the package manager
+			// or if its package has no copyright files;
+			// we collect those and report them below rather than silently skipping them
+			if e, ok := err.(noCopyrightFilesError); ok == true {
+				packagesWithoutCopyrightFiles = helpers.AppendIfMissing(packagesWithoutCopyrightFiles, e.pkg)
+				continue
+			} else if err != nil {
+				filesWithUnknownOrigin = helpers.AppendIfMissing(filesWithUnknownOrigin, lib)
+				continue
+			}
+			for _, copyrightFile := range cfs {
 				os.MkdirAll(filepath.Dir(appdir.Path+copyrightFile), 0755)
 				copy.Copy(copyrightFile, appdir.Path+copyrightFile)
 			}
-
+		}
+	}
+	if pm := getPackageManager(); pm == nil {
+		log.Println("No supported package manager (dpkg, rpm, pacman, apk) found, hence not deploying copyright files")
+	} else {
+		for _, pkg := range packagesWithoutCopyrightFiles {
+			log.Println("Package", pkg, "ships no copyright file")
+		}
+		if len(filesWithUnknownOrigin) > 0 {
+			log.Println("Could not determine the package using", pm.Name(), "for:")
+			for _, f := range filesWithUnknownOrigin {
+				fmt.Println(f)
+			}
+		}
+		if len(packagesWithoutCopyrightFiles) > 0 || len(filesWithUnknownOrigin) > 0 {
+			log.Println("Please make sure to add the copyright information for those manually")
 		}
 	}
 	log.Println("Done")
@@ -540,11 +719,6 @@ func deployCopyrightFiles(appdir helpers.AppDir) {
 		fmt.Println("LD_LIBRARY_PATH='' find " + appdir.Path + " -type f -exec ldd {} 2>&1 \\; | grep '=>' | grep -v " + appdir.Path)
 	}
 
-	if options.libAppRunHooks == true {
-		log.Println("The option '-m' was used. Hence, you need to manually add AppRun, .env, and libapprun_hooks.so")
-		log.Println("from https://github.com/AppImageCrafters/AppRun/releases/tag/continuous. TODO: Automate this")
-	}
-
 }
 
 // handleGlibSchemas compiles GLib schemas if the subdirectory is present in the AppImage.
@@ -719,6 +893,10 @@ func patchRpathsInElf(appdir helpers.AppDir, libraryLocationsInAppDir []string,
 		log.Println("Not writing rpath because file is part of the libc family of libraries")
 		return
 	}
+	if isMuslLibc(path) {
+		log.Println("Not writing rpath because file is musl libc")
+		return
+	}
 
 	if strings.HasPrefix(filepath.Base(path), "ld-") == true {
 		log.Println("Not writing rpath in", path, "because its name starts with ld-...")
@@ -1016,6 +1194,14 @@ func findLibrary(filename string) (string, error) {
 		}
 	}
 
+	// musl looks for libraries in the locations in /etc/ld-musl-<arch>.path instead
+	muslPathFiles, _ := filepath.Glob("/etc/ld-musl-*.path")
+	for _, muslPathFile := range muslPathFiles {
+		for _, loc := range getDirsFromMuslPath(muslPathFile) {
+			libraryLocations = helpers.AppendIfMissing(libraryLocations, filepath.Clean(loc))
+		}
+	}
+
 	// Also look for libraries in in LD_LIBRARY_PATH
 	ldpstr := os.Getenv("LD_LIBRARY_PATH")
 	ldps := strings.Split(ldpstr, ":")
@@ -1068,66 +1254,6 @@ func PatchFile(path string, search string, replace string) error {
 	return nil
 }
 
-func getCopyrightFile(path string) (string, error) {
-
-	var copyrightFile string
-
-	if helpers.IsCommandAvailable("dpkg") == false {
-		return copyrightFile, errors.New("dpkg not found, hence not deploying copyright files")
-	}
-
-	if helpers.IsCommandAvailable("dpkg-query") == false {
-		return copyrightFile, errors.New("dpkg-query not found, hence not deploying copyright files")
-	}
-
-	// Find out which package the file being deployed belongs to
-	var packageContainingTheSO string
-	pkg, ok := packagesContainingFiles[path]
-	if ok == true {
-		packageContainingTheSO = pkg
-	} else {
-		cmd := exec.Command("dpkg", "-S", path)
-		// log.Println("Find out which package the file being deployed belongs to using", cmd.String())
-		result, err := cmd.Output()
-		if err != nil {
-			return copyrightFile, err
-		}
-		parts := strings.Split(strings.TrimSpace(string(result)), ":")
-		packageContainingTheSO = parts[0]
-	}
-
-	// Find out the copyright file in that package
-	// We are caching the results so that multiple packages belonging to the same package have to run dpkg-query only once
-	// So first we check whether we already know it
-	cf, ok := copyrightFiles[packageContainingTheSO]
-	if ok == true {
-		return cf, nil
-	}
-
-	cmd := exec.Command("dpkg-query", "-L", packageContainingTheSO)
-	// log.Println("Find out the copyright file in that package using", cmd.String())
-	output, err := cmd.Output()
-	if err != nil {
-		return copyrightFile, err
-	}
-
-	lines := strings.Split(string(output), "\n")
-	for _, line := range lines {
-		packagesContainingFiles[strings.TrimSpace(line)] = packageContainingTheSO
-		if strings.Contains(line, "usr/share/doc") && strings.Contains(line, "copyright") {
-			copyrightFile = strings.TrimSpace(line)
-		}
-	}
-	if copyrightFile == "" {
-		return copyrightFile, errors.New("could not determine the copyright file")
-	} else {
-		// log.Println("Copyright file:", copyrightFile)
-		copyrightFiles[packageContainingTheSO] = copyrightFile
-	}
-
-	return copyrightFile, nil
-}
-
 // Let's see in how many lines of code we can re-implement the guts of linuxdeployqt
 func handleQt(appdir helpers.AppDir, qtVersion int) {
 
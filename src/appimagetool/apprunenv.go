@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/probonopd/go-appimage/internal/helpers"
+)
+
+// With --native-apprun, the compiled AppRun from src/apprun is used instead of AppRunData.
+// Rather than the shell script searching the AppDir at every launch, deploy determines
+// what the bundle needs and writes it into AppRun.env, which the compiled AppRun reads.
+// The handlers keep using addToAppRun with shell export lines, which get converted.
+
+// AppRunEnvFile is the name of the file in the AppDir that the compiled AppRun reads
+const AppRunEnvFile = "AppRun.env"
+
+// nativeAppRunName is the name of the compiled AppRun next to appimagetool or on the $PATH
+const nativeAppRunName = "apprun"
+
+// installNativeAppRun copies the compiled AppRun into the AppDir
+// and writes the part of AppRun.env that is known before deploying
+func installNativeAppRun(appdir helpers.AppDir) error {
+	helpers.AddHereToPath()
+	apprun, err := exec.LookPath(nativeAppRunName)
+	if err != nil {
+		return errors.New(nativeAppRunName + " not found next to appimagetool or on the $PATH, it is built from src/apprun")
+	}
+	log.Println("Adding compiled AppRun from", apprun+"...")
+	if helpers.Exists(appdir.Path + "/AppRun") {
+		err = os.Remove(appdir.Path + "/AppRun")
+		if err != nil {
+			return err
+		}
+	}
+	err = helpers.CopyFile(apprun, appdir.Path+"/AppRun")
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(appdir.Path+"/AppRun", 0755)
+	if err != nil {
+		return err
+	}
+
+	main, err := filepath.Rel(appdir.Path, appdir.MainExecutable)
+	if err != nil {
+		return err
+	}
+	lines := []string{
+		"# Generated by appimagetool deploy, read by AppRun",
+		"APPRUN_EXEC=" + main,
+		// The main executable may have had /usr patched to ././
+		"APPRUN_WORKDIR=usr",
+	}
+	var paths []string
+	for _, dir := range []string{"usr/bin", "usr/sbin", "usr/games", "bin", "sbin"} {
+		if helpers.IsDirectory(appdir.Path + "/" + dir) {
+			paths = append(paths, "$APPDIR/"+dir)
+		}
+	}
+	lines = append(lines, "", "# Use bundled paths", "PATH="+strings.Join(append(paths, "$PATH"), ":"))
+	if helpers.IsDirectory(appdir.Path + "/usr/share") {
+		lines = append(lines, "XDG_DATA_DIRS=$APPDIR/usr/share:$XDG_DATA_DIRS")
+	}
+	return ioutil.WriteFile(appdir.Path+"/"+AppRunEnvFile, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// appendToEnvFile adds a section with the given shell export lines to the env file in the AppDir
+// (AppRun.env for the compiled AppRun, .env for libapprun_hooks)
+func appendToEnvFile(appdir helpers.AppDir, envFile string, title string, lines []string) error {
+	section := "\n# " + title + "\n"
+	for _, line := range lines {
+		converted, err := shellExportToAppRunEnv(line)
+		if err != nil {
+			return err
+		}
+		section = section + converted + "\n"
+	}
+	f, err := os.OpenFile(appdir.Path+"/"+envFile, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	log.Println("Adding to", envFile+":", title)
+	_, err = f.WriteString(section)
+	return err
+}
+
+// shellExportToAppRunEnv converts a line like
+// export GTK_PATH="${HERE}"/usr/lib/gtk-4.0:"${GTK_PATH}"
+// into the equivalent env file line
+// GTK_PATH=$APPDIR/usr/lib/gtk-4.0:$GTK_PATH
+func shellExportToAppRunEnv(line string) (string, error) {
+	if strings.HasPrefix(line, "export ") == false || strings.Contains(line, "=") == false {
+		return "", errors.New("cannot convert to env file: " + line)
+	}
+	line = strings.TrimPrefix(line, "export ")
+	for _, here := range []string{"\"${HERE}\"", "\"$HERE\"", "${HERE}", "$HERE"} {
+		line = strings.Replace(line, here, "$APPDIR", -1)
+	}
+	line = strings.Replace(line, "\"", "", -1)
+	// Not every AppRun supports the ${NAME} form
+	return bracedVariableRegexp.ReplaceAllString(line, "$$$1"), nil
+}
+
+var bracedVariableRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// finishNativeAppRunEnv adds what the AppRun shell script would find at runtime to AppRun.env,
+// but only what is actually in the AppDir
+func finishNativeAppRunEnv(appdir helpers.AppDir, ldLinux string) error {
+	var lines []string
+	if len(helpers.FilesWithPrefixInDirectory(appdir.Path+"/usr/lib", "python")) > 0 {
+		lines = append(lines, "export PYTHONHOME=\"${HERE}\"/usr/")
+	}
+	if helpers.IsDirectory(appdir.Path + "/usr/share/tcltk/tcl8.6") {
+		lines = append(lines,
+			"export TCL_LIBRARY=\"${HERE}\"/usr/share/tcltk/tcl8.6:$TCL_LIBRARY:$TK_LIBRARY",
+			"export TK_LIBRARY=\"${HERE}\"/usr/share/tcltk/tk8.6:$TK_LIBRARY:$TCL_LIBRARY")
+	}
+	if gst := findInAppDir(appdir, "libgstcoreelements.so", false, ""); gst != "" {
+		lines = append(lines,
+			"export GST_PLUGIN_PATH=\"${HERE}\"/"+filepath.Dir(gst),
+			"export GST_PLUGIN_SYSTEM_PATH=\"${HERE}\"/"+filepath.Dir(gst))
+		if scanner := findInAppDir(appdir, "gst-plugin-scanner", false, ""); scanner != "" {
+			lines = append(lines, "export GST_PLUGIN_SCANNER=\"${HERE}\"/"+scanner)
+		}
+	}
+	if len(lines) > 0 {
+		err := appendToEnvFile(appdir, AppRunEnvFile, "Use bundled components", lines)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Run the self-contained bundle with the bundled ld-linux
+	ldLinuxInAppDir := ""
+	for _, candidate := range []string{ldLinux, "/" + LibcDir + ldLinux} {
+		if ldLinux != "" && helpers.Exists(appdir.Path+candidate) {
+			ldLinuxInAppDir = strings.TrimPrefix(candidate, "/")
+		}
+	}
+	if options.standalone == false || ldLinuxInAppDir == "" {
+		return nil
+	}
+	lines = []string{}
+	if helpers.IsDirectory(appdir.Path + "/usr/lib/gconv") {
+		lines = append(lines, "export GCONV_PATH=\"$HERE/usr/lib/gconv\"")
+	}
+	if helpers.Exists(appdir.Path + "/etc/fonts/fonts.conf") {
+		lines = append(lines, "export FONTCONFIG_FILE=\"$HERE/etc/fonts/fonts.conf\"")
+	}
+	if len(helpers.FilesWithPrefixInDirectory(appdir.Path+"/usr/share/themes", "Default")) > 0 {
+		lines = append(lines, "export GTK_EXE_PREFIX=\"$HERE/usr\"", "export GTK_THEME=Default")
+	}
+	if loaders := findInAppDir(appdir, "loaders", true, "gdk-pixbuf"); loaders != "" {
+		lines = append(lines, "export GDK_PIXBUF_MODULEDIR=\"$HERE\"/"+loaders)
+		if helpers.Exists(appdir.Path + "/" + filepath.Dir(loaders) + "/loaders.cache") {
+			lines = append(lines, "export GDK_PIXBUF_MODULE_FILE=\"$HERE\"/"+filepath.Dir(loaders)+"/loaders.cache")
+		}
+	}
+	if helpers.IsDirectory(appdir.Path+"/usr/share/perl5") || helpers.IsDirectory(appdir.Path+"/usr/lib/perl5") {
+		lines = append(lines, "export PERLLIB=\"${HERE}\"/usr/share/perl5/:\"${HERE}\"/usr/lib/perl5/:\"${PERLLIB}\"")
+	}
+	if helpers.IsDirectory(appdir.Path + "/usr/share/glib-2.0/schemas") {
+		lines = append(lines, "export GSETTINGS_SCHEMA_DIR=\"${HERE}\"/usr/share/glib-2.0/schemas/:\"${GSETTINGS_SCHEMA_DIR}\"")
+	}
+	if len(lines) > 0 {
+		err := appendToEnvFile(appdir, AppRunEnvFile, "Self-contained bundle", lines)
+		if err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(appdir.Path+"/"+AppRunEnvFile, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString("\n# Run with the bundled dynamic loader\nAPPRUN_LD_LINUX=" + ldLinuxInAppDir + "\n")
+	return err
+}
+
+// findInAppDir returns the path relative to the AppDir of the first file
+// (or directory if isDir is true) with the given name whose path contains pathContains, or ""
+func findInAppDir(appdir helpers.AppDir, name string, isDir bool, pathContains string) string {
+	var result string
+	filepath.Walk(appdir.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil || result != "" {
+			return nil
+		}
+		if info.Name() == name && info.IsDir() == isDir && strings.Contains(path, pathContains) {
+			result, _ = filepath.Rel(appdir.Path, path)
+		}
+		return nil
+	})
+	return result
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/adrg/xdg"
+	"github.com/probonopd/go-appimage/internal/helpers"
+)
+
+// libapprun_hooks (https://github.com/AppImageCrafters/AppRun) consists of an AppRun and
+// libapprun_hooks.so which gets preloaded into the application. It uses the libc family of
+// libraries bundled in LibcDir only if they are newer than the ones on the target system,
+// and restores the environment of the target system for processes the application launches.
+// AppRun reads its configuration from the .env file in the AppDir.
+// Since deploy runs without network access in many build environments, AppRun and
+// libapprun_hooks.so are taken from a local directory (--libapprun_hooks_dir)
+// or from the cache directory rather than being downloaded.
+
+// LibAppRunHooksEnvFile is the name of the file in the AppDir that the libapprun_hooks AppRun reads
+const LibAppRunHooksEnvFile = ".env"
+
+// libAppRunHooksLibrary is the name of the library that gets preloaded
+const libAppRunHooksLibrary = "libapprun_hooks.so"
+
+// libAppRunHooksDir is where AppRun and libapprun_hooks.so are taken from if --libapprun_hooks_dir is not given
+var libAppRunHooksDir = xdg.CacheHome + "/appimagetool/libapprun_hooks"
+
+var glibcVersionRegexp = regexp.MustCompile(`GNU C Library [^\n]*version ([0-9]+\.[0-9]+)`)
+
+// findLibAppRunHooksFile returns the path of the file with the given name in dir,
+// also considering the names used for the release assets (e.g., AppRun-Release-x86_64)
+func findLibAppRunHooksFile(dir string, name string, arch string) (string, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for _, candidate := range []string{name, base + "-" + arch + ext, base + "-Release-" + arch + ext} {
+		if helpers.Exists(dir + "/" + candidate) {
+			return dir + "/" + candidate, nil
+		}
+	}
+	return "", errors.New(name + " for " + arch + " not found in " + dir +
+		", please download it from https://github.com/AppImageCrafters/AppRun/releases and put it there" +
+		" or use --libapprun_hooks_dir")
+}
+
+// installLibAppRunHooks copies AppRun and libapprun_hooks.so into the AppDir
+// and writes the part of the .env that is known before deploying
+func installLibAppRunHooks(appdir helpers.AppDir, dir string) error {
+	if dir == "" {
+		dir = libAppRunHooksDir
+	}
+	arch, err := helpers.GetElfArchitecture(appdir.MainExecutable)
+	if err != nil {
+		return err
+	}
+
+	apprun, err := findLibAppRunHooksFile(dir, "AppRun", arch)
+	if err != nil {
+		return err
+	}
+	lib, err := findLibAppRunHooksFile(dir, libAppRunHooksLibrary, arch)
+	if err != nil {
+		return err
+	}
+	log.Println("Adding libapprun_hooks AppRun from", apprun+"...")
+	if helpers.Exists(appdir.Path + "/AppRun") {
+		err = os.Remove(appdir.Path + "/AppRun")
+		if err != nil {
+			return err
+		}
+	}
+	err = helpers.CopyFile(apprun, appdir.Path+"/AppRun")
+	if err == nil {
+		err = os.Chmod(appdir.Path+"/AppRun", 0755)
+	}
+	if err != nil {
+		return err
+	}
+	log.Println("Adding", libAppRunHooksLibrary, "from", lib+"...")
+	err = os.MkdirAll(appdir.Path+"/usr/lib", 0755)
+	if err != nil {
+		return err
+	}
+	err = helpers.CopyFile(lib, appdir.Path+"/usr/lib/"+libAppRunHooksLibrary)
+	if err != nil {
+		return err
+	}
+
+	main, err := filepath.Rel(appdir.Path, appdir.MainExecutable)
+	if err != nil {
+		return err
+	}
+	lines := []string{
+		"# Generated by appimagetool deploy, read by AppRun",
+		"APPDIR=$ORIGIN",
+		"EXEC_PATH=$APPDIR/" + main,
+		"EXEC_ARGS=$@",
+		"LD_PRELOAD=$APPDIR/usr/lib/" + libAppRunHooksLibrary,
+		"PATH=$APPDIR/usr/bin:$PATH",
+		"XDG_DATA_DIRS=$APPDIR/usr/share:$XDG_DATA_DIRS",
+	}
+	return ioutil.WriteFile(appdir.Path+"/"+LibAppRunHooksEnvFile, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// finishLibAppRunHooksEnv adds the library paths and the libc information to the .env
+func finishLibAppRunHooksEnv(appdir helpers.AppDir, ldLinux string, libraryLocationsInAppDir []string) error {
+	var appdirLibraryPath []string
+	for _, loc := range libraryLocationsInAppDir {
+		rel, err := filepath.Rel(appdir.Path, loc)
+		if err != nil || strings.HasPrefix(rel, LibcDir+"/") || helpers.IsDirectory(loc) == false {
+			continue
+		}
+		appdirLibraryPath = helpers.AppendIfMissing(appdirLibraryPath, "$APPDIR/"+rel)
+	}
+
+	var libcLibraryPath []string
+	libcVersion := ""
+	filepath.Walk(appdir.Path+"/"+LibcDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.Contains(info.Name(), ".so") == false {
+			return nil
+		}
+		rel, _ := filepath.Rel(appdir.Path, filepath.Dir(path))
+		libcLibraryPath = helpers.AppendIfMissing(libcLibraryPath, "$APPDIR/"+rel)
+		if strings.HasPrefix(info.Name(), "libc.so.") {
+			libcVersion = getGlibcVersion(path)
+		}
+		return nil
+	})
+
+	lines := []string{"", "# Libraries", "APPDIR_LIBRARY_PATH=" + strings.Join(appdirLibraryPath, ":")}
+	if len(libcLibraryPath) > 0 {
+		// Used only if the bundled libc is newer than the one on the target system
+		lines = append(lines, "LIBC_LIBRARY_PATH="+strings.Join(libcLibraryPath, ":"))
+		if libcVersion != "" {
+			lines = append(lines, "APPDIR_LIBC_VERSION="+libcVersion)
+		} else {
+			log.Println("Could not determine the version of the bundled libc")
+		}
+		if ldLinux != "" && helpers.Exists(appdir.Path+"/"+LibcDir+ldLinux) {
+			lines = append(lines, "APPDIR_LIBC_LINKER_PATH="+LibcDir+ldLinux)
+		}
+	}
+	f, err := os.OpenFile(appdir.Path+"/"+LibAppRunHooksEnvFile, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(strings.Join(lines, "\n") + "\n")
+	return err
+}
+
+// getGlibcVersion returns the version of the glibc at path, e.g., "2.31", or ""
+func getGlibcVersion(path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	match := glibcVersionRegexp.FindSubmatch(data)
+	if match == nil {
+		return ""
+	}
+	return string(match[1])
+}
+
+// checkLibAppRunHooksLayout checks whether the AppDir has everything libapprun_hooks needs
+func checkLibAppRunHooksLayout(appdirPath string) error {
+	log.Println("Checking the libapprun_hooks layout of", appdirPath+"...")
+	var problems []string
+	if helpers.Exists(appdirPath+"/AppRun") == false {
+		problems = append(problems, "AppRun is missing")
+	} else if _, err := helpers.GetElfArchitecture(appdirPath + "/AppRun"); err != nil {
+		problems = append(problems, "AppRun is not the libapprun_hooks AppRun (not an ELF file)")
+	}
+
+	f, err := os.Open(appdirPath + "/" + LibAppRunHooksEnvFile)
+	if err != nil {
+		return errors.New(LibAppRunHooksEnvFile + " is missing")
+	}
+	env := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "=", 2)
+		if len(parts) == 2 && strings.HasPrefix(parts[0], "#") == false {
+			env[parts[0]] = parts[1]
+		}
+	}
+	f.Close()
+	for _, key := range []string{"EXEC_PATH", "LD_PRELOAD"} {
+		value, ok := env[key]
+		if ok == false {
+			problems = append(problems, LibAppRunHooksEnvFile+" does not contain "+key)
+			continue
+		}
+		path := strings.Replace(value, "$APPDIR", appdirPath, 1)
+		if helpers.Exists(path) == false {
+			problems = append(problems, key+" points to "+value+" which does not exist")
+		}
+	}
+
+	// The libc family of libraries must only be in LibcDir, otherwise it is always used,
+	// even if the target system has a newer one
+	filepath.Walk(appdirPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(appdirPath, path)
+		if info.IsDir() && rel == LibcDir {
+			return filepath.SkipDir
+		}
+		if info.IsDir() == false && strings.Contains(info.Name(), ".so") && checkWhetherPartOfLibc(path) {
+			problems = append(problems, rel+" is part of the libc family of libraries but not in "+LibcDir+"/")
+		}
+		return nil
+	})
+
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			log.Println(problem)
+		}
+		return errors.New("the AppDir is not set up correctly for libapprun_hooks")
+	}
+	return nil
+}
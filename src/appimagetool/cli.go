@@ -29,11 +29,72 @@ func bootstrapAppImageDeploy(c *cli.Context) error {
 		log.Println(os.Args[0], "appdir/usr/share/applications/myapp.desktop")
 		log.Fatal("Terminated.")
 	}
+	setDeployOptions(c)
+	AppDirDeploy(c.Args().Get(0))
+	return nil
+}
+
+// setDeployOptions sets the options for AppDirDeploy from the command line flags
+// 		Args: c: cli.Context
+func setDeployOptions(c *cli.Context) {
+	formats, err := parseSBOMFormats(c.String("sbom"))
+	if err != nil {
+		log.Fatal(err)
+	}
 	options = DeployOptions{
-		standalone:     c.Bool("standalone"),
-		libAppRunHooks: c.Bool("libapprun_hooks"),
+		standalone:        c.Bool("standalone"),
+		libAppRunHooks:    c.Bool("libapprun_hooks"),
+		qtConf:            c.Bool("qtconf"),
+		sbomFormats:       formats,
+		embedSBOM:         c.Bool("embed-sbom"),
+		compatBaseline:    c.String("compat-baseline"),
+		strip:             c.String("strip"),
+		debugArchive:      c.String("debug-archive"),
+		nativeAppRun:      c.Bool("native-apprun"),
+		libAppRunHooksDir: c.String("libapprun_hooks_dir"),
+		entryPoints:       c.String("entrypoints"),
+		entryPointActions: c.Bool("entrypoint-actions"),
+		locales:           parseLocales(c.String("locales")),
+		dlopenHints:       c.String("dlopen-hints"),
 	}
-	AppDirDeploy(c.Args().Get(0))
+	// Splitting off debug information implies stripping it
+	if options.debugArchive != "" && options.strip == "" {
+		options.strip = "debug"
+	}
+	if options.entryPointActions == true && options.libAppRunHooks == true {
+		log.Fatal("--entrypoint-actions cannot be used with --libapprun_hooks, whose AppRun cannot dispatch to entry points")
+	}
+	// Fail before deploying rather than after it
+	if options.strip != "" {
+		err = checkStripMode(options.strip)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// bootstrapAppDirFromPackages unpacks .deb and .rpm packages into an AppDir
+// and deploys it
+// 		Args: c: cli.Context
+func bootstrapAppDirFromPackages(c *cli.Context) error {
+	if c.NArg() < 1 {
+		log.Fatal("Please specify the path to one or more .deb or .rpm packages")
+	}
+	appdirPath := c.String("appdir")
+	if appdirPath == "" {
+		appdirPath = packageNameFromFileName(c.Args().Get(0)) + ".AppDir"
+	}
+	appdirPath, err := filepath.Abs(appdirPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	desktopFilePath, err := appDirFromPackages(c.Args().Slice(), appdirPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	setDeployOptions(c)
+	AppDirDeploy(desktopFilePath)
+	log.Println("The AppDir is ready, run", os.Args[0], appdirPath, "to create the AppImage")
 	return nil
 }
 
@@ -84,6 +145,56 @@ func bootstrapSetupSigning(c *cli.Context) error {
 	return setupSigning(c.Bool("overwrite"))
 }
 
+// bootstrapAppImageSBOM extracts the software bill of materials
+// embedded in an AppImage into the current directory
+// 		Args: c: cli.Context
+func bootstrapAppImageSBOM(c *cli.Context) error {
+	if c.NArg() != 1 {
+		log.Fatal("Please specify the file path to an AppImage to extract the software bill of materials from")
+	}
+	fileToAppImage := c.Args().Get(0)
+
+	// does the file exist? if not early-exit
+	if !helpers.CheckIfFileExists(fileToAppImage) {
+		log.Fatal("The specified file could not be found")
+	}
+
+	written, err := extractSBOMs(fileToAppImage)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, w := range written {
+		log.Println("Extracted", w)
+	}
+	return nil
+}
+
+// bootstrapDlopenTrace runs the main executable of an AppDir and writes
+// the libraries it loads with dlopen into the hint file in the AppDir
+// 		Args: c: cli.Context
+func bootstrapDlopenTrace(c *cli.Context) error {
+	if c.NArg() < 1 {
+		log.Fatal("Please specify the path to an AppDir to trace")
+	}
+	desktopFile, err := findDesktopFileInAppDir(c.Args().Get(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	appdir, err := helpers.NewAppDir(desktopFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	added, err := writeDlopenHints(appdir, c.Args().Slice()[1:], time.Duration(c.Int("seconds"))*time.Second)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, lib := range added {
+		log.Println("Recorded", lib)
+	}
+	log.Println("Recorded", len(added), "libraries in", appdir.Path+"/"+DlopenHintsFile)
+	return nil
+}
+
 // bootstrapAppImageSections is a function which converts cli.Context to
 // string based arguments. Wrapper function to show the sections of the AppImage
 // 		Args: c: cli.Context
@@ -168,6 +279,32 @@ func bootstrapAppImageBuild(c *cli.Context) error {
 	// Check if is directory, then assume we want to convert an AppDir into an AppImage
 	fileToAppDir, _ = filepath.EvalSymlinks(fileToAppDir)
 	if info, err := os.Stat(fileToAppDir); err == nil && info.IsDir() {
+		// Generate the software bill of materials before the AppDir is squashed
+		// so that it can be embedded
+		formats, err := parseSBOMFormats(c.String("sbom"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = writeSBOMs(fileToAppDir, formats, c.Bool("embed-sbom"))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// Check AppDirs that use libapprun_hooks
+		if helpers.Exists(fileToAppDir + "/usr/lib/" + libAppRunHooksLibrary) {
+			err = checkLibAppRunHooksLayout(fileToAppDir)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if c.Bool("dedup") == true {
+			_, err = deduplicateAppDir(fileToAppDir)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
 		// Generate the AppImage
 		// for optimum performance, the following default parameters are passed
 		// fileToAppDir: 				fileToAppDir
@@ -248,6 +385,36 @@ func main() {
 			Usage:  "Prepare a git repository that is used with Travis CI for signing AppImages",
 			Action: bootstrapSetupSigning,
 		},
+		{
+			Name:   "sbom",
+			Usage:  "Extract the software bill of materials embedded in an AppImage",
+			Action: bootstrapAppImageSBOM,
+		},
+		{
+			Name:      "from-package",
+			Usage:     "Unpack .deb and .rpm packages into an AppDir and deploy it",
+			ArgsUsage: "PACKAGE [PACKAGE...]",
+			Action:    bootstrapAppDirFromPackages,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "appdir",
+					Usage: "Path of the AppDir to be created (default: <name of the first package>.AppDir)",
+				},
+			},
+		},
+		{
+			Name:      "dlopen-trace",
+			Usage:     "Run the application and record the libraries it loads with dlopen in " + DlopenHintsFile + " in the AppDir",
+			ArgsUsage: "APPDIR [ARGUMENTS...]",
+			Action:    bootstrapDlopenTrace,
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:  "seconds",
+					Value: 10,
+					Usage: "How long to run the application",
+				},
+			},
+		},
 		{
 			Name:   "sections",
 			Usage:  "",
@@ -262,6 +429,10 @@ func main() {
 			Aliases: []string{"l"},
 			Usage:   "Use libapprun_hooks",
 		},
+		&cli.StringFlag{
+			Name:  "libapprun_hooks_dir",
+			Usage: "Directory containing AppRun and libapprun_hooks.so from https://github.com/AppImageCrafters/AppRun/releases (default: " + libAppRunHooksDir + ")",
+		},
 		&cli.BoolFlag{
 			Name:    "overwrite",
 			Aliases: []string{"o"},
@@ -272,6 +443,54 @@ func main() {
 			Aliases: []string{"s"},
 			Usage:   "Make standalone self-contained bundle",
 		},
+		&cli.BoolFlag{
+			Name:  "qtconf",
+			Usage: "Write qt.conf instead of patching qt_prfxpath in libQt5Core.so.5",
+		},
+		&cli.StringFlag{
+			Name:  "sbom",
+			Usage: "Generate a software bill of materials in the given formats (comma-separated: spdx, cyclonedx)",
+		},
+		&cli.BoolFlag{
+			Name:  "native-apprun",
+			Usage: "Use the compiled AppRun which reads AppRun.env instead of the AppRun shell script",
+		},
+		&cli.StringFlag{
+			Name:  "entrypoints",
+			Usage: "Comma-separated names of executables in usr/bin that AppRun runs when invoked by that name or with that name as the first argument, or \"all\"",
+		},
+		&cli.BoolFlag{
+			Name:  "entrypoint-actions",
+			Usage: "Add a desktop action for each entry point given with --entrypoints (not with --libapprun_hooks)",
+		},
+		&cli.StringFlag{
+			Name:  "dlopen-hints",
+			Usage: "File listing libraries, globs, and plugin directories loaded with dlopen to be deployed, in addition to " + DlopenHintsFile + " in the AppDir",
+		},
+		&cli.StringFlag{
+			Name:  "locales",
+			Usage: "Comma-separated languages (e.g., \"de,fr,pt_BR\") of the translations to be bundled in self-contained mode (default: all)",
+		},
+		&cli.BoolFlag{
+			Name:  "dedup",
+			Usage: "Replace identical files in the AppDir by links before building the AppImage",
+		},
+		&cli.StringFlag{
+			Name:  "strip",
+			Usage: "Strip the ELF files in the AppDir: 'debug' keeps .symtab, 'all' removes everything not needed to run",
+		},
+		&cli.StringFlag{
+			Name:  "debug-archive",
+			Usage: "Write the stripped debug information into a .tar.gz to be unpacked into the extracted AppImage (implies --strip debug)",
+		},
+		&cli.StringFlag{
+			Name:  "compat-baseline",
+			Usage: "Fail if the AppDir needs newer symbol versions from the target system than these (comma-separated, e.g., GLIBC_2.17,GLIBCXX_3.4.19)",
+		},
+		&cli.BoolFlag{
+			Name:  "embed-sbom",
+			Usage: "Embed the software bill of materials in the AppImage at " + SBOMDir,
+		},
 	}
 
 	// TODO: move travis based Sections to travis.go in future
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"debug/elf"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/go-version"
+)
+
+// Libraries on the excludelist (libc, libstdc++, libGL, ...) are taken from the target system
+// at runtime. The versioned symbols (e.g., memcpy@GLIBC_2.14) which the bundled ELF files
+// import from them determine the oldest target system the AppImage can run on; if the target
+// system is too old, the dynamic loader fails with "version `GLIBC_2.xx' not found".
+// Hence we determine the highest version needed for each of these symbol version prefixes.
+
+// compatSymbolVersionPrefixes are the symbol version prefixes that are analyzed,
+// and the libraries that provide them
+var compatSymbolVersionPrefixes = map[string]string{
+	"GLIBC_":   "glibc",
+	"GLIBCXX_": "libstdc++",
+	"CXXABI_":  "libstdc++",
+}
+
+// symbolVersionRequirement is the highest version of a symbol version prefix
+// needed by any ELF in the AppDir
+type symbolVersionRequirement struct {
+	Prefix  string
+	Version *version.Version
+	Symbol  string // A symbol that needs this version
+	File    string // The ELF that needs this version, relative to the AppDir
+}
+
+func (r symbolVersionRequirement) String() string {
+	return r.Prefix + r.Version.Original()
+}
+
+// analyzeSymbolVersionRequirements returns the highest versions of the symbol version prefixes
+// needed by the ELF files in the AppDir from libraries that are not bundled in the AppDir
+func analyzeSymbolVersionRequirements(appdirPath string) (map[string]*symbolVersionRequirement, error) {
+	// Libraries that are bundled satisfy their own symbol versions
+	bundled := make(map[string]bool)
+	var elfs []string
+	err := filepath.Walk(appdirPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		bundled[filepath.Base(path)] = true
+		if info.Mode().IsRegular() {
+			elfs = append(elfs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[string]*symbolVersionRequirement)
+	for _, path := range elfs {
+		e, err := elf.Open(path)
+		if err != nil {
+			// Not an ELF file
+			continue
+		}
+		symbols, err := e.ImportedSymbols()
+		e.Close()
+		if err != nil {
+			continue
+		}
+		rel, _ := filepath.Rel(appdirPath, path)
+		for _, symbol := range symbols {
+			if symbol.Library != "" && bundled[symbol.Library] == true {
+				continue
+			}
+			prefix, v, err := parseSymbolVersion(symbol.Version)
+			if err != nil {
+				// E.g., GLIBC_PRIVATE, or a library that is not analyzed
+				continue
+			}
+			current, ok := results[prefix]
+			if ok == false || v.GreaterThan(current.Version) {
+				results[prefix] = &symbolVersionRequirement{Prefix: prefix, Version: v, Symbol: symbol.Name, File: rel}
+			}
+		}
+	}
+	return results, nil
+}
+
+// parseSymbolVersion splits a symbol version such as GLIBCXX_3.4.19 into
+// one of the compatSymbolVersionPrefixes and a version
+func parseSymbolVersion(symbolVersion string) (string, *version.Version, error) {
+	for prefix := range compatSymbolVersionPrefixes {
+		if strings.HasPrefix(symbolVersion, prefix) {
+			v, err := version.NewVersion(strings.TrimPrefix(symbolVersion, prefix))
+			return prefix, v, err
+		}
+	}
+	return "", nil, errors.New("unsupported symbol version " + symbolVersion)
+}
+
+// parseCompatBaseline parses a comma-separated list of maximum symbol versions
+// such as "GLIBC_2.17,GLIBCXX_3.4.19"
+func parseCompatBaseline(baseline string) (map[string]*version.Version, error) {
+	results := make(map[string]*version.Version)
+	for _, item := range strings.Split(baseline, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		prefix, v, err := parseSymbolVersion(item)
+		if prefix == "" {
+			return nil, errors.New("unsupported baseline '" + item + "', supported are GLIBC_, GLIBCXX_, CXXABI_ followed by a version")
+		}
+		if err != nil {
+			return nil, errors.New("invalid version in baseline: " + item)
+		}
+		results[prefix] = v
+	}
+	return results, nil
+}
+
+// checkHostCompatibility reports the minimum glibc and libstdc++ versions the target system
+// needs to have to run the AppDir, and returns an error if any of them is higher than baseline
+func checkHostCompatibility(appdirPath string, baseline string) error {
+	log.Println("Determining the minimum glibc and libstdc++ versions needed on the target system...")
+	maxVersions, err := parseCompatBaseline(baseline)
+	if err != nil {
+		return err
+	}
+	requirements, err := analyzeSymbolVersionRequirements(appdirPath)
+	if err != nil {
+		return err
+	}
+
+	var prefixes []string
+	for prefix := range requirements {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	var violations []string
+	for _, prefix := range prefixes {
+		r := requirements[prefix]
+		log.Println("Needs", compatSymbolVersionPrefixes[prefix], r.String(), "or later, e.g., for", r.Symbol, "in", r.File)
+		if max, ok := maxVersions[prefix]; ok == true && r.Version.GreaterThan(max) {
+			violations = append(violations, r.String()+" (needed by "+r.File+") is newer than the baseline "+prefix+max.Original())
+		}
+	}
+	if len(requirements) == 0 {
+		log.Println("No versioned glibc or libstdc++ symbols are needed from the target system")
+	}
+	if len(violations) > 0 {
+		for _, v := range violations {
+			log.Println(v)
+		}
+		return errors.New("the AppDir needs newer libraries than the baseline, build it on an older system")
+	}
+	return nil
+}
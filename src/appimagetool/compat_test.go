@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/probonopd/go-appimage/internal/helpers"
+)
+
+func TestSymbolVersionOrder(t *testing.T) {
+	ordered := [][]string{
+		{"GLIBC_2.2.5", "GLIBC_2.3", "GLIBC_2.9", "GLIBC_2.14", "GLIBC_2.17", "GLIBC_2.34"},
+		{"GLIBCXX_3.4", "GLIBCXX_3.4.9", "GLIBCXX_3.4.11", "GLIBCXX_3.4.19", "GLIBCXX_3.4.30"},
+		{"CXXABI_1.3", "CXXABI_1.3.5", "CXXABI_1.3.13"},
+	}
+	for _, versions := range ordered {
+		for i := 1; i < len(versions); i++ {
+			prefixA, a, err := parseSymbolVersion(versions[i-1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			prefixB, b, err := parseSymbolVersion(versions[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if prefixA != prefixB || a.LessThan(b) == false {
+				t.Error("Expected", versions[i-1], "to be older than", versions[i])
+			}
+		}
+	}
+	for _, symbolVersion := range []string{"GLIBC_PRIVATE", "GCC_3.0", "GLIBC"} {
+		if _, _, err := parseSymbolVersion(symbolVersion); err == nil {
+			t.Error("Expected", symbolVersion, "not to be a supported symbol version")
+		}
+	}
+	// GLIBC_ is not a prefix of GLIBCXX_
+	if prefix, _, _ := parseSymbolVersion("GLIBCXX_3.4.19"); prefix != "GLIBCXX_" {
+		t.Error("Expected GLIBCXX_, got", prefix)
+	}
+}
+
+func TestParseCompatBaseline(t *testing.T) {
+	for baseline, expected := range map[string]map[string]string{
+		"GLIBC_2.17":                              {"GLIBC_": "2.17"},
+		" GLIBC_2.17 , GLIBCXX_3.4.19 ":           {"GLIBC_": "2.17", "GLIBCXX_": "3.4.19"},
+		"GLIBC_2.17,GLIBCXX_3.4.19,CXXABI_1.3.7,": {"GLIBC_": "2.17", "GLIBCXX_": "3.4.19", "CXXABI_": "1.3.7"},
+		"": {},
+	} {
+		versions, err := parseCompatBaseline(baseline)
+		if err != nil || len(versions) != len(expected) {
+			t.Error("Expected", expected, "for", baseline, "got", versions, err)
+			continue
+		}
+		for prefix, v := range expected {
+			if versions[prefix] == nil || versions[prefix].Original() != v {
+				t.Error("Expected", prefix+v, "for", baseline, "got", versions[prefix])
+			}
+		}
+	}
+	for _, baseline := range []string{"GLIBC_two", "GCC_3.0", "2.17"} {
+		if _, err := parseCompatBaseline(baseline); err == nil {
+			t.Error("Expected an error for", baseline)
+		}
+	}
+}
+
+func TestCheckHostCompatibility(t *testing.T) {
+	if helpers.Exists("/usr/bin/true") == false {
+		t.Skip("/usr/bin/true is needed")
+	}
+	appdir := tempDir(t)
+	defer os.RemoveAll(appdir)
+	data, _ := ioutil.ReadFile("/usr/bin/true")
+	ioutil.WriteFile(appdir+"/true", data, 0755)
+
+	requirements, err := analyzeSymbolVersionRequirements(appdir)
+	if err != nil || requirements["GLIBC_"] == nil || requirements["GLIBC_"].File != "true" {
+		t.Fatal("Expected /usr/bin/true to need a glibc version, got", requirements, err)
+	}
+	if err := checkHostCompatibility(appdir, "GLIBC_99.0"); err != nil {
+		t.Error("Expected a future baseline to be met, got", err)
+	}
+	if err := checkHostCompatibility(appdir, "GLIBC_2.0"); err == nil {
+		t.Error("Expected GLIBC_2.0 to be too old")
+	}
+	// Bundling libc satisfies its own symbol versions
+	ioutil.WriteFile(appdir+"/libc.so.6", nil, 0644)
+	if err := checkHostCompatibility(appdir, "GLIBC_2.0"); err != nil {
+		t.Error("Expected the bundled libc to satisfy the requirements, got", err)
+	}
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/probonopd/go-appimage/internal/helpers"
+)
+
+// Copyright and license files are taken from the package manager of the build system.
+// Each package manager has its own way of telling which package a file belongs to,
+// and where that package keeps its license files. Rather than relying on the
+// command line tools of the respective package manager, the databases of
+// pacman and apk are simple enough to be read directly.
+
+// packageManager maps files on the build system to the packages they belong to
+// and to the copyright/license files of those packages
+type packageManager interface {
+	// Name returns the name of the package manager
+	Name() string
+	// Available returns true if the package manager is in use on the build system
+	Available() bool
+	// PackageContainingFile returns the name of the package that contains path
+	PackageContainingFile(path string) (string, error)
+	// CopyrightFiles returns the copyright/license files of the package
+	CopyrightFiles(pkg string) ([]string, error)
+	// PackageVersion returns the version of the installed package
+	PackageVersion(pkg string) (string, error)
+	// PackageLicense returns the license of the package as declared in the package metadata,
+	// or "" if the package manager does not record it
+	PackageLicense(pkg string) (string, error)
+}
+
+// packageManagers contains all supported package managers, in the order in which they are tried
+var packageManagers = []packageManager{&dpkgPackageManager{}, &rpmPackageManager{}, &pacmanPackageManager{}, &apkPackageManager{}}
+
+// Files for which we could not determine the package they came from
+var filesWithUnknownOrigin []string
+
+// Packages which we found but which ship no copyright files
+var packagesWithoutCopyrightFiles []string
+
+// noCopyrightFilesError is returned when a package ships no copyright files
+type noCopyrightFilesError struct {
+	pkg string
+}
+
+func (e noCopyrightFilesError) Error() string {
+	return "package " + e.pkg + " ships no copyright file"
+}
+
+// getPackageManager returns the package manager in use on the build system, or nil
+func getPackageManager() packageManager {
+	for _, pm := range packageManagers {
+		if pm.Available() == true {
+			return pm
+		}
+	}
+	return nil
+}
+
+// getCopyrightFiles returns the copyright/license files of the package which contains path
+func getCopyrightFiles(path string) ([]string, error) {
+	pm := getPackageManager()
+	if pm == nil {
+		return nil, errors.New("no supported package manager (dpkg, rpm, pacman, apk) found, hence not deploying copyright files")
+	}
+
+	// Find out which package the file being deployed belongs to
+	pkg, err := getPackageContainingFile(pm, path)
+	if err != nil {
+		return nil, err
+	}
+	return getCopyrightFilesOfPackage(pm, pkg)
+}
+
+// getPackageContainingFile returns the name of the package which contains path
+func getPackageContainingFile(pm packageManager, path string) (string, error) {
+	pkg, ok := packagesContainingFiles[path]
+	if ok == true {
+		return pkg, nil
+	}
+	pkg, err := pm.PackageContainingFile(path)
+	if err != nil {
+		// The library may be known to the package manager by its resolved path, e.g., on usrmerge systems
+		resolved, e := filepath.EvalSymlinks(path)
+		if e != nil || resolved == path {
+			return "", err
+		}
+		pkg, err = pm.PackageContainingFile(resolved)
+		if err != nil {
+			return "", err
+		}
+	}
+	packagesContainingFiles[path] = pkg
+	return pkg, nil
+}
+
+// getCopyrightFilesOfPackage returns the copyright/license files of the package pkg
+func getCopyrightFilesOfPackage(pm packageManager, pkg string) ([]string, error) {
+	// We are caching the results so that multiple files belonging to the same package
+	// have to be looked up only once
+	cfs, ok := copyrightFiles[pkg]
+	if ok == true {
+		return cfs, nil
+	}
+	cfs, err := pm.CopyrightFiles(pkg)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfs) == 0 {
+		return nil, noCopyrightFilesError{pkg}
+	}
+	copyrightFiles[pkg] = cfs
+	return cfs, nil
+}
+
+// dpkgPackageManager is used on Debian, Ubuntu, and derivatives
+type dpkgPackageManager struct{}
+
+func (dpkgPackageManager) Name() string {
+	return "dpkg"
+}
+
+func (dpkgPackageManager) Available() bool {
+	return helpers.IsCommandAvailable("dpkg") && helpers.IsCommandAvailable("dpkg-query")
+}
+
+func (dpkgPackageManager) PackageContainingFile(path string) (string, error) {
+	result, err := exec.Command("dpkg", "-S", path).Output()
+	if err != nil {
+		return "", err
+	}
+	parts := strings.Split(strings.TrimSpace(string(result)), ":")
+	return parts[0], nil
+}
+
+func (dpkgPackageManager) CopyrightFiles(pkg string) ([]string, error) {
+	output, err := exec.Command("dpkg-query", "-L", pkg).Output()
+	if err != nil {
+		return nil, err
+	}
+	var results []string
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		packagesContainingFiles[line] = pkg
+		if strings.Contains(line, "usr/share/doc") && strings.Contains(line, "copyright") {
+			results = append(results, line)
+		}
+	}
+	return results, nil
+}
+
+func (dpkgPackageManager) PackageVersion(pkg string) (string, error) {
+	output, err := exec.Command("dpkg-query", "-W", "-f=${Version}", pkg).Output()
+	return strings.TrimSpace(string(output)), err
+}
+
+func (pm dpkgPackageManager) PackageLicense(pkg string) (string, error) {
+	// dpkg does not record licenses, but machine-readable copyright files
+	// (https://www.debian.org/doc/packaging-manuals/copyright-format/1.0/) have License: fields
+	cfs, err := getCopyrightFilesOfPackage(pm, pkg)
+	if err != nil {
+		return "", err
+	}
+	var licenses []string
+	for _, cf := range cfs {
+		f, err := os.Open(cf)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), "License:") {
+				license := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "License:"))
+				if license != "" {
+					licenses = helpers.AppendIfMissing(licenses, license)
+				}
+			}
+		}
+		f.Close()
+	}
+	return strings.Join(licenses, " AND "), nil
+}
+
+// rpmPackageManager is used on Fedora, openSUSE, and derivatives
+type rpmPackageManager struct{}
+
+func (rpmPackageManager) Name() string {
+	return "rpm"
+}
+
+func (rpmPackageManager) Available() bool {
+	// rpm can be installed on non-rpm distributions, so also check for a database
+	return helpers.IsCommandAvailable("rpm") &&
+		(helpers.Exists("/var/lib/rpm") || helpers.Exists("/usr/lib/sysimage/rpm"))
+}
+
+func (rpmPackageManager) PackageContainingFile(path string) (string, error) {
+	result, err := exec.Command("rpm", "-qf", "--queryformat", "%{NAME}\n", path).Output()
+	if err != nil {
+		return "", err
+	}
+	lines := strings.Split(strings.TrimSpace(string(result)), "\n")
+	return lines[0], nil
+}
+
+func (rpmPackageManager) CopyrightFiles(pkg string) ([]string, error) {
+	// Files marked as %license in the spec file
+	output, err := exec.Command("rpm", "-q", "--licensefiles", pkg).Output()
+	if err != nil {
+		return nil, err
+	}
+	var results []string
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "/") {
+			results = append(results, line)
+		}
+	}
+	return results, nil
+}
+
+func (rpmPackageManager) PackageVersion(pkg string) (string, error) {
+	output, err := exec.Command("rpm", "-q", "--queryformat", "%{VERSION}-%{RELEASE}", pkg).Output()
+	return strings.TrimSpace(string(output)), err
+}
+
+func (rpmPackageManager) PackageLicense(pkg string) (string, error) {
+	output, err := exec.Command("rpm", "-q", "--queryformat", "%{LICENSE}", pkg).Output()
+	return strings.TrimSpace(string(output)), err
+}
+
+// pacmanPackageManager is used on Arch Linux and derivatives.
+// Its local database contains one directory per installed package
+// with a 'files' file listing the files of the package
+type pacmanPackageManager struct {
+	filesIndex   map[string]string // Key: Path of the file, value: name of the package
+	packageIndex map[string]string // Key: Name of the package, value: its directory in the database
+}
+
+const pacmanLocalDatabase = "/var/lib/pacman/local"
+
+func (pacmanPackageManager) Name() string {
+	return "pacman"
+}
+
+func (pacmanPackageManager) Available() bool {
+	return helpers.IsDirectory(pacmanLocalDatabase)
+}
+
+func (pm *pacmanPackageManager) PackageContainingFile(path string) (string, error) {
+	if pm.filesIndex == nil {
+		err := pm.readDatabase()
+		if err != nil {
+			return "", err
+		}
+	}
+	pkg, ok := pm.filesIndex[filepath.Clean(path)]
+	if ok == false {
+		return "", errors.New(path + " is not owned by any pacman package")
+	}
+	return pkg, nil
+}
+
+// readDatabase reads the %NAME% and %FILES% sections of all packages in the local database
+func (pm *pacmanPackageManager) readDatabase() error {
+	pm.filesIndex = make(map[string]string)
+	pm.packageIndex = make(map[string]string)
+	infos, err := ioutil.ReadDir(pacmanLocalDatabase)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.IsDir() == false {
+			continue
+		}
+		name, err := readPacmanDescSection(pacmanLocalDatabase+"/"+info.Name()+"/desc", "%NAME%")
+		if err != nil || len(name) == 0 {
+			continue
+		}
+		pm.packageIndex[name[0]] = pacmanLocalDatabase + "/" + info.Name()
+		files, err := readPacmanDescSection(pacmanLocalDatabase+"/"+info.Name()+"/files", "%FILES%")
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			pm.filesIndex["/"+strings.TrimSuffix(file, "/")] = name[0]
+		}
+	}
+	return nil
+}
+
+func (pm *pacmanPackageManager) CopyrightFiles(pkg string) ([]string, error) {
+	if pm.filesIndex == nil {
+		err := pm.readDatabase()
+		if err != nil {
+			return nil, err
+		}
+	}
+	// By convention, packages put their licenses into /usr/share/licenses/<pkgname>/
+	var results []string
+	for file, p := range pm.filesIndex {
+		if p == pkg && strings.HasPrefix(file, "/usr/share/licenses/") && helpers.IsDirectory(file) == false {
+			results = append(results, file)
+		}
+	}
+	// Packages under common licenses do not ship the license texts but name them in %LICENSE%;
+	// the texts are in /usr/share/licenses/common/<name>/ or, for SPDX identifiers,
+	// in /usr/share/licenses/spdx/<identifier>.txt (both from the licenses package)
+	licenses, err := pm.readPackageDescSection(pkg, "%LICENSE%")
+	if err != nil {
+		return results, nil
+	}
+	for _, license := range licenses {
+		for _, name := range strings.FieldsFunc(license, func(r rune) bool { return r == ' ' || r == '(' || r == ')' }) {
+			if name == "AND" || name == "OR" || name == "WITH" {
+				continue
+			}
+			files, _ := filepath.Glob("/usr/share/licenses/common/" + name + "/*")
+			for _, file := range files {
+				if helpers.IsDirectory(file) == false {
+					results = helpers.AppendIfMissing(results, file)
+				}
+			}
+			if file := "/usr/share/licenses/spdx/" + name + ".txt"; helpers.Exists(file) {
+				results = helpers.AppendIfMissing(results, file)
+			}
+		}
+	}
+	return results, nil
+}
+
+func (pm *pacmanPackageManager) PackageVersion(pkg string) (string, error) {
+	values, err := pm.readPackageDescSection(pkg, "%VERSION%")
+	if err != nil || len(values) == 0 {
+		return "", err
+	}
+	return values[0], nil
+}
+
+func (pm *pacmanPackageManager) PackageLicense(pkg string) (string, error) {
+	values, err := pm.readPackageDescSection(pkg, "%LICENSE%")
+	return strings.Join(values, " AND "), err
+}
+
+func (pm *pacmanPackageManager) readPackageDescSection(pkg string, section string) ([]string, error) {
+	if pm.packageIndex == nil {
+		err := pm.readDatabase()
+		if err != nil {
+			return nil, err
+		}
+	}
+	dir, ok := pm.packageIndex[pkg]
+	if ok == false {
+		return nil, errors.New(pkg + " is not installed")
+	}
+	return readPacmanDescSection(dir+"/desc", section)
+}
+
+// readPacmanDescSection returns the lines of a section like %FILES%
+// in a file of the pacman local database
+func readPacmanDescSection(path string, section string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var results []string
+	inSection := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "%") && strings.HasSuffix(line, "%") {
+			inSection = line == section
+			continue
+		}
+		if inSection && line != "" {
+			results = append(results, line)
+		}
+	}
+	return results, scanner.Err()
+}
+
+// apkPackageManager is used on Alpine Linux.
+// Its database is a single file in which each package is a block of lines
+// separated by an empty line; P: is the package name, F: a directory, R: a file in that directory
+type apkPackageManager struct {
+	filesIndex map[string]string // Key: Path of the file, value: name of the package
+	versions   map[string]string // Key: Name of the package, value: its version (V:)
+	licenses   map[string]string // Key: Name of the package, value: its license (L:)
+}
+
+const apkInstalledDatabase = "/lib/apk/db/installed"
+
+func (apkPackageManager) Name() string {
+	return "apk"
+}
+
+func (apkPackageManager) Available() bool {
+	return helpers.Exists(apkInstalledDatabase)
+}
+
+func (pm *apkPackageManager) PackageContainingFile(path string) (string, error) {
+	if pm.filesIndex == nil {
+		err := pm.readDatabase()
+		if err != nil {
+			return "", err
+		}
+	}
+	pkg, ok := pm.filesIndex[filepath.Clean(path)]
+	if ok == false {
+		return "", errors.New(path + " is not owned by any apk package")
+	}
+	return pkg, nil
+}
+
+func (pm *apkPackageManager) readDatabase() error {
+	pm.filesIndex = make(map[string]string)
+	pm.versions = make(map[string]string)
+	pm.licenses = make(map[string]string)
+	f, err := os.Open(apkInstalledDatabase)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var pkg, dir string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) < 2 || line[1] != ':' {
+			if line == "" {
+				pkg, dir = "", ""
+			}
+			continue
+		}
+		switch line[0] {
+		case 'P':
+			pkg = line[2:]
+		case 'V':
+			pm.versions[pkg] = line[2:]
+		case 'L':
+			pm.licenses[pkg] = line[2:]
+		case 'F':
+			dir = line[2:]
+		case 'R':
+			if pkg != "" {
+				pm.filesIndex["/"+dir+"/"+line[2:]] = pkg
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+func (pm *apkPackageManager) CopyrightFiles(pkg string) ([]string, error) {
+	// Alpine ships license files in /usr/share/licenses/<pkgname>/,
+	// often in the <pkgname>-doc subpackage
+	var results []string
+	for file, p := range pm.filesIndex {
+		if (p == pkg || p == pkg+"-doc") && strings.HasPrefix(file, "/usr/share/licenses/") {
+			results = append(results, file)
+		}
+	}
+	return results, nil
+}
+
+func (pm *apkPackageManager) PackageVersion(pkg string) (string, error) {
+	if pm.versions == nil {
+		err := pm.readDatabase()
+		if err != nil {
+			return "", err
+		}
+	}
+	return pm.versions[pkg], nil
+}
+
+func (pm *apkPackageManager) PackageLicense(pkg string) (string, error) {
+	if pm.licenses == nil {
+		err := pm.readDatabase()
+		if err != nil {
+			return "", err
+		}
+	}
+	return pm.licenses[pkg], nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Deploying plugins often results in the same library being copied to more than one place
+// in the AppDir. Duplicates are replaced by links to the first copy (in lexical order).
+// Relative symlinks are used where possible, but the dynamic loader determines $ORIGIN
+// of the main executable by resolving /proc/self/exe, and scripts often locate themselves
+// with readlink -f "$0", so executables and libraries with $ORIGIN-relative RPATH/RUNPATH
+// are hardlinked instead, so that each copy keeps its own location and hence its own $ORIGIN.
+// Since mksquashfs deduplicates files anyway, this makes the AppDir smaller, not the AppImage.
+
+// dedupSkipped are files in the root of the AppDir which must not be replaced
+var dedupSkipped = []string{"AppRun", ".DirIcon"}
+
+// deduplicateAppDir replaces duplicate files in the AppDir by links and returns by how many bytes
+// this reduced the size of the AppDir
+func deduplicateAppDir(appdirPath string) (int64, error) {
+	log.Println("Deduplicating files in", appdirPath+"...")
+
+	// Only files of the same size need to be hashed
+	bySize := make(map[int64][]string)
+	err := filepath.Walk(appdirPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() == false || info.Size() == 0 {
+			return nil
+		}
+		rel, _ := filepath.Rel(appdirPath, path)
+		for _, skipped := range dedupSkipped {
+			if rel == skipped {
+				return nil
+			}
+		}
+		bySize[info.Size()] = append(bySize[info.Size()], path)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var saved int64
+	for size, paths := range bySize {
+		if len(paths) < 2 {
+			continue
+		}
+		byHash := make(map[string][]string)
+		for _, path := range paths {
+			hash, err := sha256File(path)
+			if err != nil {
+				return saved, err
+			}
+			byHash[hash] = append(byHash[hash], path)
+		}
+		for _, duplicates := range byHash {
+			if len(duplicates) < 2 {
+				continue
+			}
+			sort.Strings(duplicates)
+			original := duplicates[0]
+			for _, duplicate := range duplicates[1:] {
+				if sameInode(original, duplicate) {
+					continue
+				}
+				linked, err := replaceWithLink(original, duplicate)
+				if err != nil {
+					return saved, err
+				}
+				if linked == true {
+					saved = saved + size
+				}
+			}
+		}
+	}
+	log.Println("Deduplication reduced the size of the AppDir by", saved, "bytes (the AppImage is deduplicated by mksquashfs anyway)")
+	return saved, nil
+}
+
+// replaceWithLink replaces duplicate by a link to original and returns whether it did so
+func replaceWithLink(original string, duplicate string) (bool, error) {
+	info, err := os.Stat(duplicate)
+	if err != nil {
+		return false, err
+	}
+	if needsHardlink(duplicate, info) {
+		tmp := duplicate + ".dedup"
+		err = os.Link(original, tmp)
+		if err != nil {
+			// E.g., the AppDir spans more than one file system; leave the duplicate as it is
+			log.Println("Could not hardlink", duplicate, "to", original+":", err)
+			return false, nil
+		}
+		log.Println("Hardlinking", duplicate, "to", original)
+		return true, os.Rename(tmp, duplicate)
+	}
+
+	target, err := filepath.Rel(filepath.Dir(duplicate), original)
+	if err != nil {
+		return false, err
+	}
+	// The permissions of a symlink are those of its target
+	originalInfo, err := os.Stat(original)
+	if err != nil {
+		return false, err
+	}
+	if originalInfo.Mode().Perm() != info.Mode().Perm() {
+		return false, nil
+	}
+	log.Println("Symlinking", duplicate, "to", target)
+	err = os.Remove(duplicate)
+	if err != nil {
+		return false, err
+	}
+	return true, os.Symlink(target, duplicate)
+}
+
+// needsHardlink returns true if the file at path would behave differently if it was
+// a symlink: an executable, including scripts (whose $ORIGIN or "readlink -f $0" is
+// where the symlink is resolved to) or an ELF with $ORIGIN-relative RPATH or RUNPATH
+func needsHardlink(path string, info os.FileInfo) bool {
+	if info.Mode().Perm()&0111 != 0 {
+		return true
+	}
+	e, err := elf.Open(path)
+	if err != nil {
+		// Not an ELF file
+		return false
+	}
+	defer e.Close()
+	if e.Type == elf.ET_EXEC || e.Section(".interp") != nil {
+		return true
+	}
+	for _, tag := range []elf.DynTag{elf.DT_RPATH, elf.DT_RUNPATH} {
+		values, _ := e.DynString(tag)
+		for _, value := range values {
+			if strings.Contains(value, "$ORIGIN") || strings.Contains(value, "${ORIGIN}") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func sameInode(a string, b string) bool {
+	infoA, errA := os.Stat(a)
+	infoB, errB := os.Stat(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+	statA, okA := infoA.Sys().(*syscall.Stat_t)
+	statB, okB := infoB.Sys().(*syscall.Stat_t)
+	return okA && okB && statA.Dev == statB.Dev && statA.Ino == statB.Ino
+}
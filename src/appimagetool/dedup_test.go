@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDeduplicateAppDir(t *testing.T) {
+	appdir := tempDir(t)
+	defer os.RemoveAll(appdir)
+	script := "#!/bin/sh\nHERE=$(dirname $(readlink -f \"$0\"))\n"
+	data := "the same data in more than one place"
+	for path, file := range map[string]struct {
+		data string
+		perm os.FileMode
+	}{
+		"AppRun":                {script, 0755},
+		"usr/bin/a":             {script, 0755},
+		"usr/lib/plugins/b":     {script, 0755},
+		"usr/share/a/data":      {data, 0644},
+		"usr/share/b/data":      {data, 0644},
+		"usr/share/c/data":      {data, 0600}, // The permissions of a symlink would be those of its target
+		"usr/share/a/different": {"something else entirely", 0644},
+	} {
+		os.MkdirAll(filepath.Dir(filepath.Join(appdir, path)), 0755)
+		ioutil.WriteFile(filepath.Join(appdir, path), []byte(file.data), file.perm)
+	}
+
+	saved, err := deduplicateAppDir(appdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved != int64(len(script)+len(data)) {
+		t.Error("Expected", len(script)+len(data), "bytes to be saved, got", saved)
+	}
+	// Scripts are hardlinked so that they find the files next to them
+	if info, err := os.Lstat(filepath.Join(appdir, "usr/lib/plugins/b")); err != nil || info.Mode().IsRegular() == false || sameInode(filepath.Join(appdir, "usr/bin/a"), filepath.Join(appdir, "usr/lib/plugins/b")) == false {
+		t.Error("Expected the script to be hardlinked")
+	}
+	if sameInode(filepath.Join(appdir, "AppRun"), filepath.Join(appdir, "usr/bin/a")) == true {
+		t.Error("Expected AppRun not to be replaced")
+	}
+	if target, err := os.Readlink(filepath.Join(appdir, "usr/share/b/data")); err != nil || target != "../a/data" {
+		t.Error("Expected the data file to be symlinked, got", target, err)
+	}
+	if info, err := os.Lstat(filepath.Join(appdir, "usr/share/c/data")); err != nil || info.Mode().IsRegular() == false || info.Mode().Perm() != 0600 {
+		t.Error("Expected the file with other permissions to be kept")
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/otiai10/copy"
+	"github.com/probonopd/go-appimage/internal/helpers"
+)
+
+// Deploying follows DT_NEEDED only, but frameworks load plugins and optional libraries with dlopen.
+// For the most common ones there are handlers (handleGdk, handleGStreamer, ...), for everything else
+// a hint file lists what else needs to be deployed, one entry per line:
+//
+//	# Comments and empty lines are ignored
+//	libvdpau_va_gl.so.1                        # Name of a library, searched like a DT_NEEDED one
+//	libxcb-*.so.*                              # Glob of library names, searched in the same locations
+//	/usr/lib/x86_64-linux-gnu/libfoo.so.2      # Absolute path or glob of libraries
+//	/usr/lib/x86_64-linux-gnu/foo/plugins/     # Absolute path of a plugin directory, copied as a whole
+//
+// Everything gets deployed with its dependencies. The hint file can be shipped in the AppDir
+// (DlopenHintsFile) or given with --dlopen-hints, and generated by 'appimagetool dlopen-trace',
+// which runs the application and records what it loads.
+
+// DlopenHintsFile is the name of the hint file in the root of the AppDir
+const DlopenHintsFile = ".dlopen-hints"
+
+// readDlopenHints returns the entries in the hint file at path
+func readDlopenHints(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry := strings.TrimSpace(strings.SplitN(scanner.Text(), "#", 2)[0])
+		if entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// resolveDlopenHint returns the files and directories on the build system for an entry of a hint file
+func resolveDlopenHint(entry string) ([]string, error) {
+	if filepath.IsAbs(entry) {
+		matches, err := filepath.Glob(entry)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, errors.New("nothing matches " + entry)
+		}
+		return matches, nil
+	}
+	if strings.ContainsAny(entry, "*?[") == false {
+		lib, err := findLibrary(entry)
+		if err != nil {
+			return nil, err
+		}
+		return []string{lib}, nil
+	}
+	// findLibrary adds the default locations to libraryLocations
+	findLibrary(entry)
+	var matches []string
+	for _, libraryLocation := range libraryLocations {
+		found, err := filepath.Glob(libraryLocation + "/" + entry)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, found...)
+		if len(matches) > 0 {
+			// Like for libraries, the first location that has it wins
+			break
+		}
+	}
+	if len(matches) == 0 {
+		return nil, errors.New("did not find library " + entry)
+	}
+	return matches, nil
+}
+
+// handleDlopenHints deploys what is listed in the hint file in the AppDir
+// and in the hint file at extraPath, if given
+func handleDlopenHints(appdir helpers.AppDir, extraPath string) error {
+	var paths []string
+	if helpers.Exists(appdir.Path + "/" + DlopenHintsFile) {
+		paths = append(paths, appdir.Path+"/"+DlopenHintsFile)
+	}
+	if extraPath != "" {
+		paths = append(paths, extraPath)
+	}
+	for _, path := range paths {
+		log.Println("Deploying what is listed in", path+"...")
+		entries, err := readDlopenHints(path)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			matches, err := resolveDlopenHint(entry)
+			if err != nil {
+				return errors.New(path + ": " + err.Error())
+			}
+			for _, match := range matches {
+				if helpers.IsDirectory(match) {
+					// Plugin directories may also contain other files the plugins need
+					log.Println("Bundling directory", match+"...")
+					err = copy.Copy(match, appdir.Path+match)
+					if err != nil {
+						return err
+					}
+					determineELFsInDirTree(appdir, appdir.Path+match)
+				} else {
+					log.Println("Bundling", match+"...")
+					determineELFsInDirTree(appdir, match)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// LD_DEBUG=libs,files logs "file=<name> [<namespace>];  generating link map" for each library
+// that gets mapped, including libraries loaded with dlopen and those without initializers.
+// The name is the path if dlopen was given one, otherwise the path is in the preceding
+// "trying file=<path>" line of the same process
+var (
+	ldDebugLineRegexp   = regexp.MustCompile(`^\s*(\d+):\s*(.*)$`)
+	tryingFileRegexp    = regexp.MustCompile(`^trying file=(\S+)$`)
+	generatingMapRegexp = regexp.MustCompile(`^file=(\S+) \[\d+\];\s+generating link map`)
+)
+
+// parseLdDebugOutput returns the libraries in LD_DEBUG=libs,files output
+func parseLdDebugOutput(output string) []string {
+	var libs []string
+	tried := make(map[string]string) // By process ID
+	for _, line := range strings.Split(output, "\n") {
+		match := ldDebugLineRegexp.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		pid, message := match[1], strings.TrimSpace(match[2])
+		if trying := tryingFileRegexp.FindStringSubmatch(message); trying != nil {
+			tried[pid] = trying[1]
+			continue
+		}
+		generating := generatingMapRegexp.FindStringSubmatch(message)
+		if generating == nil {
+			continue
+		}
+		lib := generating[1]
+		if filepath.IsAbs(lib) == false {
+			lib = tried[pid]
+		}
+		delete(tried, pid)
+		if filepath.IsAbs(lib) == true {
+			libs = helpers.AppendIfMissing(libs, filepath.Clean(lib))
+		}
+	}
+	return libs
+}
+
+// traceDlopen runs the main executable of the AppDir with the given arguments for the given time
+// and returns the libraries it and its child processes loaded
+func traceDlopen(appdir helpers.AppDir, args []string, duration time.Duration) ([]string, error) {
+	tmp, err := ioutil.TempDir("", "appimagetool-dlopen-trace-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	cmd := exec.Command(appdir.MainExecutable, args...)
+	// One file per process, so that the output of child processes gets recorded, too
+	cmd.Env = append(os.Environ(), "LD_DEBUG=libs,files", "LD_DEBUG_OUTPUT="+tmp+"/ld")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	log.Println("Running", appdir.MainExecutable, "for", duration, "to record the libraries it loads...")
+	log.Println("Use the functionality that loads plugins now")
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(duration):
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			<-done
+		}
+	}
+
+	outputs, _ := filepath.Glob(tmp + "/ld.*")
+	var libs []string
+	for _, output := range outputs {
+		data, err := ioutil.ReadFile(output)
+		if err != nil {
+			return nil, err
+		}
+		for _, lib := range parseLdDebugOutput(string(data)) {
+			libs = helpers.AppendIfMissing(libs, lib)
+		}
+	}
+	if len(libs) == 0 {
+		return nil, errors.New("no libraries were recorded, is " + appdir.MainExecutable + " dynamically linked?")
+	}
+	return libs, nil
+}
+
+// dlopenHintEntry returns the entry for a traced library in the hint file: its path relative
+// to the most specific library location it is in, so that the hint file also works on build systems
+// with other library locations, or its absolute path if it is in none
+func dlopenHintEntry(lib string) string {
+	entry := lib
+	for _, libraryLocation := range libraryLocations {
+		rel, err := filepath.Rel(libraryLocation, lib)
+		if err != nil || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		if filepath.IsAbs(entry) || len(rel) < len(entry) {
+			entry = rel
+		}
+	}
+	return entry
+}
+
+// findDesktopFileInAppDir returns the desktop file in usr/share/applications of the AppDir at path
+// which NewAppDir needs: the one that is also in the root of the AppDir, or else the only one
+func findDesktopFileInAppDir(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	topLevel, _ := filepath.Glob(path + "/*.desktop")
+	for _, desktopFile := range topLevel {
+		if helpers.Exists(path + "/usr/share/applications/" + filepath.Base(desktopFile)) {
+			return path + "/usr/share/applications/" + filepath.Base(desktopFile), nil
+		}
+	}
+	desktopFiles, _ := filepath.Glob(path + "/usr/share/applications/*.desktop")
+	if len(desktopFiles) != 1 {
+		return "", errors.New("could not determine the desktop file of the AppDir, it needs to be the only one in " +
+			path + "/usr/share/applications or also be in " + path)
+	}
+	return desktopFiles[0], nil
+}
+
+// writeDlopenHints traces the main executable of the AppDir and adds the libraries
+// which deploying would not find by following DT_NEEDED to the hint file in the AppDir
+func writeDlopenHints(appdir helpers.AppDir, args []string, duration time.Duration) ([]string, error) {
+	traced, err := traceDlopen(appdir, args, duration)
+	if err != nil {
+		return nil, err
+	}
+	determineELFsInDirTree(appdir, appdir.Path)
+	// findLibrary adds the default locations to libraryLocations
+	findLibrary(DlopenHintsFile)
+
+	var entries []string
+	if helpers.Exists(appdir.Path + "/" + DlopenHintsFile) {
+		entries, err = readDlopenHints(appdir.Path + "/" + DlopenHintsFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Compare by name since, e.g., /lib and /usr/lib may be the same directory
+	deployed := make(map[string]bool)
+	for _, lib := range allELFs {
+		deployed[filepath.Base(lib)] = true
+	}
+	var added []string
+	for _, lib := range traced {
+		if strings.HasPrefix(lib, appdir.Path+"/") || deployed[filepath.Base(lib)] == true {
+			continue
+		}
+		excluded := false
+		for _, excludedLib := range ExcludedLibraries {
+			if filepath.Base(lib) == excludedLib {
+				excluded = true
+			}
+		}
+		entry := dlopenHintEntry(lib)
+		if excluded == true || helpers.SliceContains(entries, entry) || helpers.SliceContains(entries, lib) {
+			continue
+		}
+		added = helpers.AppendIfMissing(added, entry)
+	}
+	sort.Strings(added)
+
+	f, err := os.OpenFile(appdir.Path+"/"+DlopenHintsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if len(added) > 0 {
+		_, err = f.WriteString("# Recorded by appimagetool dlopen-trace on " + time.Now().Format("2006-01-02") + "\n" +
+			strings.Join(added, "\n") + "\n")
+	}
+	return added, err
+}
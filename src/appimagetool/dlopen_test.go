@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseLdDebugOutput(t *testing.T) {
+	// As logged by glibc 2.36 with LD_DEBUG=libs,files, with another process in between
+	output := `     21444:	file=libm.so.6 [0];  needed by /usr/lib/libpython3.11.so.1.0 [0]
+     21444:	find library=libm.so.6 [0]; searching
+     21444:	 search path=/opt/python/lib		(RUNPATH from file /opt/python/bin/python3)
+     21444:	  trying file=/opt/python/lib/libm.so.6
+     21444:	 search cache=/etc/ld.so.cache
+     21444:	  trying file=/lib/x86_64-linux-gnu/libm.so.6
+     21500:	  trying file=/lib/x86_64-linux-gnu/libtinfo.so.6
+     21444:	file=libm.so.6 [0];  generating link map
+     21444:	  dynamic: 0x00007f8a81d31d48  base: 0x00007f8a81c53000   size: 0x00000000000df110
+     21444:	    entry: 0x00007f8a81c53000  phdr: 0x00007f8a81c53040  phnum:                 11
+     21444:	
+     21500:	file=libtinfo.so.6 [0];  generating link map
+     21444:	calling init: /lib/x86_64-linux-gnu/libm.so.6
+     21444:	file=/lib/x86_64-linux-gnu/libz.so.1 [0];  dynamically loaded by /usr/lib/_ctypes.so [0]
+     21444:	file=/lib/x86_64-linux-gnu/libz.so.1 [0];  generating link map
+     21444:	opening file=/lib/x86_64-linux-gnu/libz.so.1 [0]; direct_opencount=1
+     21444:	file=libm.so.6 [0];  generating link map
+     21444:	calling fini: /lib/x86_64-linux-gnu/libz.so.1 [0]
+`
+	expected := []string{"/lib/x86_64-linux-gnu/libm.so.6", "/lib/x86_64-linux-gnu/libtinfo.so.6", "/lib/x86_64-linux-gnu/libz.so.1"}
+	if libs := parseLdDebugOutput(output); reflect.DeepEqual(libs, expected) == false {
+		t.Error("Expected", expected, "got", libs)
+	}
+}
+
+func TestReadDlopenHints(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, DlopenHintsFile)
+	ioutil.WriteFile(path, []byte(`# Recorded by appimagetool dlopen-trace
+libvdpau_va_gl.so.1
+   libxcb-*.so.*   # Indented, with a comment
+
+/usr/lib/x86_64-linux-gnu/foo/plugins/
+`), 0644)
+	entries, err := readDlopenHints(path)
+	expected := []string{"libvdpau_va_gl.so.1", "libxcb-*.so.*", "/usr/lib/x86_64-linux-gnu/foo/plugins/"}
+	if err != nil || reflect.DeepEqual(entries, expected) == false {
+		t.Error("Expected", expected, "got", entries, err)
+	}
+	if _, err := readDlopenHints(filepath.Join(dir, "missing")); err == nil {
+		t.Error("Expected an error for a missing hint file")
+	}
+}
+
+func TestDlopenHintEntry(t *testing.T) {
+	defer func(locations []string) { libraryLocations = locations }(libraryLocations)
+	libraryLocations = []string{"/usr/lib", "/usr/lib/x86_64-linux-gnu", "/lib"}
+	for lib, expected := range map[string]string{
+		"/usr/lib/x86_64-linux-gnu/libvdpau_va_gl.so.1":     "libvdpau_va_gl.so.1",
+		"/usr/lib/x86_64-linux-gnu/gdk-pixbuf/loaders/a.so": "gdk-pixbuf/loaders/a.so",
+		"/usr/lib/libfoo.so.2":                              "libfoo.so.2",
+		"/opt/foo/lib/libfoo.so.2":                          "/opt/foo/lib/libfoo.so.2",
+		"/usr/libexec/libbar.so":                            "/usr/libexec/libbar.so",
+	} {
+		if entry := dlopenHintEntry(lib); entry != expected {
+			t.Error("Expected", expected, "for", lib, "got", entry)
+		}
+	}
+}
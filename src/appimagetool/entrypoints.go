@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/probonopd/go-appimage/internal/helpers"
+	"gopkg.in/ini.v1"
+)
+
+// Suites (office applications, SDKs, ...) ship more than one tool. Besides the main executable
+// from the Exec= key of the desktop file, additional executables in usr/bin can be registered
+// as entry points. AppRun then runs the entry point that matches, in this order,
+// * the name the AppImage was invoked by ($ARGV0 as set by the AppImage runtime, or argv[0]),
+//   so that busybox-style symlinks named like the entry point can be used
+// * the first argument, which is then removed from the arguments
+// and the main executable otherwise.
+// The entry points do not need any special treatment when deploying, because all ELFs
+// in the AppDir get their dependencies deployed and their rpaths patched anyway.
+
+// resolveEntryPoints returns the names of the entry points in usr/bin of the AppDir.
+// spec is a comma-separated list of names, or "all" for all executables in usr/bin
+func resolveEntryPoints(appdir helpers.AppDir, spec string) ([]string, error) {
+	var entryPoints []string
+	main := filepath.Base(appdir.MainExecutable)
+	if spec == "all" {
+		infos, err := ioutil.ReadDir(appdir.Path + "/usr/bin")
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			if info.IsDir() == false && info.Mode()&0111 != 0 && info.Name() != main {
+				entryPoints = append(entryPoints, info.Name())
+			}
+		}
+		return entryPoints, nil
+	}
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || name == main {
+			continue
+		}
+		if strings.Contains(name, "/") {
+			return nil, errors.New("entry point " + name + " contains a path, please only use names of executables in usr/bin")
+		}
+		info, err := os.Stat(appdir.Path + "/usr/bin/" + name)
+		if err != nil {
+			return nil, errors.New("entry point " + name + " not found in usr/bin")
+		}
+		if info.Mode()&0111 == 0 {
+			return nil, errors.New("entry point " + name + " is not executable")
+		}
+		entryPoints = helpers.AppendIfMissing(entryPoints, name)
+	}
+	sort.Strings(entryPoints)
+	return entryPoints, nil
+}
+
+// handleEntryPoints registers the entry points in AppRun
+// and, if addActions is true, adds a desktop action for each of them
+func handleEntryPoints(appdir helpers.AppDir, spec string, addActions bool) error {
+	entryPoints, err := resolveEntryPoints(appdir, spec)
+	if err != nil {
+		return err
+	}
+	if len(entryPoints) == 0 {
+		log.Println("No entry points besides the main executable")
+		return nil
+	}
+	log.Println("Registering entry points:", strings.Join(entryPoints, ", "))
+
+	switch {
+	case options.libAppRunHooks == true:
+		// Desktop actions would run the main executable with the name of the entry point as an argument
+		log.Println("The libapprun_hooks AppRun can only run the main executable, hence the entry points",
+			"can only be used by running usr/bin/<name> inside the AppImage and get no desktop actions")
+		return nil
+	case options.nativeAppRun == true:
+		var paths []string
+		for _, entryPoint := range entryPoints {
+			paths = append(paths, "usr/bin/"+entryPoint)
+		}
+		err = appendLinesToFile(appdir.Path+"/"+AppRunEnvFile, []string{"", "# Entry points", "APPRUN_ENTRYPOINTS=" + strings.Join(paths, ":")})
+	default:
+		err = addToAppRun(appdir, "Dispatch to entry points", []string{
+			"ENTRYPOINTS=\"" + strings.Join(entryPoints, " ") + "\"",
+			"INVOKED_AS=$(basename \"${ARGV0:-$0}\")",
+			"DISPATCHED=",
+			"for ENTRYPOINT in $ENTRYPOINTS ; do",
+			"  if [ \"$INVOKED_AS\" = \"$ENTRYPOINT\" ] ; then MAIN=\"$ENTRYPOINT\" ; DISPATCHED=1 ; fi",
+			"done",
+			"if [ -z \"$DISPATCHED\" ] && [ $# -gt 0 ] ; then",
+			"  for ENTRYPOINT in $ENTRYPOINTS ; do",
+			"    if [ -z \"$DISPATCHED\" ] && [ \"$1\" = \"$ENTRYPOINT\" ] ; then MAIN=\"$ENTRYPOINT\" ; DISPATCHED=1 ; shift ; fi",
+			"  done",
+			"fi",
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	if addActions == true {
+		return addEntryPointActions(appdir, entryPoints)
+	}
+	return nil
+}
+
+// addEntryPointActions adds a desktop action that runs the entry point for each of the entry points
+// to the desktop file in the root of the AppDir
+func addEntryPointActions(appdir helpers.AppDir, entryPoints []string) error {
+	cfg, err := ini.LoadSources(ini.LoadOptions{IgnoreInlineComment: true}, appdir.DesktopFilePath)
+	if err != nil {
+		return err
+	}
+	mainExec := filepath.Base(appdir.MainExecutable)
+	var actions []string
+	for _, action := range strings.Split(cfg.Section("Desktop Entry").Key("Actions").String(), ";") {
+		if action != "" {
+			actions = append(actions, action)
+		}
+	}
+	for _, entryPoint := range entryPoints {
+		// Action identifiers may only contain A-Za-z0-9-
+		id := "EntryPoint-" + strings.Map(func(r rune) rune {
+			if r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' {
+				return r
+			}
+			return '-'
+		}, entryPoint)
+		if _, err := cfg.GetSection("Desktop Action " + id); err == nil {
+			continue
+		}
+		log.Println("Adding desktop action for", entryPoint)
+		actions = append(actions, id)
+		cfg.Section("Desktop Action " + id).Key("Name").SetValue(entryPoint)
+		cfg.Section("Desktop Action " + id).Key("Exec").SetValue(mainExec + " " + entryPoint)
+	}
+	cfg.Section("Desktop Entry").Key("Actions").SetValue(strings.Join(actions, ";") + ";")
+	ini.PrettyFormat = false
+	err = cfg.SaveTo(appdir.DesktopFilePath)
+	if err != nil {
+		return err
+	}
+	return helpers.CheckDesktopFile(appdir.DesktopFilePath)
+}
+
+// appendLinesToFile appends lines to the existing file at path
+func appendLinesToFile(path string, lines []string) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(strings.Join(lines, "\n") + "\n")
+	return err
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/probonopd/go-appimage/internal/helpers"
+	"github.com/ulikunitz/xz"
+)
+
+// from-package turns .deb and .rpm packages into an AppDir without the need for dpkg, rpm,
+// or a network connection: the packages are unpacked into the AppDir as they would be
+// installed into /, then the desktop file is made to work in an AppDir and deploy runs.
+// Maintainer scripts are not run.
+
+// unpackPackage unpacks the .deb or .rpm package at path into appdirPath
+func unpackPackage(path string, appdirPath string) error {
+	log.Println("Unpacking", path, "into", appdirPath+"...")
+	err := os.MkdirAll(appdirPath, 0755)
+	if err != nil {
+		return err
+	}
+	switch {
+	case strings.HasSuffix(path, ".deb"):
+		return unpackDeb(path, appdirPath)
+	case strings.HasSuffix(path, ".rpm"):
+		return unpackRpm(path, appdirPath)
+	}
+	return errors.New(path + " is neither a .deb nor an .rpm package")
+}
+
+// packageNameFromFileName returns the name of the package from its file name,
+// e.g., "foo" for foo_1.0-1_amd64.deb or foo-1.0-1.x86_64.rpm
+func packageNameFromFileName(path string) string {
+	base := filepath.Base(path)
+	if strings.HasSuffix(base, ".deb") {
+		return strings.SplitN(base, "_", 2)[0]
+	}
+	parts := strings.Split(strings.TrimSuffix(base, ".rpm"), "-")
+	if len(parts) > 2 {
+		parts = parts[:len(parts)-2]
+	}
+	return strings.Join(parts, "-")
+}
+
+// unpackDeb unpacks data.tar.* of the .deb package at path, which is an ar archive
+func unpackDeb(path string, dest string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	magic := make([]byte, 8)
+	if _, err = io.ReadFull(r, magic); err != nil || string(magic) != "!<arch>\n" {
+		return errors.New(path + " is not a .deb package")
+	}
+	for {
+		header := make([]byte, 60)
+		_, err = io.ReadFull(r, header)
+		if err == io.EOF {
+			return errors.New(path + " does not contain data.tar")
+		}
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(strings.TrimSpace(string(header[0:16])), "/")
+		size, err := strconv.ParseInt(strings.TrimSpace(string(header[48:58])), 10, 64)
+		if err != nil {
+			return errors.New(path + ": invalid ar header")
+		}
+		member := io.LimitReader(r, size)
+		if strings.HasPrefix(name, "data.tar") {
+			return unpackTar(member, dest)
+		}
+		if _, err = io.Copy(ioutil.Discard, member); err != nil {
+			return err
+		}
+		// Members are aligned to 2 bytes
+		if size%2 == 1 {
+			r.ReadByte()
+		}
+	}
+}
+
+// unpackRpm unpacks the payload of the .rpm package at path, which is a compressed cpio archive
+func unpackRpm(path string, dest string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	lead := make([]byte, 96)
+	if _, err = io.ReadFull(r, lead); err != nil || bytes.Equal(lead[0:4], []byte{0xed, 0xab, 0xee, 0xdb}) == false {
+		return errors.New(path + " is not an .rpm package")
+	}
+	// The signature header (padded to 8 bytes) and the header
+	for i, pad := range []bool{true, false} {
+		header := make([]byte, 16)
+		if _, err = io.ReadFull(r, header); err != nil {
+			return err
+		}
+		if bytes.Equal(header[0:3], []byte{0x8e, 0xad, 0xe8}) == false {
+			return errors.New(path + ": invalid rpm header " + strconv.Itoa(i))
+		}
+		nindex := int64(binary.BigEndian.Uint32(header[8:12]))
+		hsize := int64(binary.BigEndian.Uint32(header[12:16]))
+		size := 16*nindex + hsize
+		if pad == true && size%8 != 0 {
+			size = size + 8 - size%8
+		}
+		if _, err = io.CopyN(ioutil.Discard, r, size); err != nil {
+			return err
+		}
+	}
+	payload, err := decompress(r)
+	if err != nil {
+		return err
+	}
+	return unpackCpio(payload, dest)
+}
+
+// decompress returns a reader for the gzip, xz, zstd, or bzip2 compressed data in r,
+// or r itself if it is not compressed
+func decompress(r *bufio.Reader) (io.Reader, error) {
+	magic, _ := r.Peek(6)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(r)
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return xz.NewReader(r)
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return bzip2.NewReader(r), nil
+	}
+	return r, nil
+}
+
+// targetInAppDir returns where the file that would be installed to name goes in dest,
+// never outside of dest
+func targetInAppDir(dest string, name string) string {
+	return filepath.Join(dest, filepath.Clean("/"+name))
+}
+
+// relativeSymlinkTarget turns the target of a symlink installed to name into a relative one
+// that stays inside of the AppDir: absolute targets point into the AppDir rather than to the system,
+// and ".." beyond the root ends at the root of the AppDir, like it ends at / on the system
+func relativeSymlinkTarget(name string, target string) string {
+	dir := filepath.Dir(filepath.Clean("/" + name))
+	if filepath.IsAbs(target) == false {
+		target = filepath.Join(dir, target)
+	}
+	rel, err := filepath.Rel(dir, filepath.Clean(target))
+	if err != nil {
+		return "."
+	}
+	return rel
+}
+
+// isInside returns true if path is dir or below it
+func isInside(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && strings.HasPrefix(rel, "../") == false
+}
+
+// checkParentsInside returns an error unless the directory of target, as far as it exists,
+// is inside of dest once symlinks are resolved, so that nothing can be written outside of dest
+// through symlinks that were unpacked before. Returns the resolved directory of target
+func checkParentsInside(dest string, target string) (string, error) {
+	realDest, err := filepath.EvalSymlinks(dest)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Dir(target)
+	missing := ""
+	for {
+		real, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			if isInside(realDest, real) == false {
+				return "", errors.New(target + " would be written outside of " + dest + " through a symlink")
+			}
+			return filepath.Join(real, missing), nil
+		}
+		if os.IsNotExist(err) == false || isInside(dest, dir) == false {
+			return "", err
+		}
+		missing = filepath.Join(filepath.Base(dir), missing)
+		dir = filepath.Dir(dir)
+	}
+}
+
+// unpackTar unpacks the (possibly compressed) tar archive in r into dest
+func unpackTar(r io.Reader, dest string) error {
+	decompressed, err := decompress(bufio.NewReader(r))
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(decompressed)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target := targetInAppDir(dest, header.Name)
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = writeUnpackedDirectory(dest, target)
+		case tar.TypeReg:
+			err = writeUnpackedFile(dest, target, tr, os.FileMode(header.Mode).Perm())
+		case tar.TypeSymlink:
+			err = writeUnpackedSymlink(dest, target, relativeSymlinkTarget(header.Name, header.Linkname))
+		case tar.TypeLink:
+			err = writeUnpackedHardlink(dest, target, targetInAppDir(dest, header.Linkname))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// unpackCpio unpacks the cpio archive (newc format, as used in .rpm packages) in r into dest
+func unpackCpio(r io.Reader, dest string) error {
+	br := bufio.NewReader(r)
+	var offset int64
+	read := func(n int64) ([]byte, error) {
+		data := make([]byte, n)
+		_, err := io.ReadFull(br, data)
+		offset = offset + n
+		return data, err
+	}
+	align := func() error {
+		if offset%4 != 0 {
+			_, err := read(4 - offset%4)
+			return err
+		}
+		return nil
+	}
+	// Hardlinks: the data is in the last entry of an inode
+	pendingLinks := make(map[string][]string)
+	for {
+		header, err := read(110)
+		if err != nil {
+			return err
+		}
+		if string(header[0:6]) != "070701" && string(header[0:6]) != "070702" {
+			return errors.New("unsupported cpio format")
+		}
+		field := func(i int) int64 {
+			value, _ := strconv.ParseInt(string(header[6+8*i:14+8*i]), 16, 64)
+			return value
+		}
+		ino := string(header[6:14])
+		mode := field(1)
+		nlink := field(4)
+		fileSize := field(6)
+		nameSize := field(11)
+		nameData, err := read(nameSize)
+		if err != nil {
+			return err
+		}
+		name := strings.TrimRight(string(nameData), "\x00")
+		if err = align(); err != nil {
+			return err
+		}
+		if name == "TRAILER!!!" {
+			return nil
+		}
+		data, err := read(fileSize)
+		if err != nil {
+			return err
+		}
+		if err = align(); err != nil {
+			return err
+		}
+
+		target := targetInAppDir(dest, name)
+		switch mode & 0170000 {
+		case 0040000:
+			err = writeUnpackedDirectory(dest, target)
+		case 0120000:
+			err = writeUnpackedSymlink(dest, target, relativeSymlinkTarget(name, string(data)))
+		case 0100000:
+			if nlink > 1 && fileSize == 0 {
+				pendingLinks[ino] = append(pendingLinks[ino], target)
+				continue
+			}
+			err = writeUnpackedFile(dest, target, bytes.NewReader(data), os.FileMode(mode).Perm())
+			for _, link := range pendingLinks[ino] {
+				if err == nil {
+					err = writeUnpackedHardlink(dest, link, target)
+				}
+			}
+			delete(pendingLinks, ino)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// The files of packages are written into dest by the following functions, which make sure that
+// they end up inside of it even if symlinks in the package point elsewhere
+
+func writeUnpackedDirectory(dest string, target string) error {
+	if _, err := checkParentsInside(dest, target); err != nil {
+		return err
+	}
+	err := os.MkdirAll(target, 0755)
+	if err != nil {
+		return err
+	}
+	_, err = checkParentsInside(dest, target+"/.")
+	return err
+}
+
+func writeUnpackedFile(dest string, target string, r io.Reader, perm os.FileMode) error {
+	err := writeUnpackedDirectory(dest, filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	os.Remove(target)
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, r)
+	return err
+}
+
+func writeUnpackedSymlink(dest string, target string, linkTarget string) error {
+	err := writeUnpackedDirectory(dest, filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	// Relative to where the symlink really is, which may differ from target if a parent is a symlink
+	dir, err := checkParentsInside(dest, target)
+	if err != nil {
+		return err
+	}
+	realDest, err := filepath.EvalSymlinks(dest)
+	if err != nil {
+		return err
+	}
+	if isInside(realDest, filepath.Join(dir, linkTarget)) == false {
+		return errors.New("the symlink " + target + " to " + linkTarget + " would point outside of " + dest)
+	}
+	os.Remove(target)
+	return os.Symlink(linkTarget, target)
+}
+
+func writeUnpackedHardlink(dest string, target string, existing string) error {
+	err := writeUnpackedDirectory(dest, filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	if _, err = checkParentsInside(dest, existing); err != nil {
+		return err
+	}
+	os.Remove(target)
+	return os.Link(existing, target)
+}
+
+// chooseDesktopFile returns the desktop file of the application in the AppDir,
+// preferring one named like one of the packages
+func chooseDesktopFile(appdirPath string, packageNames []string) (string, error) {
+	candidates, _ := filepath.Glob(appdirPath + "/usr/share/applications/*.desktop")
+	var shown []string
+	for _, candidate := range candidates {
+		data, err := ioutil.ReadFile(candidate)
+		if err != nil {
+			return "", err
+		}
+		if bytes.Contains(data, []byte("\nNoDisplay=true")) == false && bytes.Contains(data, []byte("\nType=Application")) {
+			shown = append(shown, candidate)
+		}
+	}
+	if len(shown) == 0 {
+		return "", errors.New("the packages contain no desktop file for an application, please add one to " +
+			appdirPath + "/usr/share/applications and run deploy")
+	}
+	sort.Strings(shown)
+	for _, name := range packageNames {
+		for _, candidate := range shown {
+			if strings.Contains(strings.ToLower(filepath.Base(candidate)), strings.ToLower(name)) {
+				return candidate, nil
+			}
+		}
+	}
+	return shown[0], nil
+}
+
+// fixDesktopFileForAppDir removes absolute paths from the Exec=, TryExec=, and Icon= keys
+// of the desktop file in the AppDir, putting the executable into usr/bin
+// and the icon into the root of the AppDir if needed
+func fixDesktopFileForAppDir(appdirPath string, desktopFilePath string) error {
+	data, err := ioutil.ReadFile(desktopFilePath)
+	if err != nil {
+		return err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		switch {
+		case strings.HasPrefix(line, "TryExec="):
+			// AppImages do not need it, and it would point to the system
+			continue
+		case strings.HasPrefix(line, "Exec="):
+			fields := strings.SplitN(strings.TrimPrefix(line, "Exec="), " ", 2)
+			if filepath.IsAbs(fields[0]) {
+				name := filepath.Base(fields[0])
+				err = linkIntoUsrBin(appdirPath, fields[0])
+				if err != nil {
+					return err
+				}
+				fields[0] = name
+				line = "Exec=" + strings.Join(fields, " ")
+			}
+		case strings.HasPrefix(line, "Icon="):
+			icon := strings.TrimSpace(strings.TrimPrefix(line, "Icon="))
+			if filepath.IsAbs(icon) {
+				ext := filepath.Ext(icon)
+				name := strings.TrimSuffix(filepath.Base(icon), ext)
+				if helpers.Exists(appdirPath + icon) {
+					err = helpers.CopyFile(appdirPath+icon, appdirPath+"/"+name+ext)
+					if err != nil {
+						return err
+					}
+				}
+				line = "Icon=" + name
+			}
+		}
+		lines = append(lines, line)
+	}
+	return ioutil.WriteFile(desktopFilePath, []byte(strings.Join(lines, "\n")), 0644)
+}
+
+// linkIntoUsrBin makes the executable installed to path available in usr/bin of the AppDir,
+// which is where AppRun looks for it
+func linkIntoUsrBin(appdirPath string, path string) error {
+	target := appdirPath + "/usr/bin/" + filepath.Base(path)
+	if filepath.Dir(path) == "/usr/bin" || helpers.Exists(target) {
+		return nil
+	}
+	if helpers.Exists(appdirPath+path) == false {
+		return errors.New(path + " from the desktop file is not in the packages")
+	}
+	rel, err := filepath.Rel("/usr/bin", path)
+	if err != nil {
+		return err
+	}
+	log.Println("Linking", path, "into usr/bin")
+	return writeUnpackedSymlink(appdirPath, target, rel)
+}
+
+// copyIconToAppDirRoot copies the icon named in the desktop file into the root of the AppDir
+// if it is not a PNG in hicolor, which is what deploy takes care of
+func copyIconToAppDirRoot(appdirPath string, desktopFilePath string) error {
+	data, err := ioutil.ReadFile(desktopFilePath)
+	if err != nil {
+		return err
+	}
+	icon := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "Icon=") {
+			icon = strings.TrimSpace(strings.TrimPrefix(line, "Icon="))
+			break
+		}
+	}
+	if icon == "" {
+		return errors.New(desktopFilePath + " has no Icon= key")
+	}
+	for _, ext := range []string{".png", ".svg", ".xpm"} {
+		if helpers.Exists(appdirPath + "/" + icon + ext) {
+			return nil
+		}
+	}
+	var candidates []string
+	for _, size := range []string{"256x256", "128x128", "512x512", "scalable", "64x64", "48x48"} {
+		for _, ext := range []string{".png", ".svg"} {
+			candidates = append(candidates, appdirPath+"/usr/share/icons/hicolor/"+size+"/apps/"+icon+ext)
+		}
+	}
+	for _, ext := range []string{".png", ".svg", ".xpm"} {
+		candidates = append(candidates, appdirPath+"/usr/share/pixmaps/"+icon+ext)
+	}
+	for _, candidate := range candidates {
+		if helpers.Exists(candidate) {
+			log.Println("Using icon", candidate)
+			return helpers.CopyFile(candidate, appdirPath+"/"+icon+filepath.Ext(candidate))
+		}
+	}
+	return errors.New("icon " + icon + " is not in the packages")
+}
+
+// appDirFromPackages unpacks the packages into a new AppDir and returns the path
+// of the desktop file in it, ready to be deployed
+func appDirFromPackages(packages []string, appdirPath string) (string, error) {
+	if helpers.Exists(appdirPath) {
+		return "", errors.New(appdirPath + " already exists")
+	}
+	var packageNames []string
+	for _, pkg := range packages {
+		err := unpackPackage(pkg, appdirPath)
+		if err != nil {
+			return "", err
+		}
+		packageNames = append(packageNames, packageNameFromFileName(pkg))
+	}
+	desktopFilePath, err := chooseDesktopFile(appdirPath, packageNames)
+	if err != nil {
+		return "", err
+	}
+	log.Println("Using desktop file", desktopFilePath)
+	err = fixDesktopFileForAppDir(appdirPath, desktopFilePath)
+	if err != nil {
+		return "", err
+	}
+	err = copyIconToAppDirRoot(appdirPath, desktopFilePath)
+	if err != nil {
+		return "", err
+	}
+	return desktopFilePath, nil
+}
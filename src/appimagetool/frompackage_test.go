@@ -0,0 +1,224 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tarEntry is a file, directory (name ending in "/"), symlink, or hardlink in a test archive
+type tarEntry struct {
+	name     string
+	data     string
+	linkname string
+	typeflag byte
+}
+
+func makeTarGz(t *testing.T, entries []tarEntry) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.data)), Linkname: e.linkname, Typeflag: e.typeflag}
+		if e.typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(e.data))
+	}
+	tw.Close()
+	gw.Close()
+	return buf.Bytes()
+}
+
+// makeCpio returns a newc cpio archive; entries are name, mode, data,
+// and entries with the same name in links share an inode
+func makeCpio(entries [][3]string, links map[string]int) []byte {
+	var buf bytes.Buffer
+	pad := func() {
+		for buf.Len()%4 != 0 {
+			buf.WriteByte(0)
+		}
+	}
+	write := func(ino int, name string, mode int64, nlink int, data string) {
+		fmt.Fprintf(&buf, "070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X",
+			ino, mode, 0, 0, nlink, 0, len(data), 0, 0, 0, 0, len(name)+1, 0)
+		buf.WriteString(name + "\x00")
+		pad()
+		buf.WriteString(data)
+		pad()
+	}
+	for i, e := range entries {
+		var mode int64
+		fmt.Sscanf(e[1], "%o", &mode)
+		ino, nlink := i+1, 1
+		if n, ok := links[e[0]]; ok == true {
+			ino, nlink = 1000, n
+		}
+		write(ino, e[0], mode, nlink, e[2])
+	}
+	write(0, "TRAILER!!!", 0, 1, "")
+	return buf.Bytes()
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "appimagetool-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func readFileOrEmpty(path string) string {
+	data, _ := ioutil.ReadFile(path)
+	return string(data)
+}
+
+func TestUnpackDeb(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	data := makeTarGz(t, []tarEntry{
+		{name: "./usr/", typeflag: tar.TypeDir},
+		{name: "./usr/bin/foo", data: "#!/bin/sh\n", typeflag: tar.TypeReg},
+		{name: "./usr/bin/bar", linkname: "/usr/bin/foo", typeflag: tar.TypeSymlink},
+		{name: "./usr/bin/baz", linkname: "./usr/bin/foo", typeflag: tar.TypeLink},
+	})
+	var deb bytes.Buffer
+	deb.WriteString("!<arch>\n")
+	for _, member := range []struct{ name, data string }{{"debian-binary", "2.0\n"}, {"control.tar.gz", "odd"}, {"data.tar.gz", string(data)}} {
+		fmt.Fprintf(&deb, "%-16s%-12s%-6s%-6s%-8s%-10d`\n", member.name, "0", "0", "0", "100644", len(member.data))
+		deb.WriteString(member.data)
+		if len(member.data)%2 == 1 {
+			deb.WriteByte('\n')
+		}
+	}
+	path := dir + "/foo_1.0-1_amd64.deb"
+	ioutil.WriteFile(path, deb.Bytes(), 0644)
+
+	appdir := dir + "/foo.AppDir"
+	if err := unpackPackage(path, appdir); err != nil {
+		t.Fatal(err)
+	}
+	if readFileOrEmpty(appdir+"/usr/bin/foo") != "#!/bin/sh\n" || readFileOrEmpty(appdir+"/usr/bin/baz") != "#!/bin/sh\n" {
+		t.Error("Expected the file and its hardlink to be unpacked")
+	}
+	if link, _ := os.Readlink(appdir + "/usr/bin/bar"); link != "foo" {
+		t.Error("Expected the absolute symlink to become relative, got", link)
+	}
+	if packageNameFromFileName(path) != "foo" {
+		t.Error("Expected the package name foo, got", packageNameFromFileName(path))
+	}
+}
+
+func TestUnpackRpm(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	cpio := makeCpio([][3]string{
+		{"./usr/share/foo", "040755", ""},
+		{"./usr/share/foo/a", "0100644", ""},
+		{"./usr/share/foo/b", "0100644", "shared"},
+		{"./usr/share/foo/c", "0120777", "/usr/share/foo/b"},
+	}, map[string]int{"./usr/share/foo/a": 2, "./usr/share/foo/b": 2})
+	var payload bytes.Buffer
+	gw := gzip.NewWriter(&payload)
+	gw.Write(cpio)
+	gw.Close()
+	var rpm bytes.Buffer
+	rpm.Write([]byte{0xed, 0xab, 0xee, 0xdb})
+	rpm.Write(make([]byte, 92))
+	for i := 0; i < 2; i++ {
+		// Header without index entries and data
+		rpm.Write([]byte{0x8e, 0xad, 0xe8, 0x01, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	}
+	rpm.Write(payload.Bytes())
+	path := dir + "/foo-1.0-1.x86_64.rpm"
+	ioutil.WriteFile(path, rpm.Bytes(), 0644)
+
+	appdir := dir + "/foo.AppDir"
+	if err := unpackPackage(path, appdir); err != nil {
+		t.Fatal(err)
+	}
+	if readFileOrEmpty(appdir+"/usr/share/foo/a") != "shared" || readFileOrEmpty(appdir+"/usr/share/foo/b") != "shared" {
+		t.Error("Expected the hardlinked files to have the data of the last entry")
+	}
+	if link, _ := os.Readlink(appdir + "/usr/share/foo/c"); link != "b" {
+		t.Error("Expected the absolute symlink to become relative, got", link)
+	}
+	if packageNameFromFileName(path) != "foo" {
+		t.Error("Expected the package name foo, got", packageNameFromFileName(path))
+	}
+}
+
+func TestRelativeSymlinkTarget(t *testing.T) {
+	for _, c := range [][3]string{
+		{"usr/bin/editor", "/etc/alternatives/editor", "../../etc/alternatives/editor"},
+		{"usr/lib/libfoo.so", "libfoo.so.1", "libfoo.so.1"},
+		{"usr/lib/evil", "../../../../etc", "../../etc"},
+		{"evil", "../../..", "."},
+	} {
+		if target := relativeSymlinkTarget(c[0], c[1]); target != c[2] {
+			t.Errorf("Expected %s for %s -> %s, got %s", c[2], c[0], c[1], target)
+		}
+	}
+}
+
+func TestUnpackDoesNotWriteOutsideOfAppDir(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	outside := dir + "/outside"
+	os.MkdirAll(outside, 0755)
+	appdir := dir + "/foo.AppDir"
+	os.MkdirAll(appdir, 0755)
+
+	// A symlink with too many ".." ends at the root of the AppDir
+	data := makeTarGz(t, []tarEntry{
+		{name: "./outside/", typeflag: tar.TypeDir},
+		{name: "./usr/lib/evil", linkname: "../../../../outside", typeflag: tar.TypeSymlink},
+		{name: "./usr/lib/evil/file", data: "x", typeflag: tar.TypeReg},
+	})
+	if err := unpackTar(bytes.NewReader(data), appdir); err != nil {
+		t.Fatal(err)
+	}
+	if readFileOrEmpty(appdir+"/outside/file") != "x" {
+		t.Error("Expected the file to be written through the symlink inside of the AppDir")
+	}
+
+	// A symlink that a parent symlink makes point outside is rejected
+	data = makeTarGz(t, []tarEntry{
+		{name: "./up", linkname: "..", typeflag: tar.TypeSymlink},
+		{name: "./up/evil", linkname: "../outside", typeflag: tar.TypeSymlink},
+	})
+	if err := unpackTar(bytes.NewReader(data), appdir); err == nil {
+		t.Error("Expected a symlink pointing outside of the AppDir to be rejected")
+	}
+
+	// Nothing is written through a symlink that points outside, e.g., made by something else
+	os.Symlink(outside, appdir+"/usr/share")
+	data = makeTarGz(t, []tarEntry{{name: "./usr/share/file", data: "x", typeflag: tar.TypeReg}})
+	if err := unpackTar(bytes.NewReader(data), appdir); err == nil {
+		t.Error("Expected writing through a symlink pointing outside of the AppDir to be rejected")
+	}
+	entries := makeCpio([][3]string{{"./usr/share/dir", "040755", ""}}, nil)
+	if err := unpackCpio(bytes.NewReader(entries), appdir); err == nil {
+		t.Error("Expected creating a directory through a symlink pointing outside of the AppDir to be rejected")
+	}
+	infos, _ := ioutil.ReadDir(outside)
+	if len(infos) != 0 {
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		t.Error("Expected nothing to be written outside of the AppDir, got", strings.Join(names, ", "))
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "evil")); err == nil {
+		t.Error("Expected nothing to be written next to the AppDir")
+	}
+}
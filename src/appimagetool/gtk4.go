@@ -0,0 +1,105 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/otiai10/copy"
+	"github.com/probonopd/go-appimage/internal/helpers"
+)
+
+// Gtk 4 is organized differently from Gtk 2 and 3, hence deployGtkDirectory does not handle it:
+// * There is no Default theme in /usr/share/themes; the Adwaita theme is compiled into libgtk-4
+//   and the libadwaita stylesheets are compiled into libadwaita-1 as GResources
+// * The GSK renderers are part of libgtk-4, but the media backends (GStreamer, FFmpeg),
+//   print backends and input method modules are loaded at runtime from libdir/gtk-4.0/4.0.0/
+//   which GTK_PATH can point to
+// * The org.gtk.gtk4.* GSettings schemas are needed, otherwise Gtk 4 aborts
+//   when trying to access settings such as the file chooser ones
+
+// handleGtk4 bundles the Gtk 4 modules, data, and schemas if libgtk-4 is about to be deployed
+func handleGtk4(appdir helpers.AppDir) {
+	var gtk4Found bool
+	var adwaitaFound bool
+	for _, lib := range allELFs {
+		if strings.HasPrefix(filepath.Base(lib), "libgtk-4.so") {
+			gtk4Found = true
+		}
+		if strings.HasPrefix(filepath.Base(lib), "libadwaita-1.so") {
+			adwaitaFound = true
+		}
+	}
+	if gtk4Found == false {
+		return
+	}
+
+	log.Println("Bundling Gtk 4 modules (for GTK_PATH)...")
+	locs, err := findWithPrefixInLibraryLocations("gtk-4.0")
+	if err != nil {
+		log.Println("Could not find Gtk 4 directory")
+		os.Exit(1)
+	}
+	var gtkPaths []string
+	for _, loc := range locs {
+		// Media backends, print backends, and input method modules
+		log.Println("Bundling dependencies of Gtk 4 directory", loc+"...")
+		determineELFsInDirTree(appdir, loc)
+		gtkPaths = append(gtkPaths, "\"${HERE}\""+loc)
+	}
+
+	// Data which Gtk 4 and libadwaita load from XDG_DATA_DIRS
+	dataDirs := []string{"/usr/share/gtk-4.0"}
+	if adwaitaFound == true {
+		log.Println("Detected libadwaita")
+		dataDirs = append(dataDirs, "/usr/share/libadwaita-1")
+	}
+	for _, dataDir := range dataDirs {
+		if helpers.Exists(dataDir) == false || helpers.Exists(appdir.Path+dataDir) == true {
+			continue
+		}
+		log.Println("Bundling", dataDir+"...")
+		err = copy.Copy(dataDir, appdir.Path+dataDir)
+		if err != nil {
+			helpers.PrintError("Copy", err)
+			os.Exit(1)
+		}
+	}
+
+	// GSettings schemas; these get compiled by handleGlibSchemas
+	schemasDir := "/usr/share/glib-2.0/schemas"
+	schemas := helpers.FilesWithPrefixInDirectory(schemasDir, "org.gtk.gtk4.")
+	if len(schemas) > 0 {
+		log.Println("Bundling Gtk 4 GSettings schemas...")
+		for _, schema := range schemas {
+			err = helpers.CopyFile(schema, appdir.Path+schema)
+			if err != nil {
+				helpers.PrintError("Copy", err)
+				os.Exit(1)
+			}
+		}
+		// A pre-existing compiled file would not contain the schemas we just added
+		if helpers.Exists(appdir.Path + schemasDir + "/gschemas.compiled") {
+			log.Println("Removing pre-existing gschemas.compiled so that it gets recompiled...")
+			err = os.Remove(appdir.Path + schemasDir + "/gschemas.compiled")
+			if err != nil {
+				helpers.PrintError("Remove", err)
+			}
+		}
+	}
+	err = handleGlibSchemas(appdir)
+	if err != nil {
+		helpers.PrintError("Could not deploy GLib schemas", err)
+	}
+
+	err = addToAppRun(appdir, "Use bundled Gtk 4", []string{
+		"export GTK_PATH=" + strings.Join(gtkPaths, ":") + ":\"${GTK_PATH}\"",
+		"export GTK_EXE_PREFIX=\"${HERE}\"/usr",
+		"export GTK_DATA_PREFIX=\"${HERE}\"/usr",
+		"export GSETTINGS_SCHEMA_DIR=\"${HERE}\"/usr/share/glib-2.0/schemas/:\"${GSETTINGS_SCHEMA_DIR}\"",
+	})
+	if err != nil {
+		helpers.PrintError("Could not add Gtk 4 to AppRun", err)
+	}
+}
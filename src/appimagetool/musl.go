@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/probonopd/go-appimage/internal/helpers"
+)
+
+// Alpine Linux and other distributions use musl rather than glibc. musl has a single
+// ld-musl-<arch>.so.1 which is both the dynamic loader and libc (libc.musl-<arch>.so.1 is
+// a symlink to it). It reads its search path from /etc/ld-musl-<arch>.path rather than
+// /etc/ld.so.conf, has no ld.so.cache, and has no gconv modules since iconv is built in.
+
+var muslInterpreterRegexp = regexp.MustCompile(`^ld-musl-([A-Za-z0-9_]+)\.so\.1$`)
+
+// muslArch is the architecture in the name of the musl dynamic loader (e.g., "x86_64")
+// and muslInterpreter its path if the main executable uses musl, otherwise ""; set by detectLibc
+var muslArch = ""
+var muslInterpreter = ""
+
+// muslSysPath is the search path compiled into the musl dynamic loader,
+// used if there is no /etc/ld-musl-<arch>.path
+const muslSysPath = "/lib:/usr/local/lib:/usr/lib"
+
+// getMuslArch returns the architecture if interpreter is the musl dynamic loader, otherwise ""
+func getMuslArch(interpreter string) string {
+	match := muslInterpreterRegexp.FindStringSubmatch(filepath.Base(interpreter))
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// readInterpreter returns the ELF interpreter of the executable at path, or ""
+func readInterpreter(path string) string {
+	e, err := elf.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer e.Close()
+	for _, prog := range e.Progs {
+		if prog.Type == elf.PT_INTERP {
+			data, err := ioutil.ReadAll(prog.Open())
+			if err != nil {
+				return ""
+			}
+			return string(bytes.TrimRight(data, "\x00"))
+		}
+	}
+	return ""
+}
+
+// detectLibc determines whether the main executable of the AppDir uses musl and, if so,
+// switches to the musl exclude list. Needs to be called before determining the libraries
+func detectLibc(appdir helpers.AppDir) error {
+	interpreter := readInterpreter(appdir.MainExecutable)
+	muslArch = getMuslArch(interpreter)
+	if muslArch == "" {
+		return nil
+	}
+	muslInterpreter = interpreter
+	log.Println("The main executable uses musl libc for", muslArch)
+	if options.libAppRunHooks == true {
+		return errors.New("libapprun_hooks requires glibc and cannot be used with musl libc")
+	}
+	ExcludedLibraries = muslExcludedLibraries(muslArch)
+	return nil
+}
+
+// muslExcludedLibraries returns the libraries that are expected to be on musl target systems:
+// musl itself, and those from the excludelist which are not part of the glibc family.
+// libstdc++ is bundled because it is not installed on minimal musl systems
+func muslExcludedLibraries(arch string) []string {
+	excluded := []string{"ld-musl-" + arch + ".so.1", "libc.musl-" + arch + ".so.1"}
+	for _, lib := range ExcludedLibraries {
+		if checkWhetherPartOfLibc(lib) == false {
+			excluded = append(excluded, lib)
+		}
+	}
+	return excluded
+}
+
+// isMuslLibc returns true if path is the musl dynamic loader or libc.musl-<arch>.so.1
+// of the main executable, which must not be patched
+func isMuslLibc(path string) bool {
+	if muslArch == "" {
+		return false
+	}
+	base := filepath.Base(path)
+	return base == "ld-musl-"+muslArch+".so.1" || base == "libc.musl-"+muslArch+".so.1"
+}
+
+// getDirsFromMuslPath returns the directories in the musl path file at path,
+// usually /etc/ld-musl-<arch>.path, which are separated by ":" or newlines
+func getDirsFromMuslPath(path string) []string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var out []string
+	for _, dir := range strings.FieldsFunc(string(data), func(r rune) bool { return r == ':' || r == '\n' }) {
+		if strings.TrimSpace(dir) != "" {
+			out = append(out, strings.TrimSpace(dir))
+		}
+	}
+	return out
+}
+
+// patchMuslLoader makes the bundled musl dynamic loader ignore the libraries on the target system.
+// Unlike ld-linux, it must not have /etc and /usr patched away everywhere
+// because it is also libc, which needs, e.g., /etc/resolv.conf and /usr/share/zoneinfo
+func patchMuslLoader(path string) error {
+	err := PatchFile(path, muslSysPath, "/XXX:/xxx/local/lib:/xxx/lib")
+	if err != nil {
+		return err
+	}
+	return PatchFile(path, "/etc/ld-musl-", "/EEE/ld-musl-")
+}
+
+// deployMuslLibc links libc.musl-<arch>.so.1 to the bundled dynamic loader rather than
+// copying it, since both are the same file, and returns true if lib is libc.musl-<arch>.so.1
+func deployMuslLibc(appdir helpers.AppDir, lib string) (bool, error) {
+	if isMuslLibc(lib) == false || strings.HasPrefix(filepath.Base(lib), "libc.musl-") == false {
+		return false, nil
+	}
+	target := appdir.Path + "/" + lib
+	if helpers.Exists(target) {
+		return true, nil
+	}
+	rel, err := filepath.Rel(filepath.Dir(lib), muslInterpreter)
+	if err != nil {
+		return true, err
+	}
+	log.Println("Linking", lib, "to", rel)
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return true, err
+	}
+	return true, os.Symlink(rel, target)
+}
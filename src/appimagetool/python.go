@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/otiai10/copy"
+	"github.com/probonopd/go-appimage/internal/helpers"
+)
+
+// AppRunData exports PYTHONHOME, but that alone is not sufficient for a bundled
+// Python to work on systems that do not have the same Python installed.
+// Hence we bundle the standard library and the site-packages of the interpreter
+// the application was built against, byte-compile them (the squashfs is read-only,
+// so Python could not write the .pyc files at runtime), and deploy the dependencies
+// of the extension modules like any other ELF in the AppDir.
+
+var pythonVersionRegexp = regexp.MustCompile(`^(?:lib)?python(3\.[0-9]+)`)
+
+// handlePython bundles the Python standard library and site-packages if the application
+// links against libpython3.* or if there is a python3 executable in the AppDir
+func handlePython(appdir helpers.AppDir) {
+	pythonVersion := detectPythonVersion(appdir)
+	if pythonVersion == "" {
+		return
+	}
+	log.Println("Detected Python", pythonVersion)
+
+	interpreter, err := exec.LookPath("python" + pythonVersion)
+	if err != nil {
+		helpers.PrintError("Could not find python"+pythonVersion+" on the build system, which is needed to determine the standard library", err)
+		os.Exit(1)
+	}
+
+	pythonDirs, err := getPythonDirs(interpreter)
+	if err != nil {
+		helpers.PrintError("Could not determine the Python directories", err)
+		os.Exit(1)
+	}
+
+	var pythonPath []string
+	for _, pythonDir := range pythonDirs {
+		if strings.HasPrefix(pythonDir, appdir.Path) {
+			continue
+		}
+		log.Println("Bundling", pythonDir+"...")
+		err = copy.Copy(pythonDir, appdir.Path+pythonDir, copy.Options{
+			Skip: func(src string) (bool, error) {
+				// The tests of the standard library are large and not needed at runtime
+				base := filepath.Base(src)
+				return base == "__pycache__" || base == "test" && filepath.Dir(src) == pythonDirs[0], nil
+			},
+		})
+		if err != nil {
+			helpers.PrintError("Could not copy "+pythonDir, err)
+			os.Exit(1)
+		}
+		pythonPath = append(pythonPath, "\"${HERE}\""+pythonDir)
+
+		// Extension modules are ELF files and need their dependencies deployed, too
+		log.Println("Determining dependencies of the Python extension modules in", pythonDir+"...")
+		determineELFsInDirTree(appdir, appdir.Path+pythonDir)
+	}
+
+	log.Println("Byte-compiling the bundled Python modules...")
+	for _, pythonDir := range pythonDirs {
+		// The AppImage is read-only, so the .pyc files need to be there already;
+		// use hashes rather than timestamps so that they stay valid regardless of mtimes
+		cmd := exec.Command(interpreter, "-m", "compileall", "-q", "-j", "0",
+			"--invalidation-mode", "unchecked-hash", "-d", pythonDir, appdir.Path+pythonDir)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			// Some third-party modules contain files which are not valid Python 3
+			log.Println(cmd.String())
+			log.Println("Byte-compiling did not succeed for all files:", strings.TrimSpace(string(out)))
+		}
+	}
+
+	// PYTHONHOME is already exported by AppRun; sys.path needs to point to the bundled locations
+	// regardless of which platlibdir the interpreter was built with
+	err = addToAppRun(appdir, "Use bundled Python "+pythonVersion, []string{
+		"export PYTHONPATH=" + strings.Join(pythonPath, ":") + ":\"${PYTHONPATH}\"",
+		"export PYTHONDONTWRITEBYTECODE=1",
+	})
+	if err != nil {
+		helpers.PrintError("Could not add Python to AppRun", err)
+	}
+}
+
+// detectPythonVersion returns the Python version (e.g., "3.8") the application needs,
+// or "" if Python is not needed
+func detectPythonVersion(appdir helpers.AppDir) string {
+	for _, lib := range allELFs {
+		if strings.HasPrefix(filepath.Base(lib), "libpython3.") {
+			match := pythonVersionRegexp.FindStringSubmatch(filepath.Base(lib))
+			if match != nil {
+				return match[1]
+			}
+		}
+	}
+
+	pythons := helpers.FilesWithPrefixInDirectory(appdir.Path+"/usr/bin", "python3")
+	for _, python := range pythons {
+		// python3 is usually a symlink to, e.g., python3.8
+		resolved, err := filepath.EvalSymlinks(python)
+		if err != nil {
+			continue
+		}
+		match := pythonVersionRegexp.FindStringSubmatch(filepath.Base(resolved))
+		if match != nil {
+			return match[1]
+		}
+	}
+	if len(pythons) > 0 {
+		// An unversioned python3 in the AppDir, ask the interpreter on the build system
+		out, err := exec.Command("python3", "-c", "import sys; print('%d.%d' % sys.version_info[:2])").Output()
+		if err == nil {
+			return strings.TrimSpace(string(out))
+		}
+	}
+	return ""
+}
+
+// getPythonDirs returns the standard library directory of the interpreter (first)
+// followed by the existing site-packages and dist-packages directories
+func getPythonDirs(interpreter string) ([]string, error) {
+	script := "import site, sysconfig\n" +
+		"print(sysconfig.get_paths()['stdlib'])\n" +
+		"print(sysconfig.get_paths()['platstdlib'])\n" +
+		"for p in site.getsitepackages(): print(p)\n"
+	out, err := exec.Command(interpreter, "-c", script).Output()
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		dir := filepath.Clean(strings.TrimSpace(line))
+		if helpers.IsDirectory(dir) == false {
+			continue
+		}
+		// Do not bundle directories twice if one is inside another
+		alreadyContained := false
+		for _, existing := range dirs {
+			if dir == existing || strings.HasPrefix(dir, existing+"/") {
+				alreadyContained = true
+				break
+			}
+		}
+		if alreadyContained == false {
+			dirs = append(dirs, dir)
+		}
+	}
+	if len(dirs) < 1 {
+		return nil, errors.New(interpreter + " did not report any existing directories")
+	}
+	return dirs, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/probonopd/go-appimage/internal/helpers"
+	"gopkg.in/ini.v1"
+)
+
+// Instead of patching qt_prfxpath inside libQt5Core.so.5 (which only works as long as the
+// new path is not longer than the original one), Qt can be told where its components are
+// by a qt.conf file in the directory of the running executable, see
+// https://doc.qt.io/qt-5/qt-conf.html
+// Note that Qt looks for qt.conf in QCoreApplication::applicationDirPath(), which is the
+// directory of /proc/self/exe. Hence if we run through a bundled ld-linux, then this is
+// the directory ld-linux is in, not the directory of the main executable.
+
+// findQtPrefixDirInAppDir returns the directory inside the AppDir which contains
+// the Qt 'plugins' directory, or "" if it cannot be found
+func findQtPrefixDirInAppDir(libraryLocationsInAppDir []string) string {
+	for _, libraryLocationInAppDir := range libraryLocationsInAppDir {
+		if strings.HasSuffix(libraryLocationInAppDir, "/plugins/platforms") {
+			return filepath.Dir(filepath.Dir(libraryLocationInAppDir))
+		}
+	}
+	return ""
+}
+
+// generateQtConf returns the contents of a qt.conf file for the directory dir
+// which points Qt to the Qt prefix directory qtPrefixDir
+func generateQtConf(dir string, qtPrefixDir string) (string, error) {
+	relPathToQt, err := filepath.Rel(dir, qtPrefixDir)
+	if err != nil {
+		return "", err
+	}
+	conf := "[Paths]\n"
+	conf = conf + "Prefix=" + relPathToQt + "\n"
+	conf = conf + "Plugins=plugins\n"
+	conf = conf + "Qml2Imports=qml\n"
+	conf = conf + "Translations=translations\n"
+	return conf, nil
+}
+
+// writeQtConf writes qt.conf next to the main executable (and next to ld-linux if it is bundled)
+// so that the bundled Qt finds its plugins without any binary patching,
+// and exports the matching QT_PLUGIN_PATH and QML2_IMPORT_PATH in AppRun
+func writeQtConf(appdir helpers.AppDir, libraryLocationsInAppDir []string, ldLinux string) error {
+	qtPrefixDir := findQtPrefixDirInAppDir(libraryLocationsInAppDir)
+	if qtPrefixDir == "" {
+		return errors.New("could not determine the Qt prefix directory")
+	}
+	log.Println("Qt prefix directory in the AppDir:", qtPrefixDir)
+
+	dirs := []string{filepath.Dir(appdir.MainExecutable)}
+	if options.standalone && ldLinux != "" {
+		dirs = helpers.AppendIfMissing(dirs, filepath.Dir(appdir.Path+ldLinux))
+	}
+
+	for _, dir := range dirs {
+		conf, err := generateQtConf(dir, qtPrefixDir)
+		if err != nil {
+			return err
+		}
+		log.Println("Writing", dir+"/qt.conf")
+		err = ioutil.WriteFile(dir+"/qt.conf", []byte(conf), 0644)
+		if err != nil {
+			return err
+		}
+		err = verifyQtConf(dir + "/qt.conf")
+		if err != nil {
+			return err
+		}
+	}
+
+	relPathToQt, err := filepath.Rel(appdir.Path, qtPrefixDir)
+	if err != nil {
+		return err
+	}
+	exports := []string{"export QT_PLUGIN_PATH=\"${HERE}\"/" + relPathToQt + "/plugins/:\"${QT_PLUGIN_PATH}\""}
+	if helpers.IsDirectory(qtPrefixDir + "/qml") {
+		exports = append(exports, "export QML2_IMPORT_PATH=\"${HERE}\"/"+relPathToQt+"/qml/:\"${QML2_IMPORT_PATH}\"")
+	}
+	return addToAppRun(appdir, "Use bundled Qt (paths match qt.conf)", exports)
+}
+
+// verifyQtConf checks that the Qt platform plugins can be resolved
+// from the paths given in the qt.conf file at path
+func verifyQtConf(path string) error {
+	cfg, err := ini.Load(path)
+	if err != nil {
+		return err
+	}
+	prefix := cfg.Section("Paths").Key("Prefix").String()
+	plugins := cfg.Section("Paths").Key("Plugins").String()
+	if filepath.IsAbs(prefix) {
+		return errors.New("Prefix in " + path + " is not relative")
+	}
+	pluginsDir := filepath.Join(filepath.Dir(path), prefix, plugins)
+	if helpers.IsDirectory(pluginsDir+"/platforms") == false {
+		return errors.New("Qt plugins do not resolve: " + pluginsDir + "/platforms does not exist")
+	}
+	platformPlugins := helpers.FilesWithSuffixInDirectory(pluginsDir+"/platforms", ".so")
+	if len(platformPlugins) < 1 {
+		return errors.New("Qt plugins do not resolve: no platform plugins in " + pluginsDir + "/platforms")
+	}
+	log.Println("Qt plugins resolve from", path, "to", pluginsDir)
+	return nil
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/otiai10/copy"
+	"github.com/probonopd/go-appimage/internal/helpers"
+)
+
+// In self-contained mode, the bundled ld-linux is patched so that it does not load anything
+// from the target system. But libc also loads data and modules at runtime: gconv modules
+// for iconv, NSS modules for user, group, and host lookups (both with dlopen), compiled
+// locale data, and gettext catalogs. Those are bundled here, too.
+// Since the paths to locale data and catalogs are compiled into libc and the libraries,
+// they are patched from /usr/... to ././/..., which resolves to usr/ in the AppDir
+// because AppRun changes into it, like what is done for .ui files.
+
+// gconvDirInAppDir is where the gconv modules go; must match GCONV_PATH exported in AppRun
+const gconvDirInAppDir = "usr/lib/gconv"
+
+// localeDir and localeDataDir are the default locations of gettext catalogs and compiled locale data
+const localeDir = "/usr/share/locale"
+const localeDataDir = "/usr/lib/locale"
+
+// muslLocaleDir is where musl-locales puts the translations of musl's messages (for MUSL_LOCPATH)
+const muslLocaleDir = "/usr/share/i18n/locales/musl"
+
+// deployGconv bundles the gconv modules and their configuration
+func deployGconv(appdir helpers.AppDir) error {
+	log.Println("Determining gconv (for GCONV_PATH)...")
+	// Search in all of the system's library directories for a directory called gconv
+	gconvs, err := findWithPrefixInLibraryLocations("gconv")
+	if err != nil {
+		return err
+	}
+	log.Println("Bundling", gconvs[0], "to", gconvDirInAppDir+"...")
+	// Including gconv-modules and gconv-modules.d, without which only the built-in conversions work
+	err = copy.Copy(gconvs[0], appdir.Path+"/"+gconvDirInAppDir)
+	if err != nil {
+		return err
+	}
+	determineELFsInDirTree(appdir, appdir.Path+"/"+gconvDirInAppDir)
+	return nil
+}
+
+// getNSSServices returns the services (e.g., "files", "systemd") used in the nsswitch.conf at path
+func getNSSServices(path string) []string {
+	var services []string
+	f, err := os.Open(path)
+	if err != nil {
+		return services
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.SplitN(scanner.Text(), "#", 2)[0])
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		for _, service := range strings.Fields(parts[1]) {
+			// E.g., [NOTFOUND=return]
+			if strings.HasPrefix(service, "[") == false {
+				services = helpers.AppendIfMissing(services, service)
+			}
+		}
+	}
+	return services
+}
+
+// deployNSSModules bundles the NSS modules which the build system uses for lookups.
+// libc loads them with dlopen, hence they are not dependencies of any ELF.
+// Modules which are not bundled but configured on the target system are skipped by libc.
+// libc opens them on behalf of the main program, so that neither its own RUNPATH nor that
+// of the library doing the lookup is searched; hence their directories are given to the bundled
+// dynamic loader with --library-path. Unlike LD_LIBRARY_PATH, this is not inherited by programs
+// the application launches, which would otherwise load the bundled libc with the ld-linux of the host
+func deployNSSModules(appdir helpers.AppDir) error {
+	var dirs []string
+	for _, service := range getNSSServices("/etc/nsswitch.conf") {
+		// Since glibc 2.34, "files" and "dns" are built into libc
+		lib, err := findLibrary("libnss_" + service + ".so.2")
+		if err != nil {
+			continue
+		}
+		log.Println("Bundling NSS module", lib+"...")
+		determineELFsInDirTree(appdir, lib)
+		dirs = helpers.AppendIfMissing(dirs, strings.TrimPrefix(filepath.Dir(lib), "/"))
+	}
+	if len(dirs) == 0 {
+		return nil
+	}
+	if options.nativeAppRun == true {
+		return appendLinesToFile(appdir.Path+"/"+AppRunEnvFile, []string{"", "# Load bundled NSS modules", "APPRUN_LIBRARY_PATH=" + strings.Join(dirs, ":")})
+	}
+	// Not exported, only used by AppRun for running the bundled dynamic loader
+	for i, dir := range dirs {
+		dirs[i] = "${HERE}/" + dir
+	}
+	return addToAppRun(appdir, "Load bundled NSS modules", []string{"LD_LINUX_LIBRARY_PATH=\"" + strings.Join(dirs, ":") + "\""})
+}
+
+// matchesLanguages returns true if the locale (e.g., "de_AT", "sr@latin")
+// is for one of the languages, or if no languages are given
+func matchesLanguages(locale string, languages []string) bool {
+	if len(languages) == 0 {
+		return true
+	}
+	for _, language := range languages {
+		if locale == language || strings.HasPrefix(locale, language+"_") || strings.HasPrefix(locale, language+"@") {
+			return true
+		}
+	}
+	return false
+}
+
+// deployTranslations bundles the gettext catalogs of the system for the text domains
+// used by the ELFs in the AppDir, returns the number of catalogs bundled
+func deployTranslations(appdir helpers.AppDir, languages []string) (int, error) {
+	// Text domain -> catalogs
+	catalogs := make(map[string][]string)
+	mos, _ := filepath.Glob(localeDir + "/*/LC_MESSAGES/*.mo")
+	for _, mo := range mos {
+		locale := filepath.Base(filepath.Dir(filepath.Dir(mo)))
+		if matchesLanguages(locale, languages) == false {
+			continue
+		}
+		domain := strings.TrimSuffix(filepath.Base(mo), ".mo")
+		catalogs[domain] = append(catalogs[domain], mo)
+	}
+
+	// Text domains are passed to bindtextdomain and dgettext as string literals,
+	// so a domain is used if it is (the tail of) one of the null-terminated strings in .rodata of an ELF
+	used := make(map[string]bool)
+	for _, lib := range allELFs {
+		for _, domain := range findTextDomains(lib, catalogs) {
+			if used[domain] == false {
+				log.Println("Text domain", domain, "is used by", lib)
+				used[domain] = true
+			}
+		}
+	}
+
+	count := 0
+	for domain := range used {
+		for _, mo := range catalogs[domain] {
+			if helpers.Exists(appdir.Path + mo) {
+				continue
+			}
+			err := helpers.CopyFile(mo, appdir.Path+mo)
+			if err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, nil
+}
+
+// findTextDomains returns those of the text domains that are (tails of) strings in .rodata of the ELF at path,
+// reading it only once for all of them
+func findTextDomains(path string, domains map[string][]string) []string {
+	var results []string
+	e, err := elf.Open(path)
+	if err != nil {
+		return results
+	}
+	defer e.Close()
+	section := e.Section(".rodata")
+	if section == nil {
+		return results
+	}
+	data, err := section.Data()
+	if err != nil {
+		return results
+	}
+	return findTextDomainsInStrings(data, domains)
+}
+
+// findTextDomainsInStrings returns those of the text domains that are (tails of) the null-terminated strings in data
+func findTextDomainsInStrings(data []byte, domains map[string][]string) []string {
+	var results []string
+	// The linker merges strings which are the tail of others, e.g., "coreutils" into "GNU coreutils",
+	// hence the tails of the strings are looked up, but only those which are not longer than the longest domain
+	longest := 0
+	for domain := range domains {
+		if len(domain) > longest {
+			longest = len(domain)
+		}
+	}
+	for _, s := range bytes.Split(data, []byte{0}) {
+		start := 0
+		if len(s) > longest {
+			start = len(s) - longest
+		}
+		for i := start; i < len(s); i++ {
+			if _, ok := domains[string(s[i:])]; ok == true {
+				results = helpers.AppendIfMissing(results, string(s[i:]))
+			}
+		}
+	}
+	return results
+}
+
+// handleRuntimeData bundles what libc loads at runtime in self-contained mode, except translations.
+// Needs to be called before the ELFs get deployed so that the modules get deployed with them
+func handleRuntimeData(appdir helpers.AppDir) error {
+	if options.libAppRunHooks == true {
+		// The libapprun_hooks AppRun does not change into usr/, and the bundled libc is not always used
+		log.Println("Not bundling locale data, gconv and NSS modules because libapprun_hooks is used")
+		return nil
+	}
+
+	if muslArch == "" {
+		err := deployGconv(appdir)
+		if err != nil {
+			return err
+		}
+		err = deployNSSModules(appdir)
+		if err != nil {
+			return err
+		}
+		if helpers.IsDirectory(localeDataDir) {
+			log.Println("Bundling compiled locale data from", localeDataDir+"...")
+			err = copy.Copy(localeDataDir, appdir.Path+localeDataDir, copy.Options{OnSymlink: func(string) copy.SymlinkAction { return copy.Deep }})
+			if err != nil {
+				return err
+			}
+		}
+	} else if helpers.IsDirectory(muslLocaleDir) {
+		// musl has no gconv modules, NSS modules, or compiled locale data,
+		// but translations of its own messages
+		log.Println("Bundling musl locales from", muslLocaleDir+"...")
+		err := copy.Copy(muslLocaleDir, appdir.Path+muslLocaleDir)
+		if err != nil {
+			return err
+		}
+		err = addToAppRun(appdir, "Use bundled musl locales", []string{"export MUSL_LOCPATH=\"${HERE}\"" + muslLocaleDir})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// handleTranslations bundles the gettext catalogs for the ELFs in the AppDir in self-contained mode.
+// Needs to be called after all handlers have added the ELFs they deploy
+func handleTranslations(appdir helpers.AppDir, languages []string) error {
+	if options.libAppRunHooks == true {
+		return nil
+	}
+	log.Println("Bundling translations...")
+	count, err := deployTranslations(appdir, languages)
+	if err != nil {
+		return err
+	}
+	log.Println("Bundled", count, "translations")
+	if helpers.IsDirectory(appdir.Path + localeDir) {
+		// For gettext.sh and bash $"..." strings
+		return addToAppRun(appdir, "Use bundled translations", []string{"export TEXTDOMAINDIR=\"${HERE}\"" + localeDir})
+	}
+	return nil
+}
+
+// patchLocalePaths makes the ELFs in the AppDir load catalogs and locale data from the AppDir.
+// Needs to be called after the ELFs have been deployed
+func patchLocalePaths(appdir helpers.AppDir) error {
+	if options.libAppRunHooks == true {
+		return nil
+	}
+	patches := map[string]string{localeDir: "././/share/locale"}
+	if helpers.IsDirectory(appdir.Path + localeDataDir) {
+		patches[localeDataDir] = "././/lib/locale"
+	}
+	elfs, err := findAllExecutablesAndLibraries(appdir.Path)
+	if err != nil {
+		return err
+	}
+	for _, path := range elfs {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for search, replace := range patches {
+			if bytes.Contains(data, []byte(search)) {
+				log.Println("Patching", search, "in", path)
+				err = PatchFile(path, search, replace)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// parseLocales parses the comma-separated list of languages given with --locales
+func parseLocales(value string) []string {
+	var languages []string
+	for _, language := range strings.Split(value, ",") {
+		if strings.TrimSpace(language) != "" {
+			languages = append(languages, strings.TrimSpace(language))
+		}
+	}
+	return languages
+}
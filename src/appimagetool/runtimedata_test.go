@@ -0,0 +1,21 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFindTextDomainsInStrings(t *testing.T) {
+	domains := map[string][]string{"coreutils": nil, "gtk30": nil, "unused": nil}
+	data := []byte("\x00GNU coreutils\x00%s: invalid option\x00gtk30\x00libgtk30-extra\x00")
+	found := findTextDomainsInStrings(data, domains)
+	if strings.Join(found, ",") != "coreutils,gtk30" {
+		t.Error("Expected coreutils and gtk30, got", found)
+	}
+	if len(findTextDomainsInStrings(data, map[string][]string{"invalid": nil, "GNU": nil})) != 0 {
+		t.Error("Expected no domains which are only the beginning or the middle of strings")
+	}
+	if len(findTextDomains("/nonexistent", domains)) != 0 {
+		t.Error("Expected no domains for a file that does not exist")
+	}
+}
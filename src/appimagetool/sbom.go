@@ -0,0 +1,613 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/probonopd/go-appimage/internal/helpers"
+	"github.com/probonopd/go-appimage/src/goappimage"
+	"gopkg.in/ini.v1"
+)
+
+// A software bill of materials (SBOM) lists what went into the AppImage:
+// the packages the bundled files were taken from (as reported by the package manager
+// of the build system), their versions and licenses, the hashes of all files,
+// and which packages depend on which (derived from the DT_NEEDED entries of the ELF files).
+// Files that do not belong to any package of the build system are attributed to the application itself.
+// The SBOM can be embedded into the AppImage at SBOMDir so that it travels with the AppImage
+// and can be extracted again with 'appimagetool sbom'.
+
+// SBOMDir is the directory inside the AppDir in which embedded SBOMs are stored
+const SBOMDir = "usr/share/sbom"
+
+// sbomFormats maps the supported formats to the file names of the SBOMs
+var sbomFormats = map[string]string{
+	"spdx":      "appimage.spdx.json",
+	"cyclonedx": "appimage.cdx.json",
+}
+
+// spdxIDRegexp matches the characters that are not allowed in SPDX identifiers
+var spdxIDRegexp = regexp.MustCompile(`[^A-Za-z0-9.-]`)
+
+type sbomFile struct {
+	Path   string // Relative to the AppDir
+	SHA1   string
+	SHA256 string
+	Needed []string // DT_NEEDED entries if the file is an ELF
+}
+
+type sbomPackage struct {
+	Name      string
+	Version   string
+	License   string
+	Files     []*sbomFile
+	DependsOn []string // Names of other packages
+}
+
+type sbom struct {
+	Name     string
+	Version  string
+	App      *sbomPackage // Files that are not part of any package of the build system
+	Packages []*sbomPackage
+	Created  time.Time
+	UUID     string
+}
+
+// parseSBOMFormats parses a comma-separated list of SBOM formats
+func parseSBOMFormats(formats string) ([]string, error) {
+	var results []string
+	for _, format := range strings.Split(formats, ",") {
+		format = strings.ToLower(strings.TrimSpace(format))
+		if format == "" {
+			continue
+		}
+		if _, ok := sbomFormats[format]; ok == false {
+			return nil, errors.New("unsupported SBOM format '" + format + "', supported are spdx, cyclonedx")
+		}
+		results = helpers.AppendIfMissing(results, format)
+	}
+	return results, nil
+}
+
+// writeSBOMs generates SBOMs in the given formats for the AppDir at appdirPath.
+// If embed is true, they are written to SBOMDir inside the AppDir so that they become part
+// of the AppImage, otherwise into the current working directory
+func writeSBOMs(appdirPath string, formats []string, embed bool) error {
+	if len(formats) == 0 {
+		return nil
+	}
+	log.Println("Generating software bill of materials...")
+	s, err := collectSBOM(appdirPath)
+	if err != nil {
+		return err
+	}
+	for _, format := range formats {
+		var data []byte
+		switch format {
+		case "spdx":
+			data, err = json.MarshalIndent(s.spdx(), "", "  ")
+		case "cyclonedx":
+			data, err = json.MarshalIndent(s.cycloneDX(), "", "  ")
+		}
+		if err != nil {
+			return err
+		}
+		var target string
+		if embed == true {
+			err = os.MkdirAll(appdirPath+"/"+SBOMDir, 0755)
+			if err != nil {
+				return err
+			}
+			target = appdirPath + "/" + SBOMDir + "/" + sbomFormats[format]
+		} else {
+			target = strings.Replace(s.Name, " ", "_", -1) + "." + strings.TrimPrefix(sbomFormats[format], "appimage.")
+		}
+		log.Println("Writing", target)
+		err = ioutil.WriteFile(target, data, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractSBOMs extracts the SBOMs embedded in the AppImage at path into the current working directory
+// and returns the names of the files written
+func extractSBOMs(path string) ([]string, error) {
+	ai, err := goappimage.NewAppImage(path)
+	if err != nil {
+		return nil, err
+	}
+	var written []string
+	var names []string
+	for _, name := range sbomFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rdr, err := ai.ExtractFileReader(SBOMDir + "/" + name)
+		if err != nil {
+			continue
+		}
+		target := strings.Replace(ai.Name, " ", "_", -1) + "." + strings.TrimPrefix(name, "appimage.")
+		f, err := os.Create(target)
+		if err != nil {
+			rdr.Close()
+			return written, err
+		}
+		_, err = io.Copy(f, rdr)
+		rdr.Close()
+		f.Close()
+		if err != nil {
+			return written, err
+		}
+		written = append(written, target)
+	}
+	if len(written) == 0 {
+		return nil, errors.New(path + " does not contain a software bill of materials in " + SBOMDir)
+	}
+	return written, nil
+}
+
+// collectSBOM determines the packages, versions, licenses, file hashes,
+// and dependencies of everything in the AppDir at appdirPath
+func collectSBOM(appdirPath string) (*sbom, error) {
+	s := sbom{Created: time.Now().UTC(), UUID: newUUID()}
+	s.Name, s.Version = getAppNameAndVersion(appdirPath)
+	s.App = &sbomPackage{Name: s.Name, Version: s.Version}
+
+	pm := getPackageManager()
+	if pm == nil {
+		log.Println("No supported package manager (dpkg, rpm, pacman, apk) found, hence the SBOM will not contain packages")
+	}
+
+	packages := make(map[string]*sbomPackage)
+	var files []*sbomFile
+	symlinks := make(map[string][]string) // Key: Path of the target relative to the AppDir, value: names of the symlinks
+	err := filepath.Walk(appdirPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(appdirPath, path)
+		if info.IsDir() && rel == SBOMDir {
+			return filepath.SkipDir
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			// Libraries are often referenced by symlinks such as libfoo.so.1 -> libfoo.so.1.2.3
+			resolved, err := filepath.EvalSymlinks(path)
+			if err == nil {
+				target, _ := filepath.Rel(appdirPath, resolved)
+				symlinks[target] = append(symlinks[target], filepath.Base(rel))
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() == false {
+			return nil
+		}
+		file := sbomFile{Path: rel}
+		file.SHA1, file.SHA256, err = hashFile(path)
+		if err != nil {
+			return err
+		}
+		isELF := false
+		buildID := ""
+		if e, err := elf.Open(path); err == nil {
+			isELF = true
+			file.Needed, _ = e.ImportedLibraries()
+			buildID = getBuildID(e)
+			e.Close()
+		}
+		files = append(files, &file)
+
+		// Deployed files are at the same location inside the AppDir as on the build system;
+		// only ELF files are looked up because asking the package manager about every file takes long
+		owner := s.App
+		if pm != nil && isELF == true {
+			hostPath := "/" + strings.TrimPrefix(rel, LibcDir+"/")
+			if isSameAsHostFile(hostPath, info.Size(), file.SHA256, buildID) {
+				pkg, err := getPackageContainingFile(pm, hostPath)
+				if err == nil {
+					if _, ok := packages[pkg]; ok == false {
+						packages[pkg] = newSBOMPackage(pm, pkg)
+					}
+					owner = packages[pkg]
+				}
+			}
+		}
+		owner.Files = append(owner.Files, &file)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Package-level dependencies, resolved by the file names of the DT_NEEDED entries
+	s.Packages = sortedSBOMPackages(packages)
+	ownerOfLibrary := make(map[string]*sbomPackage)
+	for _, p := range append([]*sbomPackage{s.App}, s.Packages...) {
+		for _, f := range p.Files {
+			ownerOfLibrary[filepath.Base(f.Path)] = p
+			for _, name := range symlinks[f.Path] {
+				ownerOfLibrary[name] = p
+			}
+		}
+	}
+	for _, p := range append([]*sbomPackage{s.App}, s.Packages...) {
+		for _, f := range p.Files {
+			for _, needed := range f.Needed {
+				dep, ok := ownerOfLibrary[needed]
+				if ok == true && dep != p {
+					p.DependsOn = helpers.AppendIfMissing(p.DependsOn, dep.Name)
+				}
+			}
+		}
+		sort.Strings(p.DependsOn)
+	}
+	log.Println("SBOM contains", len(files), "files from", len(s.Packages), "packages")
+	return &s, nil
+}
+
+// isSameAsHostFile returns true if the file at hostPath on the build system is the one that was
+// deployed, rather than an unrelated file that happens to be at the same location: it has the
+// same contents, or since deploying changes the RPATH and may strip, the same build-id
+func isSameAsHostFile(hostPath string, size int64, sha256 string, buildID string) bool {
+	info, err := os.Stat(hostPath)
+	if err != nil || info.Mode().IsRegular() == false {
+		return false
+	}
+	if info.Size() == size {
+		if _, hostSHA256, err := hashFile(hostPath); err == nil && hostSHA256 == sha256 {
+			return true
+		}
+	}
+	if buildID == "" {
+		return false
+	}
+	e, err := elf.Open(hostPath)
+	if err != nil {
+		return false
+	}
+	defer e.Close()
+	return getBuildID(e) == buildID
+}
+
+// newSBOMPackage asks the package manager for the version and license of pkg
+func newSBOMPackage(pm packageManager, pkg string) *sbomPackage {
+	p := sbomPackage{Name: pkg}
+	version, err := pm.PackageVersion(pkg)
+	if err != nil {
+		log.Println("Could not determine the version of", pkg+":", err)
+	}
+	p.Version = version
+	license, err := pm.PackageLicense(pkg)
+	if err != nil {
+		log.Println("Could not determine the license of", pkg+":", err)
+	}
+	p.License = license
+	return &p
+}
+
+func sortedSBOMPackages(packages map[string]*sbomPackage) []*sbomPackage {
+	var results []*sbomPackage
+	for _, p := range packages {
+		results = append(results, p)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+	return results
+}
+
+// getAppNameAndVersion returns the name and version of the application in the AppDir.
+// The version is taken from $VERSION like GenerateAppImage does, or from X-AppImage-Version
+func getAppNameAndVersion(appdirPath string) (string, string) {
+	name := filepath.Base(appdirPath)
+	version := os.Getenv("VERSION")
+	desktopFiles := helpers.FilesWithSuffixInDirectory(appdirPath, ".desktop")
+	if len(desktopFiles) > 0 {
+		cfg, err := ini.LoadSources(ini.LoadOptions{IgnoreInlineComment: true}, desktopFiles[0])
+		if err == nil {
+			sect := cfg.Section("Desktop Entry")
+			if sect.Key("Name").String() != "" {
+				name = sect.Key("Name").String()
+			}
+			if version == "" {
+				version = sect.Key("X-AppImage-Version").String()
+			}
+		}
+	}
+	return name, version
+}
+
+func hashFile(path string) (string, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	h1 := sha1.New()
+	h256 := sha256.New()
+	_, err = io.Copy(io.MultiWriter(h1, h256), f)
+	if err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(h1.Sum(nil)), hex.EncodeToString(h256.Sum(nil)), nil
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		helpers.PrintError("Could not generate UUID", err)
+		os.Exit(1)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func orNoAssertion(s string) string {
+	if s == "" {
+		return "NOASSERTION"
+	}
+	return s
+}
+
+func toolVersion() string {
+	if commit != "" {
+		return commit
+	}
+	return "unsupported custom build"
+}
+
+// SPDX 2.2, https://spdx.github.io/spdx-spec/
+
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Files             []spdxFile         `json:"files"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	SPDXID           string `json:"SPDXID"`
+	Name             string `json:"name"`
+	VersionInfo      string `json:"versionInfo"`
+	DownloadLocation string `json:"downloadLocation"`
+	FilesAnalyzed    bool   `json:"filesAnalyzed"`
+	LicenseConcluded string `json:"licenseConcluded"`
+	LicenseDeclared  string `json:"licenseDeclared"`
+	LicenseComments  string `json:"licenseComments,omitempty"`
+	CopyrightText    string `json:"copyrightText"`
+}
+
+type spdxFile struct {
+	SPDXID           string         `json:"SPDXID"`
+	FileName         string         `json:"fileName"`
+	Checksums        []spdxChecksum `json:"checksums"`
+	LicenseConcluded string         `json:"licenseConcluded"`
+	CopyrightText    string         `json:"copyrightText"`
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// spdxPackageIDs returns the SPDX identifiers of the application and of the packages, keyed by package name.
+// The application gets a prefix of its own so that it can have the same name as a package,
+// and packages whose names differ only in characters not allowed in identifiers are numbered
+func (s *sbom) spdxPackageIDs() (string, map[string]string) {
+	ids := make(map[string]string)
+	used := make(map[string]bool)
+	for _, p := range s.Packages {
+		id := "SPDXRef-Package-" + spdxIDRegexp.ReplaceAllString(p.Name, "-")
+		for i := 2; used[id] == true; i++ {
+			id = fmt.Sprintf("SPDXRef-Package-%s-%d", spdxIDRegexp.ReplaceAllString(p.Name, "-"), i)
+		}
+		used[id] = true
+		ids[p.Name] = id
+	}
+	return "SPDXRef-Application-" + spdxIDRegexp.ReplaceAllString(s.App.Name, "-"), ids
+}
+
+func (s *sbom) spdx() spdxDocument {
+	doc := spdxDocument{
+		SPDXVersion:       "SPDX-2.2",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              s.Name,
+		DocumentNamespace: "https://appimage.org/spdxdocs/" + spdxIDRegexp.ReplaceAllString(s.Name, "-") + "-" + s.UUID,
+		CreationInfo: spdxCreationInfo{
+			Created:  s.Created.Format(time.RFC3339),
+			Creators: []string{"Tool: appimagetool-" + toolVersion()},
+		},
+	}
+	appID, ids := s.spdxPackageIDs()
+	doc.Relationships = append(doc.Relationships, spdxRelationship{"SPDXRef-DOCUMENT", "DESCRIBES", appID})
+
+	fileCounter := 0
+	for _, p := range append([]*sbomPackage{s.App}, s.Packages...) {
+		id := ids[p.Name]
+		if p == s.App {
+			id = appID
+		}
+		sp := spdxPackage{
+			SPDXID:           id,
+			Name:             p.Name,
+			VersionInfo:      orNoAssertion(p.Version),
+			DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  "NOASSERTION",
+			CopyrightText:    "NOASSERTION",
+		}
+		// Package managers do not necessarily use SPDX license identifiers
+		if expression := spdxLicenseExpression(p.License); expression != "" {
+			sp.LicenseDeclared = expression
+		} else if p.License != "" {
+			sp.LicenseComments = "License as declared by the package manager: " + p.License
+		}
+		doc.Packages = append(doc.Packages, sp)
+		for _, f := range p.Files {
+			fileCounter++
+			id := fmt.Sprintf("SPDXRef-File-%d", fileCounter)
+			doc.Files = append(doc.Files, spdxFile{
+				SPDXID:           id,
+				FileName:         "./" + f.Path,
+				Checksums:        []spdxChecksum{{"SHA1", f.SHA1}, {"SHA256", f.SHA256}},
+				LicenseConcluded: "NOASSERTION",
+				CopyrightText:    "NOASSERTION",
+			})
+			doc.Relationships = append(doc.Relationships, spdxRelationship{sp.SPDXID, "CONTAINS", id})
+		}
+		for _, dep := range p.DependsOn {
+			if depID, ok := ids[dep]; ok == true {
+				doc.Relationships = append(doc.Relationships, spdxRelationship{sp.SPDXID, "DEPENDS_ON", depID})
+			}
+		}
+	}
+	return doc
+}
+
+// CycloneDX 1.4, https://cyclonedx.org/docs/1.4/json/
+
+type cdxDocument struct {
+	BOMFormat    string          `json:"bomFormat"`
+	SpecVersion  string          `json:"specVersion"`
+	SerialNumber string          `json:"serialNumber"`
+	Version      int             `json:"version"`
+	Metadata     cdxMetadata     `json:"metadata"`
+	Components   []cdxComponent  `json:"components"`
+	Dependencies []cdxDependency `json:"dependencies"`
+}
+
+type cdxMetadata struct {
+	Timestamp string       `json:"timestamp"`
+	Tools     []cdxTool    `json:"tools"`
+	Component cdxComponent `json:"component"`
+}
+
+type cdxTool struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type cdxComponent struct {
+	Type       string         `json:"type"`
+	BOMRef     string         `json:"bom-ref"`
+	Name       string         `json:"name"`
+	Version    string         `json:"version,omitempty"`
+	Licenses   []cdxLicense   `json:"licenses,omitempty"`
+	Hashes     []cdxHash      `json:"hashes,omitempty"`
+	Components []cdxComponent `json:"components,omitempty"`
+}
+
+type cdxLicense struct {
+	Expression string           `json:"expression,omitempty"`
+	License    *cdxNamedLicense `json:"license,omitempty"`
+}
+
+type cdxNamedLicense struct {
+	Name string `json:"name"`
+}
+
+type cdxHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type cdxDependency struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn"`
+}
+
+func cdxFileComponents(files []*sbomFile) []cdxComponent {
+	var results []cdxComponent
+	for _, f := range files {
+		results = append(results, cdxComponent{
+			Type:   "file",
+			BOMRef: "file:" + f.Path,
+			Name:   f.Path,
+			Hashes: []cdxHash{{"SHA-1", f.SHA1}, {"SHA-256", f.SHA256}},
+		})
+	}
+	return results
+}
+
+func (s *sbom) cycloneDX() cdxDocument {
+	doc := cdxDocument{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.4",
+		SerialNumber: "urn:uuid:" + s.UUID,
+		Version:      1,
+		Metadata: cdxMetadata{
+			Timestamp: s.Created.Format(time.RFC3339),
+			Tools:     []cdxTool{{"appimagetool", toolVersion()}},
+			Component: cdxComponent{
+				Type:    "application",
+				BOMRef:  "app:" + s.App.Name,
+				Name:    s.App.Name,
+				Version: s.App.Version,
+			},
+		},
+		// Files that are not part of any package belong to the application itself
+		Components: cdxFileComponents(s.App.Files),
+	}
+	appDeps := []string{}
+	for _, dep := range s.App.DependsOn {
+		appDeps = append(appDeps, "pkg:"+dep)
+	}
+	doc.Dependencies = append(doc.Dependencies, cdxDependency{doc.Metadata.Component.BOMRef, appDeps})
+
+	for _, p := range s.Packages {
+		c := cdxComponent{
+			Type:       "library",
+			BOMRef:     "pkg:" + p.Name,
+			Name:       p.Name,
+			Version:    p.Version,
+			Components: cdxFileComponents(p.Files),
+		}
+		if expression := spdxLicenseExpression(p.License); expression != "" {
+			c.Licenses = []cdxLicense{{Expression: expression}}
+		} else if p.License != "" {
+			c.Licenses = []cdxLicense{{License: &cdxNamedLicense{p.License}}}
+		}
+		doc.Components = append(doc.Components, c)
+		deps := []string{}
+		for _, dep := range p.DependsOn {
+			deps = append(deps, "pkg:"+dep)
+		}
+		doc.Dependencies = append(doc.Dependencies, cdxDependency{c.BOMRef, deps})
+	}
+	return doc
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/probonopd/go-appimage/internal/helpers"
+)
+
+func TestSPDXLicenseExpression(t *testing.T) {
+	for license, expected := range map[string]string{
+		"MIT":                         "MIT",
+		"GPL-2+":                      "GPL-2.0-or-later",
+		"GPLv3+ and (LGPLv2+ or MIT)": "GPL-3.0-or-later AND (LGPL-2.0-or-later OR MIT)",
+		"ASL 2.0":                     "Apache-2.0",
+		"GPL-2.0+":                    "GPL-2.0+",
+		"GPL-3.0-or-later WITH GCC-exception-3.1": "GPL-3.0-or-later WITH GCC-exception-3.1",
+		"GPL":                 "",
+		"custom":              "",
+		"GPL2 AND custom:foo": "",
+		"MIT AND":             "",
+		"(MIT":                "",
+		"":                    "",
+	} {
+		if got := spdxLicenseExpression(license); got != expected {
+			t.Errorf("Expected %q for %q, got %q", expected, license, got)
+		}
+	}
+}
+
+func TestSPDXPackageIDsAreUnique(t *testing.T) {
+	s := &sbom{
+		App:      &sbomPackage{Name: "foo"},
+		Packages: []*sbomPackage{{Name: "foo"}, {Name: "foo+bar"}, {Name: "foo-bar"}},
+	}
+	appID, ids := s.spdxPackageIDs()
+	seen := map[string]bool{appID: true}
+	for _, id := range ids {
+		if seen[id] == true {
+			t.Error("Duplicate SPDX identifier", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != 4 {
+		t.Error("Expected 4 identifiers, got", seen)
+	}
+}
+
+// fakePackageManager says that every file belongs to the same package
+type fakePackageManager struct{}
+
+func (fakePackageManager) Name() string                                      { return "fake" }
+func (fakePackageManager) Available() bool                                   { return true }
+func (fakePackageManager) PackageContainingFile(path string) (string, error) { return "coreutils", nil }
+func (fakePackageManager) CopyrightFiles(pkg string) ([]string, error)       { return nil, nil }
+func (fakePackageManager) PackageVersion(pkg string) (string, error)         { return "9.1", nil }
+func (fakePackageManager) PackageLicense(pkg string) (string, error)         { return "GPL-3.0-or-later", nil }
+
+func TestSBOMAttributesOnlyDeployedFilesToPackages(t *testing.T) {
+	if helpers.Exists("/usr/bin/true") == false || helpers.Exists("/usr/bin/false") == false {
+		t.Skip("/usr/bin/true and /usr/bin/false are needed")
+	}
+	defer func(pms []packageManager, cache map[string]string) {
+		packageManagers, packagesContainingFiles = pms, cache
+	}(packageManagers, packagesContainingFiles)
+	packageManagers = []packageManager{fakePackageManager{}}
+	packagesContainingFiles = make(map[string]string)
+
+	appdir := tempDir(t)
+	defer os.RemoveAll(appdir)
+	os.MkdirAll(appdir+"/usr/bin", 0755)
+	data, _ := ioutil.ReadFile("/usr/bin/true")
+	// Deployed and changed, e.g., by patchelf, which keeps the build-id
+	ioutil.WriteFile(appdir+"/usr/bin/true", append(append([]byte(nil), data...), 0), 0755)
+	// Built by the application, but there is an unrelated file at the same location on the build system
+	ioutil.WriteFile(appdir+"/usr/bin/false", data, 0755)
+
+	s, err := collectSBOM(appdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owners := make(map[string]string)
+	for _, p := range append([]*sbomPackage{s.App}, s.Packages...) {
+		for _, f := range p.Files {
+			owners[f.Path] = p.Name
+		}
+	}
+	if owners["usr/bin/true"] != "coreutils" {
+		t.Error("Expected usr/bin/true to be attributed to coreutils, got", owners["usr/bin/true"])
+	}
+	if owners["usr/bin/false"] != s.App.Name {
+		t.Error("Expected usr/bin/false to be attributed to the application, got", owners["usr/bin/false"])
+	}
+}
+
+func TestIsSameAsHostFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	host := filepath.Join(dir, "libfoo.so")
+	ioutil.WriteFile(host, []byte("contents"), 0644)
+	_, sha256, _ := hashFile(host)
+	if isSameAsHostFile(host, 8, sha256, "") == false {
+		t.Error("Expected a file with the same contents to be the same")
+	}
+	if isSameAsHostFile(host, 8, "other", "") == true || isSameAsHostFile(host, 9, sha256, "1234") == true {
+		t.Error("Expected a file with other contents and without a matching build-id to differ")
+	}
+	if isSameAsHostFile(filepath.Join(dir, "missing.so"), 8, sha256, "") == true || isSameAsHostFile(dir, 8, sha256, "") == true {
+		t.Error("Expected no match for what is not a file")
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import "strings"
+
+// Package managers declare licenses in their own ways, e.g., "GPL-2+" (Debian), "GPLv2+" (rpm),
+// or "custom" (pacman), which are not valid in SPDX license expressions. Only expressions made of
+// identifiers of the SPDX License List (https://spdx.org/licenses/) may go into SBOMs.
+
+// spdxLicenseIDs are the identifiers of the SPDX License List that packages commonly use
+var spdxLicenseIDs = []string{
+	"0BSD", "AFL-1.1", "AFL-1.2", "AFL-2.0", "AFL-2.1", "AFL-3.0",
+	"AGPL-1.0-only", "AGPL-1.0-or-later", "AGPL-3.0", "AGPL-3.0-only", "AGPL-3.0-or-later",
+	"Apache-1.0", "Apache-1.1", "Apache-2.0", "APSL-2.0", "Artistic-1.0", "Artistic-1.0-Perl", "Artistic-2.0",
+	"Beerware", "Bitstream-Vera", "blessing", "BSD-1-Clause", "BSD-2-Clause", "BSD-2-Clause-Patent",
+	"BSD-3-Clause", "BSD-3-Clause-Attribution", "BSD-3-Clause-Clear", "BSD-3-Clause-LBNL",
+	"BSD-4-Clause", "BSD-4-Clause-UC", "BSD-Source-Code", "BSL-1.0", "bzip2-1.0.6",
+	"CC-BY-3.0", "CC-BY-4.0", "CC-BY-SA-3.0", "CC-BY-SA-4.0", "CC0-1.0", "CDDL-1.0", "CDDL-1.1",
+	"CECILL-2.0", "CECILL-2.1", "CECILL-B", "CECILL-C", "ClArtistic", "CPL-1.0", "curl",
+	"ECL-2.0", "EFL-2.0", "EPL-1.0", "EPL-2.0", "EUPL-1.1", "EUPL-1.2",
+	"FSFAP", "FSFUL", "FSFULLR", "FTL", "GD",
+	"GFDL-1.1-only", "GFDL-1.1-or-later", "GFDL-1.2-only", "GFDL-1.2-or-later", "GFDL-1.3-only", "GFDL-1.3-or-later",
+	"GPL-1.0", "GPL-1.0-only", "GPL-1.0-or-later", "GPL-2.0", "GPL-2.0-only", "GPL-2.0-or-later",
+	"GPL-3.0", "GPL-3.0-only", "GPL-3.0-or-later",
+	"HPND", "HPND-sell-variant", "ICU", "IJG", "Imlib2", "Info-ZIP", "Intel", "IPA", "ISC", "JSON",
+	"LGPL-2.0", "LGPL-2.0-only", "LGPL-2.0-or-later", "LGPL-2.1", "LGPL-2.1-only", "LGPL-2.1-or-later",
+	"LGPL-3.0", "LGPL-3.0-only", "LGPL-3.0-or-later", "Libpng", "libpng-2.0", "libtiff", "LPPL-1.3c",
+	"MirOS", "MIT", "MIT-0", "MIT-advertising", "MIT-CMU", "MIT-open-group", "MPL-1.0", "MPL-1.1", "MPL-2.0",
+	"MPL-2.0-no-copyleft-exception", "MS-PL", "MS-RL", "NCSA", "NTP", "OFL-1.0", "OFL-1.1", "OLDAP-2.8", "OpenSSL",
+	"PHP-3.0", "PHP-3.01", "PostgreSQL", "PSF-2.0", "Python-2.0", "Qhull", "Ruby",
+	"SGI-B-2.0", "Sleepycat", "SMLNJ", "Spencer-94", "Spencer-99", "TCL",
+	"Unicode-DFS-2015", "Unicode-DFS-2016", "Unlicense", "UPL-1.0", "Vim", "W3C", "WTFPL",
+	"X11", "XFree86-1.1", "Xnet", "Zlib", "zlib-acknowledgement", "ZPL-2.0", "ZPL-2.1",
+}
+
+// spdxLicenseExceptionIDs are the identifiers of the SPDX License Exceptions that packages commonly use
+var spdxLicenseExceptionIDs = []string{
+	"Autoconf-exception-2.0", "Autoconf-exception-3.0", "Bison-exception-2.2", "Classpath-exception-2.0",
+	"eCos-exception-2.0", "FLTK-exception", "Font-exception-2.0", "GCC-exception-2.0", "GCC-exception-3.1",
+	"GPL-3.0-linking-exception", "LGPL-3.0-linking-exception", "Libtool-exception", "Linux-syscall-note",
+	"LLVM-exception", "OCaml-LGPL-linking-exception", "openvpn-openssl-exception",
+	"Qt-GPL-exception-1.0", "Qt-LGPL-exception-1.1", "u-boot-exception-2.0", "WxWindows-exception-3.1",
+}
+
+// spdxLicenseAliases maps the names of licenses that package managers use to SPDX license identifiers,
+// as long as there is no doubt which license is meant; keys are lowercase
+var spdxLicenseAliases = map[string]string{
+	// Debian (machine-readable copyright files)
+	"gpl-1+": "GPL-1.0-or-later", "gpl-2": "GPL-2.0-only", "gpl-2+": "GPL-2.0-or-later", "gpl-3": "GPL-3.0-only", "gpl-3+": "GPL-3.0-or-later",
+	"lgpl-2": "LGPL-2.0-only", "lgpl-2+": "LGPL-2.0-or-later", "lgpl-2.1": "LGPL-2.1-only", "lgpl-2.1+": "LGPL-2.1-or-later",
+	"lgpl-3": "LGPL-3.0-only", "lgpl-3+": "LGPL-3.0-or-later", "agpl-3": "AGPL-3.0-only", "agpl-3+": "AGPL-3.0-or-later",
+	"gfdl-1.2+": "GFDL-1.2-or-later", "gfdl-1.3+": "GFDL-1.3-or-later", "expat": "MIT",
+	"bsd-2": "BSD-2-Clause", "bsd-3": "BSD-3-Clause", "bsd-4": "BSD-4-Clause", "apache-2": "Apache-2.0",
+	// rpm (Fedora's legacy short names)
+	"gplv2": "GPL-2.0-only", "gplv2+": "GPL-2.0-or-later", "gplv3": "GPL-3.0-only", "gplv3+": "GPL-3.0-or-later",
+	"lgplv2": "LGPL-2.0-only", "lgplv2+": "LGPL-2.0-or-later", "lgplv3": "LGPL-3.0-only", "lgplv3+": "LGPL-3.0-or-later",
+	"agplv3": "AGPL-3.0-only", "agplv3+": "AGPL-3.0-or-later", "mplv1.1": "MPL-1.1", "mplv2.0": "MPL-2.0",
+	"boost": "BSL-1.0", "psfv2": "PSF-2.0",
+}
+
+// spdxIdentifiers maps lowercase SPDX license identifiers to their canonical spelling
+var spdxIdentifiers = func() map[string]string {
+	results := make(map[string]string)
+	for _, id := range spdxLicenseIDs {
+		results[strings.ToLower(id)] = id
+	}
+	return results
+}()
+
+// spdxExceptionIdentifiers maps lowercase SPDX license exception identifiers to their canonical spelling
+var spdxExceptionIdentifiers = func() map[string]string {
+	results := make(map[string]string)
+	for _, id := range spdxLicenseExceptionIDs {
+		results[strings.ToLower(id)] = id
+	}
+	return results
+}()
+
+// spdxLicenseID returns the SPDX license identifier for the name of a license, or "" if there is none
+func spdxLicenseID(name string) string {
+	if id, ok := spdxIdentifiers[strings.ToLower(name)]; ok == true {
+		return id
+	}
+	if id, ok := spdxLicenseAliases[strings.ToLower(name)]; ok == true {
+		return id
+	}
+	// "+" means "or any later version" in SPDX license expressions, too
+	if id, ok := spdxIdentifiers[strings.ToLower(strings.TrimSuffix(name, "+"))]; ok == true && strings.HasSuffix(name, "+") {
+		return id + "+"
+	}
+	return ""
+}
+
+// spdxLicenseExpression returns the license as declared by a package manager as a valid
+// SPDX license expression, or "" if it cannot be expressed with SPDX license identifiers
+func spdxLicenseExpression(license string) string {
+	license = strings.NewReplacer("(", " ( ", ")", " ) ", "ASL 2.0", "Apache-2.0", "ASL 1.1", "Apache-1.1").Replace(license)
+	var tokens []string
+	depth := 0
+	expectLicense := true // Otherwise an operator or ")"
+	afterWith := false
+	for _, token := range strings.Fields(license) {
+		switch {
+		case token == "(":
+			if expectLicense == false || afterWith == true {
+				return ""
+			}
+			depth++
+		case token == ")":
+			if expectLicense == true || depth == 0 {
+				return ""
+			}
+			depth--
+		case strings.EqualFold(token, "AND") || strings.EqualFold(token, "OR") || strings.EqualFold(token, "WITH"):
+			if expectLicense == true {
+				return ""
+			}
+			token = strings.ToUpper(token)
+			afterWith = token == "WITH"
+			expectLicense = true
+		default:
+			if expectLicense == false {
+				return ""
+			}
+			if afterWith == true {
+				token = spdxExceptionIdentifiers[strings.ToLower(token)]
+			} else {
+				token = spdxLicenseID(token)
+			}
+			if token == "" {
+				return ""
+			}
+			afterWith = false
+			expectLicense = false
+		}
+		tokens = append(tokens, token)
+	}
+	if expectLicense == true || depth != 0 {
+		return ""
+	}
+	return strings.NewReplacer("( ", "(", " )", ")").Replace(strings.Join(tokens, " "))
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"debug/elf"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/probonopd/go-appimage/internal/helpers"
+)
+
+// Libraries are deployed as they are installed on the build system, which is often with
+// full debug information. Stripping them makes the AppImage considerably smaller.
+// To still be able to symbolize crash reports, the debug information can be split off
+// into separate .debug files (objcopy --only-keep-debug) which are collected in a sidecar
+// archive. Debuggers find them by build-id in usr/lib/debug/.build-id/xx/yyyyyyyy.debug
+// once gdb is told where the archive was unpacked, e.g.,
+//
+//	tar xf MyApp-debug.tar.gz -C squashfs-root
+//	gdb -ex "set debug-file-directory $PWD/squashfs-root/usr/lib/debug" ...
+//
+// ELFs without build-id get a .gnu_debuglink section, which only contains the name of the
+// debug file. gdb looks for it in the directory of the ELF and in .debug below it, or below
+// debug-file-directory by the absolute path of the ELF, which differs whenever the AppImage
+// is mounted. Hence these debug files go to <directory in the AppDir>/.debug/<name>.debug,
+// which gdb finds when the archive is unpacked into the extracted AppImage as shown above.
+
+// stripModes are the supported values for --strip
+var stripModes = map[string][]string{
+	"debug": {"--strip-debug"},    // Keep .symtab, so that backtraces still have function names
+	"all":   {"--strip-unneeded"}, // Keep only what is needed for dynamic linking
+}
+
+// checkStripMode returns an error if mode is not one of stripModes
+func checkStripMode(mode string) error {
+	if _, ok := stripModes[mode]; ok == false {
+		return errors.New("unsupported strip mode '" + mode + "', supported are debug, all")
+	}
+	return nil
+}
+
+// stripELFsInAppDir strips all ELF files in the AppDir according to mode,
+// and writes the debug information into a gzipped tar archive at debugArchive unless it is ""
+func stripELFsInAppDir(appdir helpers.AppDir, mode string, debugArchive string) error {
+	err := checkStripMode(mode)
+	if err != nil {
+		return err
+	}
+	stripArgs := stripModes[mode]
+	helpers.CheckIfAllToolsArePresent([]string{"strip", "objcopy"})
+
+	debugDir := ""
+	if debugArchive != "" {
+		var err error
+		debugDir, err = ioutil.TempDir("", "appimagetool-debug-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(debugDir)
+	}
+
+	var bytesBefore, bytesAfter int64
+	err = filepath.Walk(appdir.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() == false {
+			return nil
+		}
+		e, err := elf.Open(path)
+		if err != nil {
+			// Not an ELF file
+			return nil
+		}
+		hasDebugInfo := e.Section(".debug_info") != nil
+		hasSymtab := e.Section(".symtab") != nil
+		buildID := getBuildID(e)
+		e.Close()
+		if hasDebugInfo == false && (mode == "debug" || hasSymtab == false) {
+			return nil
+		}
+		// Stripping the dynamic loader makes it impossible to debug anything, and it is small
+		if strings.HasPrefix(filepath.Base(path), "ld-linux") || strings.HasPrefix(filepath.Base(path), "ld-musl") {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(appdir.Path, path)
+		if debugDir != "" && hasDebugInfo == true {
+			err = splitDebugInfo(path, rel, buildID, debugDir)
+			if err != nil {
+				return err
+			}
+		}
+
+		cmd := exec.Command("strip", append(stripArgs, path)...)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			log.Println(cmd.String())
+			return errors.New("could not strip " + rel + ": " + strings.TrimSpace(string(out)))
+		}
+
+		if debugDir != "" && hasDebugInfo == true && buildID == "" {
+			// Without build-id, debuggers find the debug file by the name in .gnu_debuglink;
+			// objcopy needs the path to compute the checksum, but only stores the name
+			cmd = exec.Command("objcopy", "--add-gnu-debuglink="+debugFilePath(debugDir, rel, ""), path)
+			out, err = cmd.CombinedOutput()
+			if err != nil {
+				log.Println(cmd.String())
+				return errors.New("could not add debuglink to " + rel + ": " + strings.TrimSpace(string(out)))
+			}
+		}
+
+		stripped, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		bytesBefore = bytesBefore + info.Size()
+		bytesAfter = bytesAfter + stripped.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Println("Stripping saved", bytesBefore-bytesAfter, "bytes")
+
+	if debugDir != "" {
+		log.Println("Writing debug information to", debugArchive)
+		log.Println("To use it, unpack it into the extracted AppImage and set debug-file-directory in gdb to its usr/lib/debug")
+		return writeTarGz(debugDir, debugArchive)
+	}
+	return nil
+}
+
+// debugFilePath returns where the debug information of the ELF at rel in the AppDir goes in debugDir,
+// which is laid out like the AppDir: by build-id in usr/lib/debug if it has one,
+// otherwise in .debug next to where the ELF is
+func debugFilePath(debugDir string, rel string, buildID string) string {
+	if len(buildID) > 2 {
+		return debugDir + "/usr/lib/debug/.build-id/" + buildID[:2] + "/" + buildID[2:] + ".debug"
+	}
+	return filepath.Join(debugDir, filepath.Dir(rel), ".debug", filepath.Base(rel)+".debug")
+}
+
+// splitDebugInfo writes the debug information of the ELF at path into debugDir,
+// at the location where debuggers look for it
+func splitDebugInfo(path string, rel string, buildID string, debugDir string) error {
+	target := debugFilePath(debugDir, rel, buildID)
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("objcopy", "--only-keep-debug", "--compress-debug-sections", path, target)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		log.Println(cmd.String())
+		return errors.New("could not split debug information from " + rel + ": " + strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// getBuildID returns the GNU build-id of the ELF as a hex string, or ""
+func getBuildID(e *elf.File) string {
+	section := e.Section(".note.gnu.build-id")
+	if section == nil {
+		return ""
+	}
+	data, err := section.Data()
+	if err != nil || len(data) < 16 {
+		return ""
+	}
+	// Elf_Nhdr: namesz, descsz, type; followed by the name "GNU\0" and the descriptor
+	nameSize := e.ByteOrder.Uint32(data[0:4])
+	descSize := e.ByteOrder.Uint32(data[4:8])
+	descOffset := 12 + (nameSize+3)&^3
+	if uint32(len(data)) < descOffset+descSize {
+		return ""
+	}
+	return hex.EncodeToString(data[descOffset : descOffset+descSize])
+}
+
+// writeTarGz writes the contents of dir into a gzipped tar archive at path
+func writeTarGz(dir string, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		if rel == "." {
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		if info.IsDir() {
+			hdr.Name = rel + "/"
+		}
+		err = tw.WriteHeader(hdr)
+		if err != nil || info.Mode().IsRegular() == false {
+			return err
+		}
+		src, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	return gw.Close()
+}
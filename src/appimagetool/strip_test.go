@@ -0,0 +1,16 @@
+package main
+
+import "testing"
+
+func TestDebugFilePath(t *testing.T) {
+	for _, c := range [][4]string{
+		{"usr/lib/libfoo.so.1", "c89156ebdabf859f4ee70cb0c303004dccf1ae51", "/d/usr/lib/debug/.build-id/c8/9156ebdabf859f4ee70cb0c303004dccf1ae51.debug"},
+		// Where gdb looks for the name in .gnu_debuglink, relative to the ELF
+		{"usr/lib/libfoo.so.1", "", "/d/usr/lib/.debug/libfoo.so.1.debug"},
+		{"AppRun", "", "/d/.debug/AppRun.debug"},
+	} {
+		if path := debugFilePath("/d", c[0], c[1]); path != c[2] {
+			t.Error("Expected", c[2], "for", c[0], "got", path)
+		}
+	}
+}
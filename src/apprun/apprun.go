@@ -0,0 +1,296 @@
+// apprun is a compiled AppRun that can be used instead of the AppRun shell script.
+// Rather than searching the AppDir at every launch, it reads AppRun.env which is
+// written by 'appimagetool deploy --native-apprun' and contains only what the bundle needs.
+//
+// AppRun.env contains one assignment per line; empty lines and lines starting with # are ignored:
+//
+//	APPRUN_EXEC=usr/bin/myapp                  # Main executable, relative to the AppDir (required)
+//	APPRUN_LD_LINUX=lib64/ld-linux-x86-64.so.2 # Bundled dynamic loader to run the main executable with
+//	APPRUN_LIBRARY_PATH=lib/x86_64-linux-gnu   # Passed to the bundled dynamic loader with --library-path
+//	APPRUN_WORKDIR=usr                         # Directory to change into, relative to the AppDir
+//	APPRUN_ENTRYPOINTS=usr/bin/a:usr/bin/b     # Other executables that can be run instead of the main executable
+//	PATH=$APPDIR/usr/bin:$PATH                 # Any other variable gets exported
+//
+// $APPDIR expands to the AppDir, and other variables expand to their current values,
+// so that bundled paths can be prepended. An entry point is run instead of the main executable
+// if the AppImage was invoked by its name ($ARGV0 as set by the AppImage runtime, or argv[0],
+// e.g., through a symlink) or if its name is the first argument, which then gets removed.
+//
+// Since the environment is inherited by processes the application launches, the original value
+// of every variable that gets changed is saved in APPRUN_ORIGINAL_<NAME>, APPRUN_UNSET lists
+// the names of the changed variables which were unset, and APPRUN_MODIFIED lists the names
+// of all changed variables, separated by ":". This way, the host environment can be restored,
+// e.g., by libapprun_hooks or by the application itself, before launching something from the host.
+// When an AppImage launches another one, the original values are those of the host, not those
+// the first AppImage set.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// envFileName is the name of the file in the AppDir that describes the environment
+const envFileName = "AppRun.env"
+
+// originalPrefix is the prefix of the variables in which the original values are saved
+const originalPrefix = "APPRUN_ORIGINAL_"
+
+// The variables that list the names of the changed variables, and of those which were unset
+const (
+	modifiedVariable = "APPRUN_MODIFIED"
+	unsetVariable    = "APPRUN_UNSET"
+)
+
+// launch describes how to run the main executable of the AppDir
+type launch struct {
+	Exec    string // Absolute path to the main executable
+	LdLinux string // Absolute path to the bundled dynamic loader, or ""
+	// Absolute paths for the bundled dynamic loader only, separated by ":", which unlike
+	// LD_LIBRARY_PATH are not inherited by what the application launches
+	LibraryPath string
+	WorkDir     string   // Absolute path of the directory to change into, or ""
+	Env         []string // The environment in os.Environ() format
+	// Absolute paths to the executables that can be run instead of Exec
+	EntryPoints []string
+}
+
+func main() {
+	appdir := os.Getenv("APPDIR") // Set by the AppImage runtime
+	if appdir == "" {
+		self, err := os.Executable()
+		if err == nil {
+			self, err = filepath.EvalSymlinks(self)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "AppRun: Could not determine the AppDir:", err)
+			os.Exit(1)
+		}
+		appdir = filepath.Dir(self)
+	}
+
+	f, err := os.Open(filepath.Join(appdir, envFileName))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "AppRun:", err)
+		os.Exit(1)
+	}
+	l, err := prepareLaunch(appdir, f, os.Environ())
+	f.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "AppRun:", err)
+		os.Exit(1)
+	}
+
+	if l.WorkDir != "" {
+		err = os.Chdir(l.WorkDir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "AppRun:", err)
+			os.Exit(1)
+		}
+	}
+
+	argv0 := os.Getenv("ARGV0") // Set by the AppImage runtime
+	if argv0 == "" {
+		argv0 = os.Args[0]
+	}
+	exe, args := l.selectExec(argv0, os.Args[1:])
+	binary, argv := l.commandLine(exe, args)
+	err = syscall.Exec(binary, argv, l.Env)
+	fmt.Fprintln(os.Stderr, "AppRun: Could not execute", binary+":", err)
+	os.Exit(1)
+}
+
+// prepareLaunch reads the AppRun.env from r and applies it to environ
+func prepareLaunch(appdir string, r io.Reader, environ []string) (launch, error) {
+	var l launch
+	env := newEnvironment(environ)
+	// Like the AppImage runtime does; not something that needs to be restored
+	if _, ok := env.values["APPDIR"]; ok == false {
+		env.names = append(env.names, "APPDIR")
+	}
+	env.values["APPDIR"] = appdir
+
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return l, fmt.Errorf("%s:%d: not an assignment: %s", envFileName, lineNumber, line)
+		}
+		name := strings.TrimSpace(parts[0])
+		value := os.Expand(strings.TrimSpace(parts[1]), env.get)
+		switch name {
+		case "APPRUN_EXEC":
+			l.Exec = filepath.Join(appdir, value)
+		case "APPRUN_LD_LINUX":
+			l.LdLinux = filepath.Join(appdir, value)
+		case "APPRUN_LIBRARY_PATH":
+			var dirs []string
+			for _, dir := range strings.Split(value, ":") {
+				if dir != "" {
+					dirs = append(dirs, filepath.Join(appdir, dir))
+				}
+			}
+			l.LibraryPath = strings.Join(dirs, ":")
+		case "APPRUN_WORKDIR":
+			l.WorkDir = filepath.Join(appdir, value)
+		case "APPRUN_ENTRYPOINTS":
+			for _, entryPoint := range strings.Split(value, ":") {
+				if entryPoint != "" {
+					l.EntryPoints = append(l.EntryPoints, filepath.Join(appdir, entryPoint))
+				}
+			}
+		default:
+			env.set(name, cleanPathList(value))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return l, err
+	}
+	if l.Exec == "" {
+		return l, errors.New(envFileName + " does not contain APPRUN_EXEC")
+	}
+	l.Env = env.environ()
+	return l, nil
+}
+
+// selectExec returns the entry point to run given the name the AppImage was invoked by
+// and the arguments, and the arguments to pass to it
+func (l launch) selectExec(argv0 string, args []string) (string, []string) {
+	for _, entryPoint := range l.EntryPoints {
+		if filepath.Base(argv0) == filepath.Base(entryPoint) {
+			return entryPoint, args
+		}
+	}
+	if len(args) > 0 {
+		for _, entryPoint := range l.EntryPoints {
+			if args[0] == filepath.Base(entryPoint) {
+				return entryPoint, args[1:]
+			}
+		}
+	}
+	return l.Exec, args
+}
+
+// commandLine returns the binary to execute and its arguments to run exe with args,
+// which is the bundled dynamic loader if there is one
+func (l launch) commandLine(exe string, args []string) (string, []string) {
+	argv := append([]string{exe}, args...)
+	if l.LdLinux == "" {
+		return exe, argv
+	}
+	if l.LibraryPath != "" {
+		argv = append([]string{"--library-path", l.LibraryPath}, argv...)
+	}
+	return l.LdLinux, append([]string{l.LdLinux}, argv...)
+}
+
+// cleanPathList removes empty elements from a ":"-separated list,
+// which result from prepending to a variable that was unset.
+// An empty element in, e.g., LD_LIBRARY_PATH would mean the current directory
+func cleanPathList(value string) string {
+	if strings.Contains(value, ":") == false {
+		return value
+	}
+	var elements []string
+	for _, element := range strings.Split(value, ":") {
+		if element != "" {
+			elements = append(elements, element)
+		}
+	}
+	return strings.Join(elements, ":")
+}
+
+// environment is an environment that remembers the original values of what gets changed
+type environment struct {
+	names    []string // In order of appearance
+	values   map[string]string
+	modified []string // Including those changed by an AppImage that launched this one
+	unset    []string
+}
+
+func newEnvironment(environ []string) *environment {
+	env := environment{values: make(map[string]string)}
+	for _, kv := range environ {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if _, ok := env.values[parts[0]]; ok == false {
+			env.names = append(env.names, parts[0])
+		}
+		env.values[parts[0]] = parts[1]
+	}
+	env.modified = splitNames(env.values[modifiedVariable])
+	env.unset = splitNames(env.values[unsetVariable])
+	return &env
+}
+
+// splitNames returns the names in a list separated by ":"
+func splitNames(list string) []string {
+	var names []string
+	for _, name := range strings.Split(list, ":") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (env *environment) get(name string) string {
+	return env.values[name]
+}
+
+func (env *environment) set(name string, value string) {
+	original, ok := env.values[name]
+	// What was saved when the variable was changed before, possibly by an AppImage
+	// that launched this one, is the original value
+	_, saved := env.values[originalPrefix+name]
+	if contains(env.modified, name) == false && saved == false {
+		if ok == true {
+			env.names = append(env.names, originalPrefix+name)
+			env.values[originalPrefix+name] = original
+		} else if contains(env.unset, name) == false {
+			env.unset = append(env.unset, name)
+		}
+	}
+	if contains(env.modified, name) == false {
+		env.modified = append(env.modified, name)
+	}
+	if ok == false {
+		env.names = append(env.names, name)
+	}
+	env.values[name] = value
+}
+
+func (env *environment) environ() []string {
+	var results []string
+	for _, name := range env.names {
+		if name == modifiedVariable || name == unsetVariable {
+			// From an AppImage that launched this one, included in what is appended below
+			continue
+		}
+		results = append(results, name+"="+env.values[name])
+	}
+	return append(results, modifiedVariable+"="+strings.Join(env.modified, ":"), unsetVariable+"="+strings.Join(env.unset, ":"))
+}
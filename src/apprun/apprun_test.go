@@ -0,0 +1,156 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func lookup(environ []string, name string) (string, bool) {
+	for _, kv := range environ {
+		if strings.HasPrefix(kv, name+"=") {
+			return strings.TrimPrefix(kv, name+"="), true
+		}
+	}
+	return "", false
+}
+
+func TestPrepareLaunch(t *testing.T) {
+	envFile := `# Generated by appimagetool
+APPRUN_EXEC=usr/bin/myapp
+APPRUN_LD_LINUX=lib64/ld-linux-x86-64.so.2
+APPRUN_WORKDIR=usr
+
+PATH=$APPDIR/usr/bin:$PATH
+LD_LIBRARY_PATH=$APPDIR/usr/lib:$LD_LIBRARY_PATH
+GTK_THEME=Default
+`
+	l, err := prepareLaunch("/tmp/.mount_x", strings.NewReader(envFile), []string{"PATH=/usr/bin:/bin", "HOME=/home/me"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Exec != "/tmp/.mount_x/usr/bin/myapp" {
+		t.Error("Exec:", l.Exec)
+	}
+	if l.LdLinux != "/tmp/.mount_x/lib64/ld-linux-x86-64.so.2" {
+		t.Error("LdLinux:", l.LdLinux)
+	}
+	if l.WorkDir != "/tmp/.mount_x/usr" {
+		t.Error("WorkDir:", l.WorkDir)
+	}
+
+	expected := map[string]string{
+		"PATH":                 "/tmp/.mount_x/usr/bin:/usr/bin:/bin",
+		"APPRUN_ORIGINAL_PATH": "/usr/bin:/bin",
+		"LD_LIBRARY_PATH":      "/tmp/.mount_x/usr/lib", // No trailing ":", which would mean the current directory
+		"GTK_THEME":            "Default",
+		"HOME":                 "/home/me",
+		"APPDIR":               "/tmp/.mount_x",
+		"APPRUN_MODIFIED":      "PATH:LD_LIBRARY_PATH:GTK_THEME",
+		"APPRUN_UNSET":         "LD_LIBRARY_PATH:GTK_THEME",
+	}
+	for name, value := range expected {
+		v, ok := lookup(l.Env, name)
+		if ok == false || v != value {
+			t.Errorf("%s: expected '%s', got '%s'", name, value, v)
+		}
+	}
+	// Variables that were unset have no original value, so that they can be unset again
+	for _, name := range []string{"APPRUN_ORIGINAL_LD_LIBRARY_PATH", "APPRUN_ORIGINAL_GTK_THEME", "APPRUN_ORIGINAL_APPDIR"} {
+		if _, ok := lookup(l.Env, name); ok == true {
+			t.Error(name, "should not be set")
+		}
+	}
+}
+
+func TestPrepareNestedLaunch(t *testing.T) {
+	envFile := "APPRUN_EXEC=usr/bin/other\nPATH=$APPDIR/usr/bin:$PATH\nGTK_THEME=Other\nQT_PLUGIN_PATH=$APPDIR/usr/plugins\n"
+	parent := []string{
+		"PATH=/tmp/.mount_x/usr/bin:/usr/bin:/bin",
+		"APPRUN_ORIGINAL_PATH=/usr/bin:/bin",
+		"GTK_THEME=Default",
+		"APPRUN_MODIFIED=PATH:GTK_THEME",
+		"APPRUN_UNSET=GTK_THEME",
+	}
+	l, err := prepareLaunch("/tmp/.mount_y", strings.NewReader(envFile), parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"PATH":                 "/tmp/.mount_y/usr/bin:/tmp/.mount_x/usr/bin:/usr/bin:/bin",
+		"APPRUN_ORIGINAL_PATH": "/usr/bin:/bin", // Not what the first AppImage set
+		"GTK_THEME":            "Other",
+		"APPRUN_MODIFIED":      "PATH:GTK_THEME:QT_PLUGIN_PATH",
+		"APPRUN_UNSET":         "GTK_THEME:QT_PLUGIN_PATH",
+	}
+	for name, value := range expected {
+		v, ok := lookup(l.Env, name)
+		if ok == false || v != value {
+			t.Errorf("%s: expected '%s', got '%s'", name, value, v)
+		}
+	}
+	if _, ok := lookup(l.Env, "APPRUN_ORIGINAL_GTK_THEME"); ok == true {
+		t.Error("The value set by the first AppImage should not be saved as the original value")
+	}
+	if strings.Count(strings.Join(l.Env, "\n"), "APPRUN_MODIFIED=") != 1 {
+		t.Error("APPRUN_MODIFIED should be set once, got", l.Env)
+	}
+}
+
+func TestPrepareLaunchErrors(t *testing.T) {
+	_, err := prepareLaunch("/appdir", strings.NewReader("PATH=$APPDIR/usr/bin:$PATH\n"), nil)
+	if err == nil {
+		t.Error("Missing APPRUN_EXEC should be an error")
+	}
+	_, err = prepareLaunch("/appdir", strings.NewReader("APPRUN_EXEC=usr/bin/myapp\nthis is not an assignment\n"), nil)
+	if err == nil {
+		t.Error("A line without assignment should be an error")
+	}
+}
+
+func TestSelectExec(t *testing.T) {
+	envFile := "APPRUN_EXEC=usr/bin/office\nAPPRUN_ENTRYPOINTS=usr/bin/writer:usr/bin/calc\n"
+	l, err := prepareLaunch("/appdir", strings.NewReader(envFile), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		argv0    string
+		args     []string
+		expected string
+		nargs    int
+	}{
+		{"/home/me/Office.AppImage", []string{"file.odt"}, "/appdir/usr/bin/office", 1},
+		{"/home/me/bin/calc", []string{"file.ods"}, "/appdir/usr/bin/calc", 1},
+		{"/home/me/Office.AppImage", []string{"writer", "file.odt"}, "/appdir/usr/bin/writer", 1},
+		{"/home/me/Office.AppImage", nil, "/appdir/usr/bin/office", 0},
+	}
+	for _, test := range tests {
+		exe, args := l.selectExec(test.argv0, test.args)
+		if exe != test.expected || len(args) != test.nargs {
+			t.Errorf("%s %v: expected %s with %d arguments, got %s %v", test.argv0, test.args, test.expected, test.nargs, exe, args)
+		}
+	}
+}
+
+func TestCommandLine(t *testing.T) {
+	envFile := "APPRUN_EXEC=usr/bin/myapp\nAPPRUN_LD_LINUX=lib64/ld-linux-x86-64.so.2\nAPPRUN_LIBRARY_PATH=lib/x86_64-linux-gnu:\n"
+	l, err := prepareLaunch("/appdir", strings.NewReader(envFile), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary, argv := l.commandLine(l.Exec, []string{"file.txt"})
+	expected := "/appdir/lib64/ld-linux-x86-64.so.2 --library-path /appdir/lib/x86_64-linux-gnu /appdir/usr/bin/myapp file.txt"
+	if binary != "/appdir/lib64/ld-linux-x86-64.so.2" || strings.Join(argv, " ") != expected {
+		t.Error("Expected", expected, "got", binary, argv)
+	}
+	// The library path is not exported to what the application launches
+	if _, ok := lookup(l.Env, "APPRUN_LIBRARY_PATH"); ok == true {
+		t.Error("APPRUN_LIBRARY_PATH should not be exported")
+	}
+
+	l.LdLinux = ""
+	binary, argv = l.commandLine(l.Exec, nil)
+	if binary != "/appdir/usr/bin/myapp" || len(argv) != 1 {
+		t.Error("Expected the main executable to be run directly, got", binary, argv)
+	}
+}
@@ -165,6 +165,12 @@ func (ai AppImage) ExtractFileReader(filepath string) (io.ReadCloser, error) {
 	return ai.reader.FileReader(filepath)
 }
 
+//ListFiles returns the names of the files in the directory at path in the AppImage.
+//Returns nil if the path is not pointing to a directory.
+func (ai AppImage) ListFiles(path string) []string {
+	return ai.reader.ListFiles(path)
+}
+
 //Thumbnail tries to get the AppImage's thumbnail and returns it as a io.ReadCloser.
 func (ai AppImage) Thumbnail() (io.ReadCloser, error) {
 	return ai.reader.FileReader(".DirIcon")
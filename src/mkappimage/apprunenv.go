@@ -0,0 +1 @@
+../appimagetool/apprunenv.go
\ No newline at end of file
@@ -0,0 +1 @@
+../appimagetool/apprunhooks.go
\ No newline at end of file
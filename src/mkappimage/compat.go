@@ -0,0 +1 @@
+../appimagetool/compat.go
\ No newline at end of file
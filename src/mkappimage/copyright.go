@@ -0,0 +1 @@
+../appimagetool/copyright.go
\ No newline at end of file
@@ -0,0 +1 @@
+../appimagetool/dlopen.go
\ No newline at end of file
@@ -0,0 +1 @@
+../appimagetool/entrypoints.go
\ No newline at end of file
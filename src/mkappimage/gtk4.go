@@ -0,0 +1 @@
+../appimagetool/gtk4.go
\ No newline at end of file
@@ -0,0 +1 @@
+../appimagetool/musl.go
\ No newline at end of file
@@ -0,0 +1 @@
+../appimagetool/python.go
\ No newline at end of file
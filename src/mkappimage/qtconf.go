@@ -0,0 +1 @@
+../appimagetool/qtconf.go
\ No newline at end of file
@@ -0,0 +1 @@
+../appimagetool/runtimedata.go
\ No newline at end of file
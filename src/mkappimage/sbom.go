@@ -0,0 +1 @@
+../appimagetool/sbom.go
\ No newline at end of file
@@ -0,0 +1 @@
+../appimagetool/spdxlicenses.go
\ No newline at end of file
@@ -0,0 +1 @@
+../appimagetool/strip.go
\ No newline at end of file